@@ -1,44 +1,244 @@
 package aws
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
 	"github.com/rs/zerolog/log"
 )
 
-type songCache struct {
-	songs []S3Song
-	mu    sync.Mutex
+// Cache holds the last successfully loaded copy of a content listing (audio,
+// sheet music, shows) so pages never wait on S3. Readers always get the
+// current copy, even while a refresh is running or after one failed
+// (stale-while-revalidate), and concurrent refreshes are coalesced.
+type Cache[T any] struct {
+	name string
+	load func(ctx context.Context) ([]T, error)
+	// maxSnapshotAge, if set, is how old a disk snapshot may be and still be
+	// restored (e.g. audio items embed presigned URLs that expire).
+	maxSnapshotAge time.Duration
+
+	mu           sync.Mutex
+	items        []T
+	refreshedAt  time.Time
+	lastErr      error
+	lastDuration time.Duration
+	generation   uint64
+
+	// running is set while a refresh is loading. Refresh calls arriving in
+	// the meantime set pending and wait on followUp, which is closed once
+	// the single queued follow-up run completes.
+	running  bool
+	pending  bool
+	followUp chan struct{}
+}
+
+// CacheStatus is a point-in-time summary of a Cache, for diagnostics.
+type CacheStatus struct {
+	Name         string
+	Entries      int
+	RefreshedAt  time.Time
+	LastError    string
+	LastDuration time.Duration
+	Generation   uint64
+	Refreshing   bool
 }
 
-var cache = songCache{}
+// NewCache returns an empty cache that fills itself by calling load.
+func NewCache[T any](name string, load func(ctx context.Context) ([]T, error)) *Cache[T] {
+	return &Cache[T]{name: name, load: load}
+}
 
-func GetCachedAudio() ([]S3Song, error) {
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-	return cache.songs, nil
+// Get returns a copy of the cached items.
+func (c *Cache[T]) Get() []T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cp := make([]T, len(c.items))
+	// shallow copy the cache slice
+	copy(cp, c.items)
+	return cp
 }
 
-// UpdateAudioCacheOnPresignExpiry resolves bug where presignedURLs become stale
-// if cache not updated
-func UpdateAudioCacheOnPresignExpiry() {
+// Status reports when the cache last refreshed and how that went.
+func (c *Cache[T]) Status() CacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := CacheStatus{
+		Name:         c.name,
+		Entries:      len(c.items),
+		RefreshedAt:  c.refreshedAt,
+		LastDuration: c.lastDuration,
+		Generation:   c.generation,
+		Refreshing:   c.running,
+	}
+	if c.lastErr != nil {
+		st.LastError = c.lastErr.Error()
+	}
+	return st
+}
+
+// Refresh reloads the cache. If a refresh is already in flight it may have
+// listed before whatever change prompted this call, so instead of starting a
+// second concurrent load, exactly one follow-up run is queued behind it and
+// every caller arriving meanwhile waits for that run. On failure the
+// previous items are kept and the error is recorded.
+func (c *Cache[T]) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	if c.running {
+		c.pending = true
+		if c.followUp == nil {
+			c.followUp = make(chan struct{})
+		}
+		wait := c.followUp
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.lastErr
+	}
+	c.running = true
+	c.mu.Unlock()
+
+	var finished chan struct{}
 	for {
-		time.Sleep(PresignURLExpiry - 30*time.Minute)
-		UpdateAudioCache()
+		err := c.runOnce(ctx)
+
+		c.mu.Lock()
+		if finished != nil {
+			close(finished)
+		}
+		if !c.pending {
+			c.running = false
+			c.mu.Unlock()
+			return err
+		}
+		c.pending = false
+		finished = c.followUp
+		c.followUp = nil
+		c.mu.Unlock()
 	}
 }
 
-func UpdateAudioCache() {
-	log.Debug().Msg("Updating song cache...")
-	songs, err := GetAudioFromS3()
-	log.Debug().Msgf("Found %d songs in S3", len(songs))
+func (c *Cache[T]) runOnce(ctx context.Context) error {
+	log.Debug().Msgf("Updating %s cache...", c.name)
+	start := time.Now()
+	items, err := c.load(ctx)
+	elapsed := time.Since(start)
+
+	c.mu.Lock()
+	c.lastDuration = elapsed
+	wasFailing := c.lastErr != nil
 	if err != nil {
-		log.Error().Msgf("Failed to update cache: %v", err)
-		return
+		c.lastErr = err
+		stale := len(c.items)
+		log.Error().Err(err).Msgf("Failed to update %s cache; keeping %d stale entries", c.name, stale)
+		c.mu.Unlock()
+		// only the first failure in a row is worth a notification
+		if !wasFailing {
+			notify.Record(ctx, c.name+" cache", "cache_refresh_failing", c.name+" cache refresh failed", fmt.Sprintf("%v; serving %d stale entries", err, stale))
+		}
+		return err
+	}
+	c.items = items
+	c.lastErr = nil
+	c.refreshedAt = time.Now()
+	c.generation++
+	log.Info().Msgf("%s cache updated, %d entries in %v", c.name, len(items), elapsed.Round(time.Millisecond))
+	c.mu.Unlock()
+
+	saveCacheSnapshot()
+	if wasFailing {
+		notify.Record(ctx, c.name+" cache", "cache_refresh_recovered", c.name+" cache refreshing again", "")
 	}
+	return nil
+}
+
+// snapshot captures the cache contents for persisting to disk.
+func (c *Cache[T]) snapshot() (cacheSnapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items, err := json.Marshal(c.items)
+	if err != nil {
+		return cacheSnapshot{}, err
+	}
+	return cacheSnapshot{RefreshedAt: c.refreshedAt, Items: items}, nil
+}
 
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-	cache.songs = songs
+// restore fills an empty cache from a snapshot, reporting whether it did.
+// Snapshots older than maxSnapshotAge are ignored.
+func (c *Cache[T]) restore(snap cacheSnapshot) (bool, error) {
+	if snap.RefreshedAt.IsZero() {
+		return false, nil
+	}
+	if c.maxSnapshotAge > 0 && time.Since(snap.RefreshedAt) > c.maxSnapshotAge {
+		log.Info().Msgf("%s cache snapshot from %v is too old to use", c.name, snap.RefreshedAt)
+		return false, nil
+	}
+	var items []T
+	if err := json.Unmarshal(snap.Items, &items); err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation > 0 {
+		// already loaded live data; don't clobber it with older data
+		return false, nil
+	}
+	c.items = items
+	c.refreshedAt = snap.RefreshedAt
+	return true, nil
+}
+
+var audioCache = &Cache[S3Song]{
+	name: "audio",
+	load: func(ctx context.Context) ([]S3Song, error) {
+		return GetAudioFromS3()
+	},
+	// a restored entry is only useful while its presigned URLs still work
+	maxSnapshotAge: PresignURLExpiry - 5*time.Minute,
+}
+
+func GetCachedAudio() ([]S3Song, error) {
+	return audioCache.Get(), nil
+}
+
+// contentCache is the type-independent view of a Cache used to manage all
+// content caches together.
+type contentCache interface {
+	Status() CacheStatus
+	Refresh(ctx context.Context) error
+	snapshot() (cacheSnapshot, error)
+	restore(snap cacheSnapshot) (bool, error)
+}
+
+var contentCaches = []contentCache{audioCache, sheetCache, showsCache}
+
+// CacheStatuses reports the state of every content cache.
+func CacheStatuses() []CacheStatus {
+	out := make([]CacheStatus, 0, len(contentCaches))
+	for _, c := range contentCaches {
+		out = append(out, c.Status())
+	}
+	return out
+}
+
+// AudioPresignRefreshInterval is how often the audio cache must be rebuilt so
+// its presigned URLs are replaced before they expire.
+const AudioPresignRefreshInterval = PresignURLExpiry - 30*time.Minute
+
+// RefreshAudioCache reloads the audio cache, re-presigning every URL.
+func RefreshAudioCache(ctx context.Context) error {
+	return audioCache.Refresh(ctx)
+}
+
+func UpdateAudioCache() {
+	_ = audioCache.Refresh(context.Background())
 }
@@ -0,0 +1,112 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKeepsStaleItemsOnError(t *testing.T) {
+	fail := false
+	c := NewCache("test", func(ctx context.Context) ([]string, error) {
+		if fail {
+			return nil, errors.New("s3 unreachable")
+		}
+		return []string{"a", "b"}, nil
+	})
+
+	require.NoError(t, c.Refresh(context.Background()))
+	require.Equal(t, []string{"a", "b"}, c.Get())
+	st := c.Status()
+	require.Equal(t, uint64(1), st.Generation)
+	require.Empty(t, st.LastError)
+	require.False(t, st.RefreshedAt.IsZero())
+
+	fail = true
+	require.Error(t, c.Refresh(context.Background()))
+	require.Equal(t, []string{"a", "b"}, c.Get())
+	st = c.Status()
+	require.Equal(t, uint64(1), st.Generation)
+	require.Equal(t, "s3 unreachable", st.LastError)
+}
+
+func TestCacheNotifiesWhenRefreshStartsAndStopsFailing(t *testing.T) {
+	fail := false
+	c := NewCache("test", func(ctx context.Context) ([]string, error) {
+		if fail {
+			return nil, errors.New("s3 unreachable")
+		}
+		return []string{"a"}, nil
+	})
+	batch := notify.NewBatch("test")
+	ctx := notify.WithBatch(context.Background(), batch)
+
+	require.NoError(t, c.Refresh(ctx))
+	fail = true
+	require.Error(t, c.Refresh(ctx))
+	require.Error(t, c.Refresh(ctx))
+	fail = false
+	require.NoError(t, c.Refresh(ctx))
+	require.NoError(t, c.Refresh(ctx))
+
+	var kinds []string
+	for _, e := range batch.Digest().Events {
+		kinds = append(kinds, e.Kind)
+	}
+	require.Equal(t, []string{"cache_refresh_failing", "cache_refresh_recovered"}, kinds)
+}
+
+func TestCacheGetReturnsCopy(t *testing.T) {
+	c := NewCache("test", func(ctx context.Context) ([]string, error) { return []string{"a"}, nil })
+	require.NoError(t, c.Refresh(context.Background()))
+	got := c.Get()
+	got[0] = "mutated"
+	require.Equal(t, []string{"a"}, c.Get())
+}
+
+func TestCacheCoalescesConcurrentRefreshes(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	c := NewCache("test", func(ctx context.Context) ([]int, error) {
+		n := loads.Add(1)
+		if n == 1 {
+			<-release
+		}
+		return []int{int(n)}, nil
+	})
+
+	// first refresh blocks inside load
+	firstDone := make(chan error)
+	go func() { firstDone <- c.Refresh(context.Background()) }()
+	require.Eventually(t, func() bool { return c.Status().Refreshing }, time.Second, time.Millisecond)
+
+	// a burst of refreshes (e.g. one per SQS event) while it's in flight
+	var wg sync.WaitGroup
+	var arrived atomic.Int32
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			arrived.Add(1)
+			require.NoError(t, c.Refresh(context.Background()))
+		}()
+	}
+	require.Eventually(t, func() bool { return arrived.Load() == 25 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	require.NoError(t, <-firstDone)
+	wg.Wait()
+
+	// the in-flight load plus exactly one follow-up
+	require.Equal(t, int32(2), loads.Load())
+	require.Equal(t, []int{2}, c.Get())
+	require.Equal(t, uint64(2), c.Status().Generation)
+	require.False(t, c.Status().Refreshing)
+}
@@ -0,0 +1,155 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cacheSnapshot is one cache's last-known-good contents as persisted on disk.
+type cacheSnapshot struct {
+	RefreshedAt time.Time       `json:"refreshed_at"`
+	Items       json.RawMessage `json:"items"`
+}
+
+// cacheSnapshotFile is the on-disk format: every content cache keyed by name.
+type cacheSnapshotFile struct {
+	SavedAt time.Time                `json:"saved_at"`
+	Caches  map[string]cacheSnapshot `json:"caches"`
+}
+
+var (
+	snapshotMu   sync.Mutex
+	snapshotPath string
+)
+
+// WarmCaches fills the content caches at server startup. Caches restored from
+// the snapshot at path are served right away and refreshed from S3 in the
+// background, so a slow or unreachable S3 doesn't hold up (or empty) the site.
+// Caches without a usable snapshot are loaded synchronously, as on a first
+// boot. From then on every successful refresh rewrites the snapshot.
+func WarmCaches(ctx context.Context, path string) {
+	restored := loadCacheSnapshot(path)
+
+	snapshotMu.Lock()
+	snapshotPath = path
+	snapshotMu.Unlock()
+
+	for _, c := range contentCaches {
+		if restored[c.Status().Name] {
+			go func(c contentCache) { _ = c.Refresh(ctx) }(c)
+			continue
+		}
+		_ = c.Refresh(ctx)
+	}
+}
+
+// loadCacheSnapshot restores whichever caches have a usable snapshot,
+// returning the names of those restored.
+func loadCacheSnapshot(path string) map[string]bool {
+	restored := map[string]bool{}
+	if path == "" {
+		return restored
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Info().Msgf("No cache snapshot at %s; loading caches from S3", path)
+		return restored
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read cache snapshot %s", path)
+		return restored
+	}
+	var file cacheSnapshotFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		log.Error().Err(err).Msgf("Failed to parse cache snapshot %s", path)
+		return restored
+	}
+
+	for _, c := range contentCaches {
+		name := c.Status().Name
+		snap, ok := file.Caches[name]
+		if !ok {
+			continue
+		}
+		ok, err := c.restore(snap)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to restore %s cache from snapshot", name)
+			continue
+		}
+		if ok {
+			restored[name] = true
+			log.Info().Msgf("Restored %s cache from snapshot (%d entries, refreshed %v)", name, c.Status().Entries, snap.RefreshedAt)
+		}
+	}
+	return restored
+}
+
+// saveCacheSnapshot writes every cache's current contents to the snapshot
+// file, if WarmCaches enabled one. Caches that have never loaded are skipped
+// so an empty cache can't overwrite a good snapshot.
+func saveCacheSnapshot() {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	if snapshotPath == "" {
+		return
+	}
+
+	file := cacheSnapshotFile{SavedAt: time.Now().UTC(), Caches: map[string]cacheSnapshot{}}
+	if b, err := os.ReadFile(snapshotPath); err == nil {
+		// keep snapshots of caches that haven't refreshed yet this run
+		_ = json.Unmarshal(b, &file)
+		if file.Caches == nil {
+			file.Caches = map[string]cacheSnapshot{}
+		}
+	}
+	for _, c := range contentCaches {
+		snap, err := c.snapshot()
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to snapshot %s cache", c.Status().Name)
+			continue
+		}
+		if snap.RefreshedAt.IsZero() {
+			continue
+		}
+		file.Caches[c.Status().Name] = snap
+	}
+
+	b, err := json.Marshal(file)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode cache snapshot")
+		return
+	}
+	if err := writeFileAtomic(snapshotPath, b); err != nil {
+		log.Error().Err(err).Msgf("Failed to write cache snapshot %s", snapshotPath)
+	}
+}
+
+// writeFileAtomic replaces path via a temp file and rename so a crash mid-write
+// never leaves a truncated snapshot behind.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,106 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// resetContentCaches empties the package caches and disables snapshotting,
+// both now and when the test ends.
+func resetContentCaches(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		snapshotMu.Lock()
+		snapshotPath = ""
+		snapshotMu.Unlock()
+		resetCache(audioCache)
+		resetCache(sheetCache)
+		resetCache(showsCache)
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func resetCache[T any](c *Cache[T]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = nil
+	c.refreshedAt = time.Time{}
+	c.lastErr = nil
+	c.generation = 0
+}
+
+// downStore fails every call, like S3 during an outage.
+type downStore struct{ Store }
+
+func (downStore) ListPage(ctx context.Context, bucket, prefix, token string) (ObjectPage, error) {
+	return ObjectPage{}, errors.New("s3 unreachable")
+}
+
+func (downStore) Get(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	return nil, "", errors.New("s3 unreachable")
+}
+
+func TestWarmCachesRestoresSnapshotWhenS3IsDown(t *testing.T) {
+	resetContentCaches(t)
+	newFakeS3(t)
+	require.NoError(t, PutSheetJSON("Grey Eagle", "https://www.dropbox.com/s/b/ge.pdf", ""))
+	require.NoError(t, PutShowJSON("Tuesday Jam", "2099-05-01", "8:00pm", "at the pub"))
+	path := filepath.Join(t.TempDir(), "cache-snapshot.json")
+
+	// first boot: no snapshot, so caches load from S3 and the snapshot is written
+	WarmCaches(context.Background(), path)
+	require.Len(t, sheetCache.Get(), 1)
+	require.Len(t, showsCache.Get(), 1)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var file cacheSnapshotFile
+	require.NoError(t, json.Unmarshal(b, &file))
+	require.Contains(t, file.Caches, "sheet music")
+	require.Contains(t, file.Caches, "shows")
+
+	// restart with S3 unreachable: pages are still served from the snapshot
+	resetContentCaches(t)
+	SetStore(downStore{})
+	WarmCaches(context.Background(), path)
+	require.Equal(t, "Grey Eagle", sheetCache.Get()[0].DisplayName)
+	require.Equal(t, "Tuesday Jam", showsCache.Get()[0].Title)
+
+	// the background refreshes fail but keep the restored entries
+	require.Eventually(t, func() bool {
+		return audioCache.Status().LastError != "" && sheetCache.Status().LastError != "" && showsCache.Status().LastError != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Len(t, sheetCache.Get(), 1)
+	require.Len(t, showsCache.Get(), 1)
+}
+
+func TestCacheRestoreSkipsExpiredSnapshot(t *testing.T) {
+	c := NewCache("test", func(ctx context.Context) ([]string, error) { return []string{"live"}, nil })
+	c.maxSnapshotAge = time.Hour
+	items, err := json.Marshal([]string{"old"})
+	require.NoError(t, err)
+
+	ok, err := c.restore(cacheSnapshot{RefreshedAt: time.Now().Add(-2 * time.Hour), Items: items})
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Empty(t, c.Get())
+
+	ok, err = c.restore(cacheSnapshot{RefreshedAt: time.Now().Add(-time.Minute), Items: items})
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []string{"old"}, c.Get())
+
+	// live data is never replaced by a snapshot
+	require.NoError(t, c.Refresh(context.Background()))
+	ok, err = c.restore(cacheSnapshot{RefreshedAt: time.Now(), Items: items})
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, []string{"live"}, c.Get())
+}
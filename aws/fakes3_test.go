@@ -0,0 +1,264 @@
+package aws
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+)
+
+// fakeS3 is an in-process, path-style S3-compatible endpoint implementing just
+// enough of the API for this package: ListObjectsV2, GetObject, PutObject
+// (including If-Match/If-None-Match) and DeleteObject. Signatures are not
+// verified, so presigned URLs work too.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]fakeObject
+	// maxKeys caps ListObjectsV2 page size (S3's own default is 1000)
+	maxKeys int
+	// listCalls and getCalls count ListObjectsV2 and GetObject requests served
+	listCalls int
+	getCalls  int
+	// beforePut, if set, runs before each PutObject is applied (e.g. to
+	// simulate a concurrent writer)
+	beforePut func(bucket, key string)
+}
+
+type fakeObject struct {
+	body         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+// newFakeS3 starts a fake S3 server, points the package's config and Store at
+// it, and restores both when the test ends.
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+	f := &fakeS3{buckets: map[string]map[string]fakeObject{}, maxKeys: 1000}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	prevCfg := webCfg.C
+	webCfg.C.S3EndpointURL = f.URL
+	webCfg.C.AudioS3Region = "us-east-2"
+	webCfg.C.AudioS3BucketName = "audio-bucket"
+	webCfg.C.AudioS3BucketPrefix = "audio/"
+	webCfg.C.SheetMusicS3BucketName = "sheet-bucket"
+	webCfg.C.SheetMusicS3BucketPrefix = "dropbox_sheetmusic/"
+	webCfg.C.ShowsS3BucketName = "shows-bucket"
+	webCfg.C.ShowsS3BucketPrefix = "shows/"
+	SetStore(NewS3Store(initS3Session()))
+	t.Cleanup(func() {
+		webCfg.C = prevCfg
+		SetStore(nil)
+	})
+	return f
+}
+
+// put seeds an object directly, bypassing the client.
+func (f *fakeS3) put(bucket, key, body string, lastModified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = map[string]fakeObject{}
+	}
+	f.buckets[bucket][key] = fakeObject{body: []byte(body), lastModified: lastModified}
+}
+
+// keys returns the sorted keys currently stored in bucket.
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) object(bucket, key string) (fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.buckets[bucket][key]
+	return obj, ok
+}
+
+func (f *fakeS3) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.listObjectsV2(w, r, bucket)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.getObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		f.putObject(w, r, bucket, key)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.buckets[bucket], key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.Path)
+	}
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name          `xml:"ListBucketResult"`
+	Name                  string            `xml:"Name"`
+	Prefix                string            `xml:"Prefix"`
+	KeyCount              int               `xml:"KeyCount"`
+	MaxKeys               int               `xml:"MaxKeys"`
+	IsTruncated           bool              `xml:"IsTruncated"`
+	ContinuationToken     string            `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string            `xml:"NextContinuationToken,omitempty"`
+	Contents              []listBucketEntry `xml:"Contents"`
+}
+
+type listBucketEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+}
+
+func (f *fakeS3) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	// the fake's continuation token is just the last key of the previous page
+	token := r.URL.Query().Get("continuation-token")
+	f.mu.Lock()
+	f.listCalls++
+	res := listBucketResult{Name: bucket, Prefix: prefix, MaxKeys: f.maxKeys, ContinuationToken: token}
+	for key, obj := range f.buckets[bucket] {
+		if !strings.HasPrefix(key, prefix) || (token != "" && key <= token) {
+			continue
+		}
+		res.Contents = append(res.Contents, listBucketEntry{
+			Key:          key,
+			LastModified: obj.lastModified.UTC().Format(time.RFC3339),
+			ETag:         etag(obj.body),
+			Size:         len(obj.body),
+		})
+	}
+	f.mu.Unlock()
+	sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+	if len(res.Contents) > res.MaxKeys {
+		res.Contents = res.Contents[:res.MaxKeys]
+		res.IsTruncated = true
+		res.NextContinuationToken = res.Contents[len(res.Contents)-1].Key
+	}
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	f.mu.Lock()
+	f.getCalls++
+	f.mu.Unlock()
+	obj, ok := f.object(bucket, key)
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if obj.contentType != "" {
+		w.Header().Set("Content-Type", obj.contentType)
+	}
+	w.Header().Set("ETag", etag(obj.body))
+	w.Header().Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(obj.body)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(obj.body)
+	}
+}
+
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	body, err := readS3Body(r)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	if f.beforePut != nil {
+		f.beforePut(bucket, key)
+	}
+	f.mu.Lock()
+	current, exists := f.buckets[bucket][key]
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || etag(current.body) != ifMatch)) {
+		f.mu.Unlock()
+		writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+		return
+	}
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = map[string]fakeObject{}
+	}
+	f.buckets[bucket][key] = fakeObject{
+		body:         body,
+		contentType:  r.Header.Get("Content-Type"),
+		lastModified: time.Now(),
+	}
+	f.mu.Unlock()
+	w.Header().Set("ETag", etag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+// readS3Body returns the object payload, decoding the aws-chunked framing the
+// SDK uses when it streams a trailing checksum.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return io.ReadAll(r.Body)
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad chunk size %q: %w", line, err)
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, msg)
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
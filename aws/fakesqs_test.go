@@ -0,0 +1,197 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// fakeSQS is an in-process SQS stand-in speaking the AWS JSON 1.0 protocol,
+// implementing ReceiveMessage, DeleteMessage and DeleteMessageBatch for a
+// single queue. Received messages stay in flight (invisible) until deleted or
+// released with expireVisibility.
+type fakeSQS struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	nextID   int
+	messages []*fakeMessage
+	// calls counts requests per action, e.g. calls["DeleteMessageBatch"]
+	calls map[string]int
+	// lastReceive is the most recent ReceiveMessage request body
+	lastReceive fakeReceiveInput
+}
+
+type fakeMessage struct {
+	id            string
+	body          string
+	receiptHandle string
+	receiveCount  int
+	inFlight      bool
+}
+
+type fakeReceiveInput struct {
+	QueueUrl            string
+	MaxNumberOfMessages int
+	WaitTimeSeconds     int
+	VisibilityTimeout   int
+}
+
+// newFakeSQS starts a fake SQS server and returns it with a client pointed at
+// it.
+func newFakeSQS(t *testing.T) (*fakeSQS, *sqs.Client) {
+	t.Helper()
+	f := &fakeSQS{calls: map[string]int{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.Close)
+
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion("us-east-2"),
+		config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, newSQSClient(cfg, f.URL)
+}
+
+// send enqueues a message body.
+func (f *fakeSQS) send(body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.messages = append(f.messages, &fakeMessage{id: fmt.Sprintf("msg-%d", f.nextID), body: body})
+}
+
+// bodies returns the bodies of every message still on the queue.
+func (f *fakeSQS) bodies() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := []string{}
+	for _, m := range f.messages {
+		out = append(out, m.body)
+	}
+	return out
+}
+
+// expireVisibility makes every in-flight message receivable again, as when
+// its visibility timeout runs out.
+func (f *fakeSQS) expireVisibility() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.messages {
+		m.inFlight = false
+	}
+}
+
+func (f *fakeSQS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[action]++
+
+	switch action {
+	case "ReceiveMessage":
+		var in fakeReceiveInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeSQSError(w, "InvalidParameterValue", err.Error())
+			return
+		}
+		f.lastReceive = in
+		max := in.MaxNumberOfMessages
+		if max == 0 {
+			max = 1
+		}
+		type message struct {
+			MessageId     string
+			ReceiptHandle string
+			Body          string
+			Attributes    map[string]string
+		}
+		out := []message{}
+		for _, m := range f.messages {
+			if m.inFlight || len(out) == max {
+				continue
+			}
+			m.inFlight = true
+			m.receiveCount++
+			m.receiptHandle = fmt.Sprintf("%s-r%d", m.id, m.receiveCount)
+			out = append(out, message{
+				MessageId:     m.id,
+				ReceiptHandle: m.receiptHandle,
+				Body:          m.body,
+				Attributes:    map[string]string{"ApproximateReceiveCount": strconv.Itoa(m.receiveCount)},
+			})
+		}
+		writeSQSJSON(w, map[string]any{"Messages": out})
+	case "DeleteMessage":
+		var in struct{ ReceiptHandle string }
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeSQSError(w, "InvalidParameterValue", err.Error())
+			return
+		}
+		if !f.remove(in.ReceiptHandle) {
+			writeSQSError(w, "ReceiptHandleIsInvalid", in.ReceiptHandle)
+			return
+		}
+		writeSQSJSON(w, map[string]any{})
+	case "DeleteMessageBatch":
+		var in struct {
+			Entries []struct{ Id, ReceiptHandle string }
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			writeSQSError(w, "InvalidParameterValue", err.Error())
+			return
+		}
+		type ok struct{ Id string }
+		type failed struct {
+			Id, Code, Message string
+			SenderFault       bool
+		}
+		successful, failures := []ok{}, []failed{}
+		for _, e := range in.Entries {
+			if f.remove(e.ReceiptHandle) {
+				successful = append(successful, ok{e.Id})
+			} else {
+				failures = append(failures, failed{Id: e.Id, Code: "ReceiptHandleIsInvalid", Message: e.ReceiptHandle, SenderFault: true})
+			}
+		}
+		writeSQSJSON(w, map[string]any{"Successful": successful, "Failed": failures})
+	default:
+		writeSQSError(w, "UnsupportedOperation", action)
+	}
+}
+
+// remove deletes the message with receiptHandle; callers hold f.mu.
+func (f *fakeSQS) remove(receiptHandle string) bool {
+	for i, m := range f.messages {
+		if m.receiptHandle == receiptHandle && receiptHandle != "" {
+			f.messages = append(f.messages[:i], f.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func writeSQSJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeSQSError(w http.ResponseWriter, code, msg string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.sqs#" + code, "message": msg})
+}
@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+)
+
+const (
+	defaultFetchConcurrency = 8
+	defaultFetchTimeout     = 10 * time.Second
+)
+
+// fetchResult is the outcome of reading a single object.
+type fetchResult[T any] struct {
+	Key  string
+	Item T
+	Err  error
+}
+
+// fetchOptions bounds a fetchObjects call.
+type fetchOptions struct {
+	// Concurrency is the maximum number of reads in flight at once.
+	Concurrency int
+	// Timeout caps each individual read.
+	Timeout time.Duration
+}
+
+// fetchOptionsFromConfig reads S3_FETCH_CONCURRENCY / S3_FETCH_TIMEOUT_SECONDS,
+// falling back to defaults when unset.
+func fetchOptionsFromConfig() fetchOptions {
+	opts := fetchOptions{
+		Concurrency: webCfg.C.S3FetchConcurrency,
+		Timeout:     time.Duration(webCfg.C.S3FetchTimeoutSeconds) * time.Second,
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultFetchConcurrency
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultFetchTimeout
+	}
+	return opts
+}
+
+// fetchObjects runs fetch for every key on a bounded pool of workers, so a
+// listing of n objects costs roughly one round trip instead of n. Results
+// come back in the same order as keys. Once ctx is cancelled no new reads
+// start, and keys that never ran report ctx's error.
+func fetchObjects[T any](ctx context.Context, keys []string, opts fetchOptions, fetch func(ctx context.Context, key string) (T, error)) []fetchResult[T] {
+	results := make([]fetchResult[T], len(keys))
+	if len(keys) == 0 {
+		return results
+	}
+	workers := min(max(opts.Concurrency, 1), len(keys))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = fetchOne(ctx, keys[i], opts.Timeout, fetch)
+			}
+		}()
+	}
+
+	next := 0
+feed:
+	for ; next < len(keys) && ctx.Err() == nil; next++ {
+		select {
+		case indexes <- next:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i := next; i < len(keys); i++ {
+		results[i] = fetchResult[T]{Key: keys[i], Err: ctx.Err()}
+	}
+	return results
+}
+
+func fetchOne[T any](ctx context.Context, key string, timeout time.Duration, fetch func(ctx context.Context, key string) (T, error)) fetchResult[T] {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	item, err := fetch(ctx, key)
+	return fetchResult[T]{Key: key, Item: item, Err: err}
+}
@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchObjectsBoundsConcurrencyAndKeepsOrder(t *testing.T) {
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%02d", i)
+	}
+
+	var inFlight, peak atomic.Int32
+	results := fetchObjects(context.Background(), keys, fetchOptions{Concurrency: 4, Timeout: time.Second},
+		func(ctx context.Context, key string) (string, error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			return "v" + key, nil
+		})
+
+	require.Len(t, results, len(keys))
+	for i, r := range results {
+		require.NoError(t, r.Err)
+		require.Equal(t, keys[i], r.Key)
+		require.Equal(t, "v"+keys[i], r.Item)
+	}
+	require.LessOrEqual(t, peak.Load(), int32(4))
+	require.Greater(t, peak.Load(), int32(1), "reads should overlap")
+}
+
+func TestFetchObjectsPerObjectTimeout(t *testing.T) {
+	results := fetchObjects(context.Background(), []string{"fast", "slow"}, fetchOptions{Concurrency: 2, Timeout: 20 * time.Millisecond},
+		func(ctx context.Context, key string) (string, error) {
+			if key == "fast" {
+				return key, nil
+			}
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+
+	require.NoError(t, results[0].Err)
+	require.ErrorIs(t, results[1].Err, context.DeadlineExceeded)
+}
+
+func TestFetchObjectsStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	keys := []string{"a", "b", "c", "d", "e"}
+	var started atomic.Int32
+
+	results := fetchObjects(ctx, keys, fetchOptions{Concurrency: 1, Timeout: time.Second},
+		func(ctx context.Context, key string) (string, error) {
+			started.Add(1)
+			if key == "b" {
+				cancel()
+			}
+			return key, nil
+		})
+
+	require.Less(t, started.Load(), int32(len(keys)))
+	require.True(t, errors.Is(results[len(keys)-1].Err, context.Canceled))
+}
+
+func TestFetchObjectsEmpty(t *testing.T) {
+	results := fetchObjects(context.Background(), nil, fetchOptionsFromConfig(), func(ctx context.Context, key string) (int, error) {
+		t.Fatal("fetch should not be called")
+		return 0, nil
+	})
+	require.Empty(t, results)
+}
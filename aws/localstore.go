@@ -0,0 +1,180 @@
+package aws
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// localListPageSize mirrors S3's ListObjectsV2 page size so paging code paths
+// get exercised offline too.
+const localListPageSize = 1000
+
+// LocalStorageURLPrefix is the URL path the web server serves the local
+// storage directory under, so "presigned" local URLs resolve in a browser.
+const LocalStorageURLPrefix = "/storage"
+
+// localStore is a Store backed by a directory on disk. Each bucket is a
+// subdirectory of root and each key is a file path relative to its bucket.
+type localStore struct {
+	root      string
+	urlPrefix string
+	// mu serializes writes so conditional puts are atomic within this process
+	mu sync.Mutex
+}
+
+// NewLocalStore returns a Store rooted at dir. PresignGet returns URLs of the
+// form urlPrefix/<bucket>/<key>.
+func NewLocalStore(dir, urlPrefix string) Store {
+	return &localStore{root: dir, urlPrefix: strings.TrimRight(urlPrefix, "/")}
+}
+
+// path maps bucket+key to a file path, refusing keys that would escape the bucket.
+func (l *localStore) path(bucket, key string) (string, error) {
+	if bucket == "" {
+		return "", fmt.Errorf("empty bucket")
+	}
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || slices.Contains(strings.Split(key, "/"), "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(l.root, bucket, filepath.FromSlash(clean)), nil
+}
+
+// ListPage walks the whole bucket on every call; the continuation token is
+// simply the last key of the previous page.
+func (l *localStore) ListPage(ctx context.Context, bucket, prefix, token string) (ObjectPage, error) {
+	bucketDir := filepath.Join(l.root, bucket)
+	var objs []ObjectInfo
+	err := filepath.WalkDir(bucketDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketDir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || key <= token {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objs = append(objs, ObjectInfo{Key: key, LastModified: info.ModTime(), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return ObjectPage{}, err
+	}
+	// S3 lists keys in lexicographic order; match it
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+	if len(objs) > localListPageSize {
+		objs = objs[:localListPageSize]
+		return ObjectPage{Objects: objs, NextToken: objs[len(objs)-1].Key}, nil
+	}
+	return ObjectPage{Objects: objs}, nil
+}
+
+func (l *localStore) Get(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	p, err := l.path(bucket, key)
+	if err != nil {
+		return nil, "", err
+	}
+	b, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", fmt.Errorf("%s/%s: %w", bucket, key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return b, localETag(b), nil
+}
+
+// localETag mimics S3's ETag for single-part uploads: the quoted MD5 of the body.
+func localETag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (l *localStore) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	p, err := l.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if opts.IfMatch != "" || opts.IfNoneMatch != "" {
+		current, err := os.ReadFile(p)
+		exists := err == nil
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if opts.IfNoneMatch == "*" && exists {
+			return fmt.Errorf("%s/%s: %w", bucket, key, ErrPreconditionFailed)
+		}
+		if opts.IfMatch != "" && (!exists || localETag(current) != opts.IfMatch) {
+			return fmt.Errorf("%s/%s: %w", bucket, key, ErrPreconditionFailed)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// write to a temp file and rename so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (l *localStore) Delete(ctx context.Context, bucket, key string) error {
+	p, err := l.path(bucket, key)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *localStore) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	if _, err := l.path(bucket, key); err != nil {
+		return "", err
+	}
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return l.urlPrefix + "/" + url.PathEscape(bucket) + "/" + strings.Join(segments, "/"), nil
+}
@@ -0,0 +1,56 @@
+package aws
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	st := NewLocalStore(t.TempDir(), LocalStorageURLPrefix)
+
+	require.NoError(t, st.Put(ctx, "bucket", "shows/a.json", strings.NewReader(`{"title":"a"}`), PutOptions{}))
+	require.NoError(t, st.Put(ctx, "bucket", "shows/b.json", strings.NewReader(`{"title":"b"}`), PutOptions{}))
+	require.NoError(t, st.Put(ctx, "bucket", "audio/c.wav", strings.NewReader("RIFF"), PutOptions{}))
+
+	objs, err := listAllObjects(ctx, st, "bucket", "shows/")
+	require.NoError(t, err)
+	require.Len(t, objs, 2)
+	require.Equal(t, "shows/a.json", objs[0].Key)
+	require.Equal(t, "shows/b.json", objs[1].Key)
+
+	b, _, err := st.Get(ctx, "bucket", "shows/b.json")
+	require.NoError(t, err)
+	require.Equal(t, `{"title":"b"}`, string(b))
+
+	url, err := st.PresignGet(ctx, "bucket", "audio/c d.wav", time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, "/storage/bucket/audio/c%20d.wav", url)
+
+	require.NoError(t, st.Delete(ctx, "bucket", "shows/a.json"))
+	require.NoError(t, st.Delete(ctx, "bucket", "shows/a.json"), "deleting a missing key is not an error")
+	objs, err = listAllObjects(ctx, st, "bucket", "shows/")
+	require.NoError(t, err)
+	require.Len(t, objs, 1)
+
+	objs, err = listAllObjects(ctx, st, "missing-bucket", "")
+	require.NoError(t, err)
+	require.Empty(t, objs)
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	st := NewLocalStore(t.TempDir(), LocalStorageURLPrefix)
+	err := st.Put(context.Background(), "bucket", "../outside.json", strings.NewReader("x"), PutOptions{})
+	require.Error(t, err)
+	err = st.Put(context.Background(), "bucket", "sheets/../../outside.json", strings.NewReader("x"), PutOptions{})
+	require.Error(t, err)
+
+	// dots inside a name are fine; only a ".." segment could escape
+	for _, key := range []string{"Reel... in D.pdf", "a..b.pdf"} {
+		require.NoError(t, st.Put(context.Background(), "bucket", key, strings.NewReader("x"), PutOptions{}), key)
+	}
+}
@@ -2,26 +2,147 @@ package aws
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/rs/zerolog/log"
 )
 
-func getS3Client() *s3.Client {
-	if s3Client == nil {
-		s3Client = initS3Session()
-	}
-	return s3Client
-}
-
 func initS3Session() *s3.Client {
 	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(webCfg.C.AudioS3Region))
 	if err != nil {
 		log.Fatal().Msgf("Failed to load AWS config: %v", err)
 	}
-	client := s3.NewFromConfig(cfg)
-	s3Client = client
-	return client
+	return newS3Client(cfg, webCfg.C.S3EndpointURL)
+}
+
+// newS3Client builds an S3 client, pointing it at endpoint instead of AWS when
+// set. Custom endpoints are addressed path-style (http://host/bucket/key),
+// which S3-compatible servers expect.
+func newS3Client(cfg aws.Config, endpoint string) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+}
+
+// s3Store is the Store backed by real S3 buckets.
+type s3Store struct {
+	client *s3.Client
+}
+
+// NewS3Store returns a Store that talks to S3 through client.
+func NewS3Store(client *s3.Client) Store {
+	return &s3Store{client: client}
+}
+
+func (s *s3Store) ListPage(ctx context.Context, bucket, prefix, token string) (ObjectPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	out, err := s.client.ListObjectsV2(ctx, input)
+	if err != nil {
+		return ObjectPage{}, err
+	}
+
+	page := ObjectPage{Objects: make([]ObjectInfo, 0, len(out.Contents))}
+	for _, item := range out.Contents {
+		if item.Key == nil {
+			continue
+		}
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          *item.Key,
+			LastModified: aws.ToTime(item.LastModified),
+			Size:         aws.ToInt64(item.Size),
+		})
+	}
+	if aws.ToBool(out.IsTruncated) {
+		page.NextToken = aws.ToString(out.NextContinuationToken)
+	}
+	return page, nil
+}
+
+func (s *s3Store) Get(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, "", fmt.Errorf("s3://%s/%s: %w", bucket, key, ErrNotFound)
+		}
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, aws.ToString(resp.ETag), nil
+}
+
+func (s *s3Store) Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error {
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.PublicRead {
+		input.ACL = types.ObjectCannedACLPublicRead
+	}
+	if opts.IfMatch != "" {
+		input.IfMatch = aws.String(opts.IfMatch)
+	}
+	if opts.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	// the uploader switches to multipart for large bodies (audio files)
+	_, err := manager.NewUploader(s.client).Upload(ctx, input)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		// S3 answers a lost conditional-write race with one or the other
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return fmt.Errorf("s3://%s/%s: %w", bucket, key, ErrPreconditionFailed)
+		}
+	}
+	return err
+}
+
+func (s *s3Store) Delete(ctx context.Context, bucket, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (s *s3Store) PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error) {
+	resp, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expiry))
+	if err != nil {
+		return "", err
+	}
+	return resp.URL, nil
 }
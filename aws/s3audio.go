@@ -9,10 +9,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/rs/zerolog/log"
 
 	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
@@ -22,7 +18,6 @@ import (
 )
 
 var (
-	s3Client        *s3.Client
 	presignedURLTTL = 30 * time.Minute
 	cacheTTL        = presignedURLTTL - 1*time.Minute
 )
@@ -38,8 +33,6 @@ type S3Song struct {
 func UploadAudioToS3(filePath string) error {
 	log.Debug().Msgf("Uploading audio file %s to S3...", filePath)
 
-	client := getS3Client()
-
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
@@ -52,14 +45,9 @@ func UploadAudioToS3(filePath string) error {
 		contentType = "audio/wav"
 	}
 
-	uploader := manager.NewUploader(client)
-
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(webCfg.C.AudioS3BucketName),
-		Key:         aws.String(key),
-		Body:        file,
-		ContentType: aws.String(contentType),
-		ACL:         types.ObjectCannedACLPublicRead,
+	err = getStore().Put(context.TODO(), webCfg.C.AudioS3BucketName, key, file, PutOptions{
+		ContentType: contentType,
+		PublicRead:  true,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to upload to S3: %w", err)
@@ -72,22 +60,17 @@ func UploadAudioToS3(filePath string) error {
 // GetAudioKeysFromS3 returns the S3 keys for all audio files.
 // Used for generating cover art images without needing presigned URLs.
 func GetAudioKeysFromS3() ([]string, error) {
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(webCfg.C.AudioS3BucketName),
-		Prefix: aws.String(webCfg.C.AudioS3BucketPrefix),
-	}
-
-	output, err := getS3Client().ListObjectsV2(context.TODO(), input)
+	objs, err := listAllObjects(context.TODO(), getStore(), webCfg.C.AudioS3BucketName, webCfg.C.AudioS3BucketPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list objects in S3: %w", err)
 	}
 
 	var keys []string
-	for _, item := range output.Contents {
-		if item.Key == nil || *item.Key == webCfg.C.AudioS3BucketPrefix {
+	for _, item := range objs {
+		if item.Key == webCfg.C.AudioS3BucketPrefix {
 			continue
 		}
-		key := *item.Key
+		key := item.Key
 		if strings.HasSuffix(key, ".wav") || strings.HasSuffix(key, ".mp3") {
 			keys = append(keys, key)
 		}
@@ -99,8 +82,6 @@ func GetAudioKeysFromS3() ([]string, error) {
 func UploadAudioImageToS3(filePath string) error {
 	log.Debug().Msgf("Uploading image file %s to S3...", filePath)
 
-	client := getS3Client()
-
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to open file: %w", err)
@@ -109,14 +90,9 @@ func UploadAudioImageToS3(filePath string) error {
 
 	key := filepath.Join(webCfg.C.AudioS3BucketPrefix, filepath.Base(filePath))
 
-	uploader := manager.NewUploader(client)
-
-	_, err = uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(webCfg.C.AudioS3BucketName),
-		Key:         aws.String(key),
-		Body:        file,
-		ContentType: aws.String("image/png"),
-		ACL:         types.ObjectCannedACLPublicRead,
+	err = getStore().Put(context.TODO(), webCfg.C.AudioS3BucketName, key, file, PutOptions{
+		ContentType: "image/png",
+		PublicRead:  true,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to upload to S3: %w", err)
@@ -129,13 +105,8 @@ func UploadAudioImageToS3(filePath string) error {
 func GetAudioFromS3() ([]S3Song, error) {
 	log.Debug().Msg("GetS3Songs()")
 
-	input := &s3.ListObjectsV2Input{
-		Bucket: aws.String(webCfg.C.AudioS3BucketName),
-		Prefix: aws.String(webCfg.C.AudioS3BucketPrefix),
-	}
-
 	start := time.Now()
-	output, err := getS3Client().ListObjectsV2(context.TODO(), input)
+	objs, err := listAllObjects(context.TODO(), getStore(), webCfg.C.AudioS3BucketName, webCfg.C.AudioS3BucketPrefix)
 	if err != nil {
 		log.Error().Msgf("Failed to list objects in S3: %v", err)
 		return nil, err
@@ -145,11 +116,11 @@ func GetAudioFromS3() ([]S3Song, error) {
 	wavs := make(map[string]S3Song)
 	imgs := make(map[string]string)
 
-	for _, item := range output.Contents {
-		if item.Key == nil || *item.Key == webCfg.C.AudioS3BucketPrefix {
+	for _, item := range objs {
+		if item.Key == webCfg.C.AudioS3BucketPrefix {
 			continue
 		}
-		key := *item.Key
+		key := item.Key
 		filetype := wavOrPng(key)
 		audioTitle := formatAudioTitle(key)
 		log.Debug().Msgf("item.Key: %s, audioTitle: %s", key, audioTitle)
@@ -165,8 +136,8 @@ func GetAudioFromS3() ([]S3Song, error) {
 			wavs[audioTitle] = S3Song{
 				Name:         audioTitle,
 				AudioURL:     itemUrl,
-				LastModified: aws.ToTime(item.LastModified),
-				Key:          *item.Key,
+				LastModified: item.LastModified,
+				Key:          item.Key,
 			}
 		case "png":
 			imgs[audioTitle] = itemUrl
@@ -192,17 +163,11 @@ func GetAudioFromS3() ([]S3Song, error) {
 func DeleteAudioFromS3(key string) error {
 	log.Info().Msgf("Deleting audio file %s from S3...", key)
 
-	client := getS3Client()
-
 	if !strings.HasPrefix(key, webCfg.C.AudioS3BucketPrefix) {
 		key = filepath.Join(webCfg.C.AudioS3BucketPrefix, key)
 	}
 
-	_, err := client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(webCfg.C.AudioS3BucketName),
-		Key:    aws.String(key),
-	})
-	if err != nil {
+	if err := getStore().Delete(context.TODO(), webCfg.C.AudioS3BucketName, key); err != nil {
 		return fmt.Errorf("failed to delete object %s from S3: %w", key, err)
 	}
 
@@ -237,15 +202,5 @@ func sortS3SongsByRecent(songs []S3Song) {
 const PresignURLExpiry = 60 * time.Minute
 
 func getPresignedURL(key string) (string, error) {
-	presigner := s3.NewPresignClient(getS3Client())
-
-	resp, err := presigner.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(webCfg.C.AudioS3BucketName),
-		Key:    aws.String(key),
-	}, s3.WithPresignExpires(PresignURLExpiry))
-	if err != nil {
-		return "", err
-	}
-
-	return resp.URL, nil
+	return getStore().PresignGet(context.TODO(), webCfg.C.AudioS3BucketName, key, PresignURLExpiry)
 }
@@ -1,17 +1,93 @@
 package aws
 
 import (
-	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetS3Songs(t *testing.T) {
-	songs, err := GetAudioFromS3()
-	if err != nil {
-		t.Errorf("listSongs() failed: %v", err)
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		keys      []string // seeded in order, each one minute newer than the last
+		wantNames []string // most recent first
+		wantImage map[string]string
+	}{
+		{
+			name:      "wav paired with png of the same name",
+			keys:      []string{"audio/grey_eagle.wav", "audio/grey_eagle.png"},
+			wantNames: []string{"Grey Eagle"},
+			wantImage: map[string]string{"Grey Eagle": "audio/grey_eagle.png"},
+		},
+		{
+			name:      "wav without png falls back to the album image",
+			keys:      []string{"audio/grey_eagle.wav"},
+			wantNames: []string{"Grey Eagle"},
+			wantImage: map[string]string{"Grey Eagle": "audio/webpage_album_cuts_image.png"},
+		},
+		{
+			name:      "png without wav is not a song",
+			keys:      []string{"audio/orphan.png"},
+			wantNames: nil,
+		},
+		{
+			name: "sorted most recently modified first",
+			keys: []string{
+				"audio/billy_in_the_lowground.wav",
+				"audio/grey_eagle.wav",
+				"audio/billy_in_the_lowground.png",
+			},
+			wantNames: []string{"Grey Eagle", "Billy In The Lowground"},
+			wantImage: map[string]string{
+				"Billy In The Lowground": "audio/billy_in_the_lowground.png",
+				"Grey Eagle":             "audio/webpage_album_cuts_image.png",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3(t)
+			for i, k := range tt.keys {
+				f.put("audio-bucket", k, "data", base.Add(time.Duration(i)*time.Minute))
+			}
+
+			songs, err := GetAudioFromS3()
+			require.NoError(t, err)
+
+			var names []string
+			for _, s := range songs {
+				names = append(names, s.Name)
+				require.Contains(t, s.AudioURL, f.URL+"/audio-bucket/"+s.Key)
+				if want, ok := tt.wantImage[s.Name]; ok {
+					require.Contains(t, s.ImageURL, f.URL+"/audio-bucket/"+want)
+				}
+			}
+			require.Equal(t, tt.wantNames, names)
+		})
 	}
-	fmt.Printf("%+v\n", songs)
+}
+
+func TestPresignedURLResolves(t *testing.T) {
+	f := newFakeS3(t)
+	f.put("audio-bucket", "audio/grey_eagle.wav", "RIFF", time.Now())
+
+	u, err := getPresignedURL("audio/grey_eagle.wav")
+	require.NoError(t, err)
+	require.Contains(t, u, "X-Amz-Signature=")
+
+	resp, err := http.Get(u)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "RIFF", string(b))
 }
 
 func TestFormatAudioTitle(t *testing.T) {
@@ -21,7 +97,6 @@ func TestFormatAudioTitle(t *testing.T) {
 	}{
 		{"audio/this_is_a_test.mp3", "This Is A Test"},
 	}
-	fmt.Printf("testing %v\n", formatAudioTitle("audio/this_is_a_test.mp3"))
 	for _, test := range tests {
 		if got := formatAudioTitle(test.input); got != test.expected {
 			t.Errorf("formatAudioTitle(%q) = %q, want %q", test.input, got, test.expected)
@@ -30,7 +105,21 @@ func TestFormatAudioTitle(t *testing.T) {
 }
 
 func TestUploadAudioToS3(t *testing.T) {
-	userHome := os.Getenv("HOME")
-	file := fmt.Sprintf("%s/recordings/wasted_words_kick.wav", userHome)
-	UploadAudioToS3(file)
+	f := newFakeS3(t)
+	file := filepath.Join(t.TempDir(), "wasted_words_kick.wav")
+	require.NoError(t, os.WriteFile(file, []byte("RIFF....WAVE"), 0644))
+
+	require.NoError(t, UploadAudioToS3(file))
+
+	obj, ok := f.object("audio-bucket", "audio/wasted_words_kick.wav")
+	require.True(t, ok)
+	require.Equal(t, "RIFF....WAVE", string(obj.body))
+	require.Equal(t, "audio/wav", obj.contentType)
+
+	keys, err := GetAudioKeysFromS3()
+	require.NoError(t, err)
+	require.Equal(t, []string{"audio/wasted_words_kick.wav"}, keys)
+
+	require.NoError(t, DeleteAudioFromS3("wasted_words_kick.wav"))
+	require.Empty(t, f.keys("audio-bucket"))
 }
@@ -1,19 +1,17 @@
 package aws
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/url"
 	"path/filepath"
 	"sort"
 	"strings"
-	"sync"
 
 	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
@@ -35,42 +33,32 @@ type SheetMusicAdminObject struct {
 	DisplayName string
 }
 
-type sheetCache struct {
-	sheets []SheetMusicJSONObject
-	mu     sync.Mutex
-}
-
-var sheetCacheInst = sheetCache{}
-
-func GetCachedSheetMusic() ([]SheetMusicJSONObject, error) {
-	sheetCacheInst.mu.Lock()
-	defer sheetCacheInst.mu.Unlock()
-	cp := make([]SheetMusicJSONObject, len(sheetCacheInst.sheets))
-	// shallow copy the cache slice
-	copy(cp, sheetCacheInst.sheets)
-	return cp, nil
-}
-
-func UpdateSheetMusicCache() {
-	log.Debug().Msg("Updating sheet music cache...")
+var sheetCache = NewCache("sheet music", func(ctx context.Context) ([]SheetMusicJSONObject, error) {
 	items, err := ListSheetMusicFromS3()
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to list sheet music from S3")
-		return
+		return nil, err
 	}
 	sort.Slice(items, func(i, j int) bool {
 		return strings.ToLower(items[i].DisplayName) < strings.ToLower(items[j].DisplayName)
 	})
-	sheetCacheInst.mu.Lock()
-	sheetCacheInst.sheets = items
-	sheetCacheInst.mu.Unlock()
-	log.Info().Msgf("Sheet music cache updated, %d entries", len(items))
+	return items, nil
+})
+
+func GetCachedSheetMusic() ([]SheetMusicJSONObject, error) {
+	return sheetCache.Get(), nil
+}
+
+func UpdateSheetMusicCache() {
+	_ = sheetCache.Refresh(context.Background())
 }
 
 func PutSheetJSON(displayName, dropboxURL, dropboxFileID string) error {
 	// slug is the name of object in S3 bucket, derived from display name. (eg derived_display_name.json)
 	slug := slugify(displayName)
 	key := ensureTrailingSlash(webCfg.C.SheetMusicS3BucketPrefix) + slug + ".json"
+	if isSheetMusicIndexKey(key) {
+		return fmt.Errorf("display name %q collides with the sheet music index object %s", displayName, key)
+	}
 
 	item := SheetMusicJSONObject{
 		DisplayName:   strings.TrimSpace(displayName),
@@ -82,17 +70,22 @@ func PutSheetJSON(displayName, dropboxURL, dropboxFileID string) error {
 		return err
 	}
 
-	_, err = getS3Client().PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(webCfg.C.SheetMusicS3BucketName),
-		Key:         aws.String(key),
-		Body:        strings.NewReader(string(body)),
-		ContentType: aws.String("application/json"),
+	ctx := context.TODO()
+	st := getStore()
+	err = st.Put(ctx, webCfg.C.SheetMusicS3BucketName, key, bytes.NewReader(body), PutOptions{
+		ContentType: "application/json",
 	})
 	if err != nil {
 		return err
 	}
-
 	log.Info().Msgf("Uploaded sheet JSON: s3://%s/%s", webCfg.C.SheetMusicS3BucketName, key)
+
+	err = updateSheetMusicIndex(ctx, st, func(entries map[string]SheetMusicJSONObject) {
+		entries[key] = item
+	})
+	if err != nil {
+		return fmt.Errorf("uploaded %s but failed to update the sheet music index (run rebuild-sheet-index): %w", key, err)
+	}
 	return nil
 }
 
@@ -108,15 +101,23 @@ func DeleteSheetMusicFromS3(key string) error {
 		key = key + ".json"
 	}
 
-	_, err := getS3Client().DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(webCfg.C.SheetMusicS3BucketName),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return err
+	if isSheetMusicIndexKey(key) {
+		return fmt.Errorf("refusing to delete the sheet music index %s; use rebuild-sheet-index instead", key)
 	}
 
+	ctx := context.TODO()
+	st := getStore()
+	if err := st.Delete(ctx, webCfg.C.SheetMusicS3BucketName, key); err != nil {
+		return err
+	}
 	log.Info().Msgf("Deleted sheet JSON: s3://%s/%s", webCfg.C.SheetMusicS3BucketName, key)
+
+	err := updateSheetMusicIndex(ctx, st, func(entries map[string]SheetMusicJSONObject) {
+		delete(entries, key)
+	})
+	if err != nil {
+		return fmt.Errorf("deleted %s but failed to update the sheet music index (run rebuild-sheet-index): %w", key, err)
+	}
 	return nil
 }
 
@@ -172,50 +173,55 @@ type sheetMusicS3Object struct {
 	JSONItem SheetMusicJSONObject
 }
 
-// listSheetJSONRaw main entry point for retrieving
+// listSheetJSONRaw main entry point for retrieving. Reads the index manifest
+// when one exists, falling back to reading every entry object individually.
 func listSheetJSONRaw() ([]sheetMusicS3Object, error) {
-	client := getS3Client()
-	out, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(webCfg.C.SheetMusicS3BucketName),
-		Prefix: aws.String(ensureTrailingSlash(webCfg.C.SheetMusicS3BucketPrefix)),
-	})
+	ctx := context.TODO()
+	st := getStore()
+	rows, err := listSheetJSONFromIndex(ctx, st)
+	if err == nil {
+		return rows, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		log.Warn().Err(err).Msg("Failed reading sheet music index; falling back to per-object reads")
+	}
+	return listSheetJSONFromObjects(ctx, st)
+}
+
+// listSheetJSONFromObjects lists the prefix and reads each entry object,
+// concurrently (see fetchObjects).
+func listSheetJSONFromObjects(ctx context.Context, st Store) ([]sheetMusicS3Object, error) {
+	objs, err := listAllObjects(ctx, st, webCfg.C.SheetMusicS3BucketName, ensureTrailingSlash(webCfg.C.SheetMusicS3BucketPrefix))
 	if err != nil {
 		return nil, err
 	}
 
-	rows := make([]sheetMusicS3Object, 0, len(out.Contents))
-	for _, obj := range out.Contents {
-		if obj.Key == nil {
-			continue
-		}
-		key := *obj.Key
-
-		if key == webCfg.C.SheetMusicS3BucketPrefix || !strings.HasSuffix(strings.ToLower(key), ".json") {
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		key := obj.Key
+		if key == webCfg.C.SheetMusicS3BucketPrefix || !strings.HasSuffix(strings.ToLower(key), ".json") || isSheetMusicIndexKey(key) || isSheetMusicTrashKey(key) {
 			continue
 		}
+		keys = append(keys, key)
+	}
 
-		// we need to read the individual json objects after getting list of all the keys
-		sheetMusicJSON, err := readSheetMusicJSONFromS3(client, webCfg.C.SheetMusicS3BucketName, key)
-		if err != nil {
-			log.Warn().Err(err).Msgf("Failed reading %s", key)
+	// we need to read the individual json objects after getting list of all the keys
+	results := fetchObjects(ctx, keys, fetchOptionsFromConfig(), func(ctx context.Context, key string) (SheetMusicJSONObject, error) {
+		return readSheetMusicJSONFromS3(ctx, st, webCfg.C.SheetMusicS3BucketName, key)
+	})
+	rows := make([]sheetMusicS3Object, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			log.Warn().Err(r.Err).Msgf("Failed reading %s", r.Key)
 			continue
 		}
-		rows = append(rows, sheetMusicS3Object{Key: key, JSONItem: sheetMusicJSON})
+		rows = append(rows, sheetMusicS3Object{Key: r.Key, JSONItem: r.Item})
 	}
-	return rows, nil
+	return rows, ctx.Err()
 }
 
-func readSheetMusicJSONFromS3(client *s3.Client, bucket, key string) (SheetMusicJSONObject, error) {
-	resp, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return SheetMusicJSONObject{}, err
-	}
-	defer resp.Body.Close()
-
-	b, err := io.ReadAll(resp.Body)
+func readSheetMusicJSONFromS3(ctx context.Context, st Store, bucket, key string) (SheetMusicJSONObject, error) {
+	b, _, err := st.Get(ctx, bucket, key)
 	if err != nil {
 		return SheetMusicJSONObject{}, err
 	}
@@ -2,8 +2,87 @@ package aws
 
 import (
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
-// Used to prototype implementation
 func TestPutSheetJSON(t *testing.T) {
+	type put struct {
+		name string
+		url  string
+	}
+	tests := []struct {
+		name     string
+		puts     []put
+		wantKeys []string
+		wantURLs map[string]string // display name -> url
+	}{
+		{
+			name: "distinct names get distinct keys",
+			puts: []put{
+				{"Jerusalem Ridge", "https://www.dropbox.com/s/a/jr.pdf"},
+				{"Grey Eagle", "https://www.dropbox.com/s/b/ge.pdf"},
+			},
+			wantKeys: []string{"dropbox_sheetmusic/grey_eagle.json", "dropbox_sheetmusic/jerusalem_ridge.json"},
+		},
+		{
+			name: "names that slugify the same collide and the last write wins",
+			puts: []put{
+				{"Jerusalem Ridge", "https://www.dropbox.com/s/a/old.pdf"},
+				{"jerusalem-ridge!", "https://www.dropbox.com/s/a/new.pdf"},
+			},
+			wantKeys: []string{"dropbox_sheetmusic/jerusalem_ridge.json"},
+			wantURLs: map[string]string{"jerusalem-ridge!": "https://www.dropbox.com/s/a/new.pdf?dl=0"},
+		},
+		{
+			name: "surrounding whitespace doesn't change the slug",
+			puts: []put{
+				{"  Salt Creek ", "https://www.dropbox.com/s/c/sc.pdf?dl=1"},
+				{"Salt Creek", "https://www.dropbox.com/s/c/sc2.pdf"},
+			},
+			wantKeys: []string{"dropbox_sheetmusic/salt_creek.json"},
+			wantURLs: map[string]string{"Salt Creek": "https://www.dropbox.com/s/c/sc2.pdf?dl=0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3(t)
+			for _, p := range tt.puts {
+				require.NoError(t, PutSheetJSON(p.name, p.url, ""))
+			}
+			require.Equal(t, tt.wantKeys, f.keys("sheet-bucket"))
+
+			items, err := ListSheetMusicFromS3()
+			require.NoError(t, err)
+			require.Len(t, items, len(tt.wantKeys))
+			for name, url := range tt.wantURLs {
+				found := false
+				for _, it := range items {
+					if it.DisplayName == name {
+						found = true
+						require.Equal(t, url, it.DropboxURL)
+					}
+				}
+				require.True(t, found, "entry %q not listed", name)
+			}
+		})
+	}
+}
+
+func TestListSheetMusicSkipsNonJSONAndFallsBackToKeyName(t *testing.T) {
+	f := newFakeS3(t)
+	now := time.Now()
+	f.put("sheet-bucket", "dropbox_sheetmusic/", "", now)
+	f.put("sheet-bucket", "dropbox_sheetmusic/readme.txt", "not json", now)
+	f.put("sheet-bucket", "dropbox_sheetmusic/big_sciota.json", `{"url":"https://example.com/bs.pdf"}`, now)
+	f.put("sheet-bucket", "dropbox_sheetmusic/broken.json", `{`, now)
+
+	objs, err := ListSheetMusicObjects()
+	require.NoError(t, err)
+	require.Equal(t, []SheetMusicAdminObject{{Key: "dropbox_sheetmusic/big_sciota.json", DisplayName: "Big Sciota"}}, objs)
+
+	require.NoError(t, DeleteSheetMusicByDisplayName("Big Sciota"))
+	require.NotContains(t, f.keys("sheet-bucket"), "dropbox_sheetmusic/big_sciota.json")
 }
@@ -1,18 +1,17 @@
 package aws
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
 	"github.com/rs/zerolog/log"
 )
 
@@ -32,49 +31,64 @@ func (s ShowJSONObject) FormattedDate() string {
 	return t.Format("January 2, 2006")
 }
 
-type showsCache struct {
-	shows []ShowJSONObject
-	mu    sync.Mutex
-}
-
-var showsCacheInst = showsCache{}
+var showsCache = NewCache("shows", func(ctx context.Context) ([]ShowJSONObject, error) {
+	items, err := ListShowsFromS3()
+	if err != nil {
+		return nil, err
+	}
+	// past shows are deleted by the ExpireShows job; hide any it hasn't
+	// reached yet
+	today := time.Now().Format("2006-01-02")
+	upcoming := items[:0]
+	for _, item := range items {
+		if item.Date == "" || item.Date >= today {
+			upcoming = append(upcoming, item)
+		}
+	}
+	sortShows(upcoming, today)
+	return upcoming, nil
+})
 
 func GetCachedShows() ([]ShowJSONObject, error) {
-	showsCacheInst.mu.Lock()
-	defer showsCacheInst.mu.Unlock()
-	cp := make([]ShowJSONObject, len(showsCacheInst.shows))
-	copy(cp, showsCacheInst.shows)
-	return cp, nil
+	return showsCache.Get(), nil
 }
 
-func deleteExpiredShows() {
+// ExpireShows deletes every show dated before today and refreshes the shows
+// cache if any were removed. It returns how many were deleted.
+func ExpireShows(ctx context.Context) (int, error) {
 	objects, err := ListShowObjects()
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to list show objects for expiry check")
-		return
+		return 0, fmt.Errorf("listing shows for expiry: %w", err)
 	}
 	today := time.Now().Format("2006-01-02")
+	deleted := 0
+	var errs []error
 	for _, obj := range objects {
-		if obj.Date != "" && obj.Date < today {
-			if err := DeleteShowFromS3(obj.Key); err != nil {
-				log.Error().Err(err).Msgf("Failed to delete expired show %s", obj.Key)
-			} else {
-				log.Info().Msgf("Deleted expired show %s (date=%s)", obj.Key, obj.Date)
-			}
+		if obj.Date == "" || obj.Date >= today {
+			continue
+		}
+		if err := DeleteShowFromS3(obj.Key); err != nil {
+			log.Error().Err(err).Msgf("Failed to delete expired show %s", obj.Key)
+			errs = append(errs, err)
+			continue
 		}
+		log.Info().Msgf("Deleted expired show %s (date=%s)", obj.Key, obj.Date)
+		notify.Record(ctx, "show expiry", "show_expired", obj.Title, obj.Date)
+		deleted++
 	}
+	if deleted > 0 {
+		_ = showsCache.Refresh(ctx)
+	}
+	return deleted, errors.Join(errs...)
 }
 
 func UpdateShowsCache() {
-	log.Debug().Msg("Updating shows cache...")
-	deleteExpiredShows()
-	items, err := ListShowsFromS3()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to list shows from S3")
-		return
-	}
-	today := time.Now().Format("2006-01-02")
-	// upcoming (>= today) ascending, past (< today) descending, empty last
+	_ = showsCache.Refresh(context.Background())
+}
+
+// sortShows orders upcoming (>= today) ascending, past (< today) descending,
+// empty last
+func sortShows(items []ShowJSONObject, today string) {
 	sort.Slice(items, func(i, j int) bool {
 		di, dj := items[i].Date, items[j].Date
 		iEmpty, jEmpty := di == "", dj == ""
@@ -97,10 +111,6 @@ func UpdateShowsCache() {
 		}
 		return di > dj // past: most recent first
 	})
-	showsCacheInst.mu.Lock()
-	showsCacheInst.shows = items
-	showsCacheInst.mu.Unlock()
-	log.Info().Msgf("Shows cache updated, %d entries", len(items))
 }
 
 func PutShowJSON(title, date, showTime, description string) error {
@@ -123,11 +133,8 @@ func PutShowJSON(title, date, showTime, description string) error {
 		return err
 	}
 
-	_, err = getS3Client().PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(webCfg.C.ShowsS3BucketName),
-		Key:         aws.String(key),
-		Body:        strings.NewReader(string(body)),
-		ContentType: aws.String("application/json"),
+	err = getStore().Put(context.TODO(), webCfg.C.ShowsS3BucketName, key, bytes.NewReader(body), PutOptions{
+		ContentType: "application/json",
 	})
 	if err != nil {
 		return err
@@ -138,32 +145,16 @@ func PutShowJSON(title, date, showTime, description string) error {
 }
 
 func ListShowsFromS3() ([]ShowJSONObject, error) {
-	client := getS3Client()
-	out, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(webCfg.C.ShowsS3BucketName),
-		Prefix: aws.String(ensureTrailingSlash(webCfg.C.ShowsS3BucketPrefix)),
-	})
+	rows, err := listShowJSONRaw(context.TODO())
 	if err != nil {
 		return nil, err
 	}
 
-	items := make([]ShowJSONObject, 0, len(out.Contents))
-	for _, obj := range out.Contents {
-		if obj.Key == nil {
-			continue
-		}
-		key := *obj.Key
-		if key == webCfg.C.ShowsS3BucketPrefix || !strings.HasSuffix(strings.ToLower(key), ".json") {
-			continue
-		}
-
-		item, err := readShowJSONFromS3(client, webCfg.C.ShowsS3BucketName, key)
-		if err != nil {
-			log.Warn().Err(err).Msgf("Failed reading show %s", key)
-			continue
-		}
+	items := make([]ShowJSONObject, 0, len(rows))
+	for _, r := range rows {
+		item := r.JSONItem
 		if strings.TrimSpace(item.Title) == "" {
-			item.Title = fallbackNameFromKey(key, webCfg.C.ShowsS3BucketPrefix)
+			item.Title = fallbackNameFromKey(r.Key, webCfg.C.ShowsS3BucketPrefix)
 		}
 		items = append(items, item)
 	}
@@ -177,34 +168,18 @@ type ShowAdminObject struct {
 }
 
 func ListShowObjects() ([]ShowAdminObject, error) {
-	client := getS3Client()
-	out, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
-		Bucket: aws.String(webCfg.C.ShowsS3BucketName),
-		Prefix: aws.String(ensureTrailingSlash(webCfg.C.ShowsS3BucketPrefix)),
-	})
+	rows, err := listShowJSONRaw(context.TODO())
 	if err != nil {
 		return nil, err
 	}
 
-	items := make([]ShowAdminObject, 0, len(out.Contents))
-	for _, obj := range out.Contents {
-		if obj.Key == nil {
-			continue
-		}
-		key := *obj.Key
-		if key == webCfg.C.ShowsS3BucketPrefix || !strings.HasSuffix(strings.ToLower(key), ".json") {
-			continue
-		}
-		item, err := readShowJSONFromS3(client, webCfg.C.ShowsS3BucketName, key)
-		if err != nil {
-			log.Warn().Err(err).Msgf("Failed reading show %s", key)
-			continue
-		}
-		title := strings.TrimSpace(item.Title)
+	items := make([]ShowAdminObject, 0, len(rows))
+	for _, r := range rows {
+		title := strings.TrimSpace(r.JSONItem.Title)
 		if title == "" {
-			title = fallbackNameFromKey(key, webCfg.C.ShowsS3BucketPrefix)
+			title = fallbackNameFromKey(r.Key, webCfg.C.ShowsS3BucketPrefix)
 		}
-		items = append(items, ShowAdminObject{Key: key, Title: title, Date: item.Date})
+		items = append(items, ShowAdminObject{Key: r.Key, Title: title, Date: r.JSONItem.Date})
 	}
 	sort.Slice(items, func(i, j int) bool {
 		return strings.ToLower(items[i].Title) < strings.ToLower(items[j].Title)
@@ -212,33 +187,58 @@ func ListShowObjects() ([]ShowAdminObject, error) {
 	return items, nil
 }
 
+// showS3Object the S3 key and associated JSON object for the key
+type showS3Object struct {
+	Key      string
+	JSONItem ShowJSONObject
+}
+
+// listShowJSONRaw lists the shows prefix and reads each show object,
+// concurrently (see fetchObjects).
+func listShowJSONRaw(ctx context.Context) ([]showS3Object, error) {
+	st := getStore()
+	objs, err := listAllObjects(ctx, st, webCfg.C.ShowsS3BucketName, ensureTrailingSlash(webCfg.C.ShowsS3BucketPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		key := obj.Key
+		if key == webCfg.C.ShowsS3BucketPrefix || !strings.HasSuffix(strings.ToLower(key), ".json") {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	results := fetchObjects(ctx, keys, fetchOptionsFromConfig(), func(ctx context.Context, key string) (ShowJSONObject, error) {
+		return readShowJSONFromS3(ctx, st, webCfg.C.ShowsS3BucketName, key)
+	})
+	rows := make([]showS3Object, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			log.Warn().Err(r.Err).Msgf("Failed reading show %s", r.Key)
+			continue
+		}
+		rows = append(rows, showS3Object{Key: r.Key, JSONItem: r.Item})
+	}
+	return rows, ctx.Err()
+}
+
 func DeleteShowFromS3(key string) error {
 	key = strings.TrimSpace(key)
 	if key == "" {
 		return fmt.Errorf("empty key")
 	}
-	_, err := getS3Client().DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(webCfg.C.ShowsS3BucketName),
-		Key:    aws.String(key),
-	})
-	if err != nil {
+	if err := getStore().Delete(context.TODO(), webCfg.C.ShowsS3BucketName, key); err != nil {
 		return err
 	}
 	log.Info().Msgf("Deleted show JSON: s3://%s/%s", webCfg.C.ShowsS3BucketName, key)
 	return nil
 }
 
-func readShowJSONFromS3(client *s3.Client, bucket, key string) (ShowJSONObject, error) {
-	resp, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-	})
-	if err != nil {
-		return ShowJSONObject{}, err
-	}
-	defer resp.Body.Close()
-
-	b, err := io.ReadAll(resp.Body)
+func readShowJSONFromS3(ctx context.Context, st Store, bucket, key string) (ShowJSONObject, error) {
+	b, _, err := st.Get(ctx, bucket, key)
 	if err != nil {
 		return ShowJSONObject{}, err
 	}
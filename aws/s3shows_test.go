@@ -0,0 +1,91 @@
+package aws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpireShows(t *testing.T) {
+	day := func(offset int) string { return time.Now().AddDate(0, 0, offset).Format("2006-01-02") }
+	tests := []struct {
+		name        string
+		shows       map[string]string // key suffix -> date
+		wantKept    []string          // remaining keys
+		wantTitles  []string          // cache order
+		wantDeleted int
+	}{
+		{
+			name:        "past shows are deleted",
+			shows:       map[string]string{"old": day(-1), "older": day(-30)},
+			wantKept:    nil,
+			wantTitles:  []string{},
+			wantDeleted: 2,
+		},
+		{
+			name:       "today and future shows are kept, nearest first",
+			shows:      map[string]string{"today": day(0), "later": day(10), "soon": day(2)},
+			wantKept:   []string{"shows/later.json", "shows/soon.json", "shows/today.json"},
+			wantTitles: []string{"today", "soon", "later"},
+		},
+		{
+			name:        "undated shows never expire and sort last",
+			shows:       map[string]string{"tbd": "", "gone": day(-2), "next": day(1)},
+			wantKept:    []string{"shows/next.json", "shows/tbd.json"},
+			wantTitles:  []string{"next", "tbd"},
+			wantDeleted: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeS3(t)
+			for title, date := range tt.shows {
+				f.put("shows-bucket", "shows/"+title+".json", `{"title":"`+title+`","date":"`+date+`"}`, time.Now())
+			}
+
+			deleted, err := ExpireShows(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, tt.wantDeleted, deleted)
+			UpdateShowsCache()
+
+			require.Equal(t, tt.wantKept, f.keys("shows-bucket"))
+			shows, err := GetCachedShows()
+			require.NoError(t, err)
+			titles := []string{}
+			for _, s := range shows {
+				titles = append(titles, s.Title)
+			}
+			require.Equal(t, tt.wantTitles, titles)
+		})
+	}
+}
+
+func TestShowsCacheHidesPastShowsBeforeExpiry(t *testing.T) {
+	f := newFakeS3(t)
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
+	f.put("shows-bucket", "shows/old.json", `{"title":"old","date":"`+yesterday+`"}`, time.Now())
+	f.put("shows-bucket", "shows/new.json", `{"title":"new","date":"`+tomorrow+`"}`, time.Now())
+
+	UpdateShowsCache()
+
+	shows, err := GetCachedShows()
+	require.NoError(t, err)
+	require.Len(t, shows, 1)
+	require.Equal(t, "new", shows[0].Title)
+	// deleting is left to the expire-shows job
+	require.Equal(t, []string{"shows/new.json", "shows/old.json"}, f.keys("shows-bucket"))
+}
+
+func TestPutShowJSON(t *testing.T) {
+	f := newFakeS3(t)
+	require.NoError(t, PutShowJSON("Tuesday Jam", "2099-05-01", "8:00pm", "at the pub"))
+	require.Equal(t, []string{"shows/tuesday_jam_2099-05-01.json"}, f.keys("shows-bucket"))
+
+	objs, err := ListShowObjects()
+	require.NoError(t, err)
+	require.Equal(t, []ShowAdminObject{{Key: "shows/tuesday_jam_2099-05-01.json", Title: "Tuesday Jam", Date: "2099-05-01"}}, objs)
+}
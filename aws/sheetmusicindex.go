@@ -0,0 +1,127 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+// sheetMusicIndexName is the manifest object stored alongside the per-entry
+// JSON objects. It holds every Sheet Music Entry so a full listing is a
+// single GET instead of one GET per entry.
+const sheetMusicIndexName = "index.json"
+
+// sheetMusicIndexRetries bounds how many times a read-modify-write of the
+// index is retried after losing an ETag race to a concurrent writer.
+const sheetMusicIndexRetries = 5
+
+// sheetMusicIndex is the manifest's JSON shape, keyed by each entry's S3 key.
+// The per-entry objects stay the source of truth; the index is a cache of
+// them that rebuild-sheet-index can always regenerate.
+type sheetMusicIndex struct {
+	Version   int                             `json:"version"`
+	UpdatedAt time.Time                       `json:"updated_at"`
+	Entries   map[string]SheetMusicJSONObject `json:"entries"`
+}
+
+func sheetMusicIndexKey() string {
+	return ensureTrailingSlash(webCfg.C.SheetMusicS3BucketPrefix) + sheetMusicIndexName
+}
+
+// readSheetMusicIndex returns the manifest and its ETag, or an error wrapping
+// ErrNotFound if the index hasn't been built.
+func readSheetMusicIndex(ctx context.Context, st Store) (sheetMusicIndex, string, error) {
+	b, etag, err := st.Get(ctx, webCfg.C.SheetMusicS3BucketName, sheetMusicIndexKey())
+	if err != nil {
+		return sheetMusicIndex{}, "", err
+	}
+	var idx sheetMusicIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return sheetMusicIndex{}, "", fmt.Errorf("parsing %s: %w", sheetMusicIndexKey(), err)
+	}
+	if idx.Entries == nil {
+		idx.Entries = map[string]SheetMusicJSONObject{}
+	}
+	return idx, etag, nil
+}
+
+func writeSheetMusicIndex(ctx context.Context, st Store, idx sheetMusicIndex, opts PutOptions) error {
+	idx.Version = 1
+	idx.UpdatedAt = time.Now().UTC()
+	body, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	opts.ContentType = "application/json"
+	return st.Put(ctx, webCfg.C.SheetMusicS3BucketName, sheetMusicIndexKey(), bytes.NewReader(body), opts)
+}
+
+// updateSheetMusicIndex applies mutate to the manifest with optimistic
+// concurrency: the write only lands if nobody changed the index since it was
+// read (If-Match on its ETag), otherwise it re-reads and tries again. If no
+// index exists the site is listing per-object, so there is nothing to update.
+func updateSheetMusicIndex(ctx context.Context, st Store, mutate func(entries map[string]SheetMusicJSONObject)) error {
+	for attempt := 1; attempt <= sheetMusicIndexRetries; attempt++ {
+		idx, etag, err := readSheetMusicIndex(ctx, st)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mutate(idx.Entries)
+		err = writeSheetMusicIndex(ctx, st, idx, PutOptions{IfMatch: etag})
+		if errors.Is(err, ErrPreconditionFailed) {
+			log.Debug().Msgf("sheet music index changed underneath us, retrying (attempt %d)", attempt)
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("sheet music index: gave up after %d conflicting concurrent updates", sheetMusicIndexRetries)
+}
+
+// listSheetJSONFromIndex returns the entries recorded in the manifest.
+func listSheetJSONFromIndex(ctx context.Context, st Store) ([]sheetMusicS3Object, error) {
+	idx, _, err := readSheetMusicIndex(ctx, st)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]sheetMusicS3Object, 0, len(idx.Entries))
+	for key, item := range idx.Entries {
+		rows = append(rows, sheetMusicS3Object{Key: key, JSONItem: item})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key < rows[j].Key })
+	return rows, nil
+}
+
+// RebuildSheetMusicIndex regenerates the manifest from the per-entry objects,
+// creating it if it doesn't exist yet. Returns the number of entries indexed.
+func RebuildSheetMusicIndex() (int, error) {
+	ctx := context.TODO()
+	st := getStore()
+	rows, err := listSheetJSONFromObjects(ctx, st)
+	if err != nil {
+		return 0, err
+	}
+	idx := sheetMusicIndex{Entries: make(map[string]SheetMusicJSONObject, len(rows))}
+	for _, r := range rows {
+		idx.Entries[r.Key] = r.JSONItem
+	}
+	if err := writeSheetMusicIndex(ctx, st, idx, PutOptions{}); err != nil {
+		return 0, err
+	}
+	log.Info().Msgf("Rebuilt sheet music index: s3://%s/%s (%d entries)", webCfg.C.SheetMusicS3BucketName, sheetMusicIndexKey(), len(rows))
+	return len(rows), nil
+}
+
+func isSheetMusicIndexKey(key string) bool {
+	return strings.EqualFold(key, sheetMusicIndexKey())
+}
@@ -0,0 +1,100 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func seedSheetMusic(f *fakeS3, names ...string) {
+	for _, n := range names {
+		f.put("sheet-bucket", "dropbox_sheetmusic/"+slugify(n)+".json", fmt.Sprintf(`{"display_name":%q,"url":"https://example.com/%s.pdf"}`, n, slugify(n)), time.Now())
+	}
+}
+
+func TestSheetMusicIndexListsWithOneGet(t *testing.T) {
+	f := newFakeS3(t)
+	seedSheetMusic(f, "Jerusalem Ridge", "Grey Eagle", "Salt Creek")
+
+	n, err := RebuildSheetMusicIndex()
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Contains(t, f.keys("sheet-bucket"), "dropbox_sheetmusic/index.json")
+
+	f.getCalls, f.listCalls = 0, 0
+	items, err := ListSheetMusicFromS3()
+	require.NoError(t, err)
+	require.Len(t, items, 3)
+	require.Equal(t, 1, f.getCalls)
+	require.Equal(t, 0, f.listCalls)
+}
+
+func TestSheetMusicWithoutIndexFallsBackToPerObjectReads(t *testing.T) {
+	f := newFakeS3(t)
+	seedSheetMusic(f, "Jerusalem Ridge", "Grey Eagle")
+
+	items, err := ListSheetMusicFromS3()
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+
+	// put/delete don't create an index on their own
+	require.NoError(t, PutSheetJSON("Salt Creek", "https://example.com/sc.pdf", ""))
+	require.NoError(t, DeleteSheetMusicByDisplayName("Grey Eagle"))
+	require.NotContains(t, f.keys("sheet-bucket"), "dropbox_sheetmusic/index.json")
+}
+
+func TestSheetMusicIndexMaintainedByPutAndDelete(t *testing.T) {
+	f := newFakeS3(t)
+	seedSheetMusic(f, "Jerusalem Ridge")
+	_, err := RebuildSheetMusicIndex()
+	require.NoError(t, err)
+
+	require.NoError(t, PutSheetJSON("Grey Eagle", "https://example.com/ge.pdf", "id:ge"))
+	require.NoError(t, DeleteSheetMusicByDisplayName("Jerusalem Ridge"))
+
+	idx, _, err := readSheetMusicIndex(context.Background(), getStore())
+	require.NoError(t, err)
+	require.Len(t, idx.Entries, 1)
+	require.Equal(t, "id:ge", idx.Entries["dropbox_sheetmusic/grey_eagle.json"].DropboxFileID)
+}
+
+func TestSheetMusicIndexRetriesOnConcurrentUpdate(t *testing.T) {
+	f := newFakeS3(t)
+	_, err := RebuildSheetMusicIndex()
+	require.NoError(t, err)
+
+	// the first time our index write goes out, another writer sneaks in an
+	// entry, so our If-Match must fail and the retry must keep both entries
+	raced := false
+	f.beforePut = func(bucket, key string) {
+		if key != "dropbox_sheetmusic/index.json" || raced {
+			return
+		}
+		raced = true
+		obj, _ := f.object(bucket, key)
+		var idx sheetMusicIndex
+		require.NoError(t, json.Unmarshal(obj.body, &idx))
+		idx.Entries["dropbox_sheetmusic/other.json"] = SheetMusicJSONObject{DisplayName: "Other"}
+		b, _ := json.Marshal(idx)
+		f.put(bucket, key, string(b), time.Now())
+	}
+
+	require.NoError(t, PutSheetJSON("Grey Eagle", "https://example.com/ge.pdf", ""))
+	require.True(t, raced)
+
+	items, err := ListSheetMusicObjects()
+	require.NoError(t, err)
+	require.Equal(t, []SheetMusicAdminObject{
+		{Key: "dropbox_sheetmusic/grey_eagle.json", DisplayName: "Grey Eagle"},
+		{Key: "dropbox_sheetmusic/other.json", DisplayName: "Other"},
+	}, items)
+}
+
+func TestPutSheetJSONRejectsIndexSlug(t *testing.T) {
+	newFakeS3(t)
+	require.Error(t, PutSheetJSON("Index", "https://example.com/i.pdf", ""))
+}
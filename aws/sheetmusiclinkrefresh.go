@@ -2,126 +2,193 @@ package aws
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
 	"strings"
 	"time"
 
 	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
 	"github.com/andrewwillette/andrewwillettedotcom/dropbox"
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
 	"github.com/rs/zerolog/log"
 )
 
-const sheetMusicLinkRefreshInterval = 24 * time.Hour
+// Per-entry outcomes of a Link Refresh Job run. In a dry run they describe
+// what the job would have done.
+const (
+	LinkUnchanged      = "unchanged"
+	LinkStaleUpdated   = "stale_link_updated"
+	LinkBackfilled     = "backfilled"
+	LinkAmbiguousMatch = "ambiguous_match"
+	LinkNoMatch        = "no_match"
+	LinkConfirmedGone  = "confirmed_gone"
+	LinkError          = "error"
+)
 
-// StartSheetMusicLinkRefreshJob runs the Link Refresh Job once immediately,
-// then once every 24h thereafter. It is a no-op if Dropbox isn't configured
-// yet (DROPBOX_REFRESH_TOKEN unset).
-func StartSheetMusicLinkRefreshJob() {
-	dbx := dropbox.NewClientFromConfig()
-	if dbx == nil {
-		log.Warn().Msg("Dropbox API not configured (DROPBOX_REFRESH_TOKEN unset); sheet music link refresh job disabled")
-		return
-	}
+// LinkRefreshResult is what the Link Refresh Job did (or would do) with one
+// Sheet Music Entry.
+type LinkRefreshResult struct {
+	Entry         string `json:"entry"`
+	Key           string `json:"key"`
+	Outcome       string `json:"outcome"`
+	DropboxFileID string `json:"dropbox_file_id,omitempty"`
+	OldURL        string `json:"old_url,omitempty"`
+	NewURL        string `json:"new_url,omitempty"`
+	// Detail explains the outcome, e.g. the error or why nothing matched.
+	Detail string `json:"detail,omitempty"`
+}
 
-	go func() {
-		RefreshSheetMusicLinks(dbx)
-		ticker := time.NewTicker(sheetMusicLinkRefreshInterval)
-		defer ticker.Stop()
-		for range ticker.C {
-			RefreshSheetMusicLinks(dbx)
-		}
-	}()
+// LinkRefreshReport is the per-entry account of one Link Refresh Job run.
+type LinkRefreshReport struct {
+	DryRun     bool                `json:"dry_run"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt time.Time           `json:"finished_at"`
+	Counts     map[string]int      `json:"counts"`
+	Results    []LinkRefreshResult `json:"results"`
+}
+
+// LinkRefreshOptions controls a Link Refresh Job run.
+type LinkRefreshOptions struct {
+	// DryRun reports what would change without writing to S3 or creating
+	// shared links in Dropbox.
+	DryRun bool
+}
+
+// linkRefreshDropbox is the part of the Dropbox client the Link Refresh Job
+// uses.
+type linkRefreshDropbox interface {
+	GetMetadata(ctx context.Context, pathOrID string) (*dropbox.FileMetadata, error)
+	ListFolder(ctx context.Context, folderPath string) ([]dropbox.FileMetadata, error)
+	GetSharedLink(ctx context.Context, pathOrID string) (string, error)
+	GetOrCreateSharedLink(ctx context.Context, pathOrID string) (string, error)
 }
 
 // RefreshSheetMusicLinks checks every Sheet Music Entry against Dropbox:
 //   - entries with a known Dropbox File ID are checked directly; a Confirmed
-//     Gone file causes the entry to be deleted, a moved/renamed file gets its
+//     Gone file moves the entry to the trash, a moved/renamed file gets its
 //     link refreshed.
 //   - entries missing a Dropbox File ID (uploaded before this job existed) are
 //     matched by name against files under webCfg.C.DropboxSheetMusicFolder; an
 //     Ambiguous Match (or no match) is skipped and logged, never guessed.
-func RefreshSheetMusicLinks(dbx *dropbox.Client) {
-	ctx := context.Background()
+//
+// Every entry gets a result in the report. Per-entry failures are reported
+// and skipped; the returned error covers only failing to list entries at all,
+// or being cancelled part way.
+func RefreshSheetMusicLinks(ctx context.Context, dbx *dropbox.Client, opts LinkRefreshOptions) (LinkRefreshReport, error) {
+	return refreshSheetMusicLinks(ctx, dbx, opts)
+}
+
+func refreshSheetMusicLinks(ctx context.Context, dbx linkRefreshDropbox, opts LinkRefreshOptions) (LinkRefreshReport, error) {
+	report := LinkRefreshReport{DryRun: opts.DryRun, StartedAt: time.Now().UTC(), Counts: map[string]int{}}
 
 	rows, err := listSheetJSONRaw()
 	if err != nil {
-		log.Error().Err(err).Msg("sheet music link refresh: failed to list entries")
-		return
+		return report, fmt.Errorf("sheet music link refresh: listing entries: %w", err)
 	}
 
 	var folderFiles []dropbox.FileMetadata
+	var folderErr error
 	var folderListed bool
 	changed := false
 
 	for _, row := range rows {
+		if ctx.Err() != nil {
+			log.Info().Msg("sheet music link refresh: stopping early, shutting down")
+			break
+		}
 		item := row.JSONItem
 
+		var res LinkRefreshResult
 		if item.DropboxFileID != "" {
-			if refreshKnownEntry(ctx, dbx, row.Key, item) {
-				changed = true
+			res = refreshKnownEntry(ctx, dbx, row.Key, item, opts.DryRun)
+		} else {
+			if !folderListed {
+				folderFiles, folderErr = dbx.ListFolder(ctx, webCfg.C.DropboxSheetMusicFolder)
+				if folderErr != nil {
+					log.Error().Err(folderErr).Str("folder", webCfg.C.DropboxSheetMusicFolder).
+						Msg("sheet music link refresh: failed to list dropbox folder; skipping name-matching this run")
+				}
+				folderListed = true
 			}
-			continue
-		}
-
-		if !folderListed {
-			folderFiles, err = dbx.ListFolder(ctx, webCfg.C.DropboxSheetMusicFolder)
-			if err != nil {
-				log.Error().Err(err).Str("folder", webCfg.C.DropboxSheetMusicFolder).
-					Msg("sheet music link refresh: failed to list dropbox folder; skipping name-matching this run")
+			if folderErr != nil {
+				res = linkRefreshError(row.Key, item, "listing dropbox folder", folderErr)
+			} else {
+				res = backfillEntry(ctx, dbx, row.Key, item, folderFiles, opts.DryRun)
 			}
-			folderListed = true
 		}
 
-		if backfillEntry(ctx, dbx, item, folderFiles) {
-			changed = true
+		logLinkRefreshResult(res, opts.DryRun)
+		if !opts.DryRun {
+			notifyLinkRefreshResult(ctx, res)
+		}
+		report.Results = append(report.Results, res)
+		report.Counts[res.Outcome]++
+		switch res.Outcome {
+		case LinkStaleUpdated, LinkBackfilled, LinkConfirmedGone:
+			if !opts.DryRun {
+				changed = true
+			}
 		}
 	}
 
 	if changed {
 		UpdateSheetMusicCache()
 	}
+	report.FinishedAt = time.Now().UTC()
+	return report, ctx.Err()
 }
 
 // refreshKnownEntry handles an entry that already has a Dropbox File ID.
-// Returns true if the entry was changed (updated or deleted).
-func refreshKnownEntry(ctx context.Context, dbx *dropbox.Client, key string, item SheetMusicJSONObject) bool {
+func refreshKnownEntry(ctx context.Context, dbx linkRefreshDropbox, key string, item SheetMusicJSONObject, dryRun bool) LinkRefreshResult {
+	res := LinkRefreshResult{Entry: item.DisplayName, Key: key, DropboxFileID: item.DropboxFileID, OldURL: item.DropboxURL}
+
 	meta, err := dbx.GetMetadata(ctx, item.DropboxFileID)
 	if err != nil {
-		log.Error().Err(err).Str("entry", item.DisplayName).Msg("sheet music link refresh: failed to check dropbox metadata")
-		return false
+		return linkRefreshError(key, item, "checking dropbox metadata", err)
 	}
 	if meta == nil {
-		log.Warn().Str("entry", item.DisplayName).Msg("sheet music link refresh: backing dropbox file confirmed gone; deleting entry")
-		if err := DeleteSheetMusicFromS3(key); err != nil {
-			log.Error().Err(err).Str("entry", item.DisplayName).Msg("sheet music link refresh: failed to delete entry for gone file")
-			return false
+		res.Outcome = LinkConfirmedGone
+		if dryRun {
+			res.Detail = "would be moved to the trash"
+			return res
 		}
-		return true
+		if err := trashSheetMusic(ctx, key, item, "dropbox file confirmed gone"); err != nil {
+			return linkRefreshError(key, item, "moving entry for gone file to the trash", err)
+		}
+		res.Detail = "moved to the trash"
+		return res
 	}
 
-	freshURL, err := dbx.GetOrCreateSharedLink(ctx, item.DropboxFileID)
+	freshURL, err := sharedLink(ctx, dbx, item.DropboxFileID, dryRun)
 	if err != nil {
-		log.Error().Err(err).Str("entry", item.DisplayName).Msg("sheet music link refresh: failed to fetch shared link")
-		return false
+		return linkRefreshError(key, item, "fetching shared link", err)
+	}
+	if freshURL == "" {
+		// dry run, and the file has no shared link yet
+		res.Outcome = LinkStaleUpdated
+		res.Detail = "a new shared link would be created"
+		return res
 	}
 	freshURL = normalizeDropboxURL(freshURL)
 	if freshURL == item.DropboxURL {
-		return false
+		res.Outcome = LinkUnchanged
+		return res
 	}
 
-	log.Info().Str("entry", item.DisplayName).Str("old_url", item.DropboxURL).Str("new_url", freshURL).
-		Msg("sheet music link refresh: updating stale link")
-	if err := PutSheetJSON(item.DisplayName, freshURL, item.DropboxFileID); err != nil {
-		log.Error().Err(err).Str("entry", item.DisplayName).Msg("sheet music link refresh: failed to save refreshed link")
-		return false
+	res.Outcome = LinkStaleUpdated
+	res.NewURL = freshURL
+	if !dryRun {
+		if err := PutSheetJSON(item.DisplayName, freshURL, item.DropboxFileID); err != nil {
+			return linkRefreshError(key, item, "saving refreshed link", err)
+		}
 	}
-	return true
+	return res
 }
 
 // backfillEntry handles a legacy entry with no stored Dropbox File ID, matching
 // it by name against files already listed from the configured Dropbox folder.
-// Returns true if the entry was changed.
-func backfillEntry(ctx context.Context, dbx *dropbox.Client, item SheetMusicJSONObject, folderFiles []dropbox.FileMetadata) bool {
+func backfillEntry(ctx context.Context, dbx linkRefreshDropbox, key string, item SheetMusicJSONObject, folderFiles []dropbox.FileMetadata, dryRun bool) LinkRefreshResult {
+	res := LinkRefreshResult{Entry: item.DisplayName, Key: key, OldURL: item.DropboxURL}
 	target := slugify(item.DisplayName)
 
 	var match *dropbox.FileMetadata
@@ -140,25 +207,90 @@ func backfillEntry(ctx context.Context, dbx *dropbox.Client, item SheetMusicJSON
 	}
 
 	if ambiguous {
-		log.Warn().Str("entry", item.DisplayName).Msg("sheet music link refresh: ambiguous name match against dropbox folder; skipping")
-		return false
+		res.Outcome = LinkAmbiguousMatch
+		res.Detail = "more than one dropbox file matches this name"
+		return res
 	}
 	if match == nil {
-		log.Warn().Str("entry", item.DisplayName).Msg("sheet music link refresh: no matching dropbox file found for entry lacking a file ID; skipping")
-		return false
+		res.Outcome = LinkNoMatch
+		res.Detail = "no dropbox file matches this name"
+		return res
 	}
 
-	freshURL, err := dbx.GetOrCreateSharedLink(ctx, match.ID)
+	res.Outcome = LinkBackfilled
+	res.DropboxFileID = match.ID
+	freshURL, err := sharedLink(ctx, dbx, match.ID, dryRun)
 	if err != nil {
-		log.Error().Err(err).Str("entry", item.DisplayName).Msg("sheet music link refresh: failed to fetch shared link for backfilled match")
-		return false
+		return linkRefreshError(key, item, "fetching shared link for backfilled match", err)
 	}
-	freshURL = normalizeDropboxURL(freshURL)
+	if freshURL == "" {
+		res.Detail = "a new shared link would be created"
+		return res
+	}
+	res.NewURL = normalizeDropboxURL(freshURL)
+	if !dryRun {
+		if err := PutSheetJSON(item.DisplayName, res.NewURL, match.ID); err != nil {
+			return linkRefreshError(key, item, "saving backfilled entry", err)
+		}
+	}
+	return res
+}
+
+// sharedLink returns the file's shared link. Dry runs only look up an
+// existing one (returning "" if there is none) rather than creating it.
+func sharedLink(ctx context.Context, dbx linkRefreshDropbox, fileID string, dryRun bool) (string, error) {
+	if dryRun {
+		return dbx.GetSharedLink(ctx, fileID)
+	}
+	return dbx.GetOrCreateSharedLink(ctx, fileID)
+}
 
-	log.Info().Str("entry", item.DisplayName).Str("dropbox_file_id", match.ID).Msg("sheet music link refresh: backfilled dropbox file id")
-	if err := PutSheetJSON(item.DisplayName, freshURL, match.ID); err != nil {
-		log.Error().Err(err).Str("entry", item.DisplayName).Msg("sheet music link refresh: failed to save backfilled entry")
-		return false
+func linkRefreshError(key string, item SheetMusicJSONObject, action string, err error) LinkRefreshResult {
+	return LinkRefreshResult{
+		Entry:         item.DisplayName,
+		Key:           key,
+		Outcome:       LinkError,
+		DropboxFileID: item.DropboxFileID,
+		OldURL:        item.DropboxURL,
+		Detail:        action + ": " + err.Error(),
+	}
+}
+
+// notifyLinkRefreshResult reports entries the job changed, or failed on, to
+// the site owner.
+func notifyLinkRefreshResult(ctx context.Context, res LinkRefreshResult) {
+	detail := res.Detail
+	switch res.Outcome {
+	case LinkStaleUpdated, LinkBackfilled:
+		if res.NewURL != "" {
+			detail = res.OldURL + " -> " + res.NewURL
+		}
+	case LinkConfirmedGone, LinkError:
+	default:
+		return
+	}
+	notify.Record(ctx, "sheet music link refresh", res.Outcome, res.Entry, detail)
+}
+
+func logLinkRefreshResult(res LinkRefreshResult, dryRun bool) {
+	ev := log.Info()
+	switch res.Outcome {
+	case LinkUnchanged:
+		ev = log.Debug()
+	case LinkAmbiguousMatch, LinkNoMatch, LinkConfirmedGone:
+		ev = log.Warn()
+	case LinkError:
+		ev = log.Error()
+	}
+	ev.Str("entry", res.Entry).Str("outcome", res.Outcome).Bool("dry_run", dryRun)
+	if res.DropboxFileID != "" {
+		ev = ev.Str("dropbox_file_id", res.DropboxFileID)
+	}
+	if res.NewURL != "" {
+		ev = ev.Str("old_url", res.OldURL).Str("new_url", res.NewURL)
+	}
+	if res.Detail != "" {
+		ev = ev.Str("detail", res.Detail)
 	}
-	return true
+	ev.Msg("sheet music link refresh")
 }
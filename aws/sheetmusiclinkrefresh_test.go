@@ -0,0 +1,202 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/dropbox"
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLinkDropbox is an in-memory linkRefreshDropbox.
+type fakeLinkDropbox struct {
+	files   map[string]dropbox.FileMetadata // by ID
+	links   map[string]string               // file ID -> shared link
+	broken  map[string]bool                 // IDs whose metadata lookup fails
+	created []string                        // IDs a shared link was created for
+}
+
+func (d *fakeLinkDropbox) GetMetadata(ctx context.Context, id string) (*dropbox.FileMetadata, error) {
+	if d.broken[id] {
+		return nil, errors.New("dropbox unavailable")
+	}
+	f, ok := d.files[id]
+	if !ok {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func (d *fakeLinkDropbox) ListFolder(ctx context.Context, folder string) ([]dropbox.FileMetadata, error) {
+	var out []dropbox.FileMetadata
+	for _, f := range d.files {
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func (d *fakeLinkDropbox) GetSharedLink(ctx context.Context, id string) (string, error) {
+	return d.links[id], nil
+}
+
+func (d *fakeLinkDropbox) GetOrCreateSharedLink(ctx context.Context, id string) (string, error) {
+	if l, ok := d.links[id]; ok {
+		return l, nil
+	}
+	l := "https://www.dropbox.com/s/created/" + id + ".pdf"
+	d.links[id] = l
+	d.created = append(d.created, id)
+	return l, nil
+}
+
+func seedLinkRefreshEntries(t *testing.T, f *fakeS3) *fakeLinkDropbox {
+	t.Helper()
+	webCfg.C.DropboxSheetMusicFolder = "/sheet music"
+	entries := []SheetMusicJSONObject{
+		{DisplayName: "Unchanged", DropboxURL: "https://www.dropbox.com/s/u/unchanged.pdf?dl=0", DropboxFileID: "id:u"},
+		{DisplayName: "Stale", DropboxURL: "https://www.dropbox.com/s/old/stale.pdf?dl=0", DropboxFileID: "id:s"},
+		{DisplayName: "Gone", DropboxURL: "https://www.dropbox.com/s/g/gone.pdf?dl=0", DropboxFileID: "id:g"},
+		{DisplayName: "Broken", DropboxURL: "https://www.dropbox.com/s/b/broken.pdf?dl=0", DropboxFileID: "id:b"},
+		{DisplayName: "Legacy Tune", DropboxURL: "https://www.dropbox.com/s/old/legacy.pdf?dl=0"},
+		{DisplayName: "Never Shared", DropboxURL: "https://www.dropbox.com/s/old/never.pdf?dl=0"},
+		{DisplayName: "Twin", DropboxURL: "https://www.dropbox.com/s/old/twin.pdf?dl=0"},
+		{DisplayName: "Orphan", DropboxURL: "https://www.dropbox.com/s/old/orphan.pdf?dl=0"},
+	}
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		require.NoError(t, err)
+		f.put("sheet-bucket", "dropbox_sheetmusic/"+slugify(e.DisplayName)+".json", string(b), time.Now())
+	}
+	return &fakeLinkDropbox{
+		files: map[string]dropbox.FileMetadata{
+			"id:u":  {ID: "id:u", Name: "unchanged.pdf"},
+			"id:s":  {ID: "id:s", Name: "stale (moved).pdf"},
+			"id:b":  {ID: "id:b", Name: "broken.pdf"},
+			"id:l":  {ID: "id:l", Name: "Legacy Tune.pdf"},
+			"id:n":  {ID: "id:n", Name: "never shared.pdf"},
+			"id:t1": {ID: "id:t1", Name: "Twin.pdf"},
+			"id:t2": {ID: "id:t2", Name: "twin!.pdf"},
+		},
+		links: map[string]string{
+			"id:u": "https://www.dropbox.com/s/u/unchanged.pdf",
+			"id:s": "https://www.dropbox.com/s/new/stale.pdf",
+			"id:l": "https://www.dropbox.com/s/l/legacy.pdf",
+		},
+		broken: map[string]bool{"id:b": true},
+	}
+}
+
+func outcomesByEntry(report LinkRefreshReport) map[string]string {
+	out := map[string]string{}
+	for _, r := range report.Results {
+		out[r.Entry] = r.Outcome
+	}
+	return out
+}
+
+var wantLinkRefreshOutcomes = map[string]string{
+	"Unchanged":    LinkUnchanged,
+	"Stale":        LinkStaleUpdated,
+	"Gone":         LinkConfirmedGone,
+	"Broken":       LinkError,
+	"Legacy Tune":  LinkBackfilled,
+	"Never Shared": LinkBackfilled,
+	"Twin":         LinkAmbiguousMatch,
+	"Orphan":       LinkNoMatch,
+}
+
+func TestRefreshSheetMusicLinksDryRunChangesNothing(t *testing.T) {
+	f := newFakeS3(t)
+	dbx := seedLinkRefreshEntries(t, f)
+	before := map[string]string{}
+	for _, k := range f.keys("sheet-bucket") {
+		obj, _ := f.object("sheet-bucket", k)
+		before[k] = string(obj.body)
+	}
+
+	report, err := refreshSheetMusicLinks(context.Background(), dbx, LinkRefreshOptions{DryRun: true})
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, wantLinkRefreshOutcomes, outcomesByEntry(report))
+	require.Equal(t, 2, report.Counts[LinkBackfilled])
+	require.False(t, report.FinishedAt.Before(report.StartedAt))
+
+	for _, r := range report.Results {
+		switch r.Entry {
+		case "Stale":
+			require.Equal(t, "https://www.dropbox.com/s/new/stale.pdf?dl=0", r.NewURL)
+		case "Legacy Tune":
+			require.Equal(t, "id:l", r.DropboxFileID)
+		case "Never Shared":
+			require.Empty(t, r.NewURL)
+			require.Equal(t, "a new shared link would be created", r.Detail)
+		case "Broken":
+			require.Contains(t, r.Detail, "dropbox unavailable")
+		}
+	}
+
+	require.Empty(t, dbx.created)
+	after := map[string]string{}
+	for _, k := range f.keys("sheet-bucket") {
+		obj, _ := f.object("sheet-bucket", k)
+		after[k] = string(obj.body)
+	}
+	require.Equal(t, before, after)
+}
+
+func TestRefreshSheetMusicLinksApplies(t *testing.T) {
+	resetContentCaches(t)
+	f := newFakeS3(t)
+	dbx := seedLinkRefreshEntries(t, f)
+
+	batch := notify.NewBatch("sheet-music-link-refresh")
+	report, err := refreshSheetMusicLinks(notify.WithBatch(context.Background(), batch), dbx, LinkRefreshOptions{})
+	require.NoError(t, err)
+	require.False(t, report.DryRun)
+	// everything changed (or failed) is reported, nothing that was left alone
+	notified := map[string]string{}
+	for _, e := range batch.Digest().Events {
+		notified[e.Subject] = e.Kind
+	}
+	require.Equal(t, map[string]string{
+		"Stale":        LinkStaleUpdated,
+		"Gone":         LinkConfirmedGone,
+		"Broken":       LinkError,
+		"Legacy Tune":  LinkBackfilled,
+		"Never Shared": LinkBackfilled,
+	}, notified)
+	require.Equal(t, wantLinkRefreshOutcomes, outcomesByEntry(report))
+	require.Equal(t, []string{"id:n"}, dbx.created)
+
+	require.NotContains(t, f.keys("sheet-bucket"), "dropbox_sheetmusic/gone.json")
+	trashed, err := ListTrashedSheetMusic(context.Background())
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	require.Equal(t, "Gone", trashed[0].Entry.DisplayName)
+	require.Equal(t, "dropbox_sheetmusic/gone.json", trashed[0].OriginalKey)
+	require.Equal(t, "id:g", trashed[0].LastKnownFileID)
+	require.NotEmpty(t, trashed[0].Reason)
+	items, err := ListSheetMusicFromS3()
+	require.NoError(t, err)
+	got := map[string]SheetMusicJSONObject{}
+	for _, it := range items {
+		got[it.DisplayName] = it
+	}
+	require.Len(t, got, 7)
+	require.Equal(t, "https://www.dropbox.com/s/new/stale.pdf?dl=0", got["Stale"].DropboxURL)
+	require.Equal(t, "id:l", got["Legacy Tune"].DropboxFileID)
+	require.Equal(t, "https://www.dropbox.com/s/l/legacy.pdf?dl=0", got["Legacy Tune"].DropboxURL)
+	require.Equal(t, "id:n", got["Never Shared"].DropboxFileID)
+	require.Empty(t, got["Twin"].DropboxFileID)
+	require.Empty(t, got["Orphan"].DropboxFileID)
+
+	// a second run finds nothing left to do for the entries it fixed
+	report, err = refreshSheetMusicLinks(context.Background(), dbx, LinkRefreshOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, 4, report.Counts[LinkUnchanged])
+}
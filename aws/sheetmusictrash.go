@@ -0,0 +1,202 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
+	"github.com/rs/zerolog/log"
+)
+
+// sheetMusicTrashPrefix is where removed Sheet Music Entries are kept, at the
+// root of the sheet music bucket so they never show up in the public listing.
+// A trashed entry's key is this prefix followed by its original key.
+const sheetMusicTrashPrefix = "trash/"
+
+// DefaultSheetTrashRetention is how long trashed entries are kept when
+// SHEET_TRASH_RETENTION_DAYS is unset.
+const DefaultSheetTrashRetention = 30 * 24 * time.Hour
+
+// TrashedSheetMusic is a Sheet Music Entry moved to the trash, with why and
+// when it was removed.
+type TrashedSheetMusic struct {
+	// Key is the trash object's own key; not stored in the object.
+	Key             string               `json:"-"`
+	OriginalKey     string               `json:"original_key"`
+	Entry           SheetMusicJSONObject `json:"entry"`
+	DeletedAt       time.Time            `json:"deleted_at"`
+	Reason          string               `json:"reason"`
+	LastKnownFileID string               `json:"last_known_file_id,omitempty"`
+}
+
+// SheetTrashRetention is how long trashed entries are kept before the purge
+// job deletes them for good.
+func SheetTrashRetention() time.Duration {
+	if webCfg.C.SheetTrashRetentionDays > 0 {
+		return time.Duration(webCfg.C.SheetTrashRetentionDays) * 24 * time.Hour
+	}
+	return DefaultSheetTrashRetention
+}
+
+func sheetMusicTrashKey(originalKey string) string {
+	return sheetMusicTrashPrefix + originalKey
+}
+
+func isSheetMusicTrashKey(key string) bool {
+	return strings.HasPrefix(key, sheetMusicTrashPrefix)
+}
+
+// LocalStorageServes reports whether the web server may serve bucket/key from
+// the local storage directory. Trashed sheet music isn't served: on S3 nothing
+// presigns it, and a deleted entry shouldn't stay downloadable until it's
+// purged.
+func LocalStorageServes(bucket, key string) bool {
+	return !(bucket == webCfg.C.SheetMusicS3BucketName && isSheetMusicTrashKey(key))
+}
+
+// trashSheetMusic moves a Sheet Music Entry to the trash: the entry and its
+// deletion metadata are written under trash/ before the live entry is removed,
+// so a failure part way never loses it.
+func trashSheetMusic(ctx context.Context, key string, item SheetMusicJSONObject, reason string) error {
+	trashed := TrashedSheetMusic{
+		OriginalKey:     key,
+		Entry:           item,
+		DeletedAt:       time.Now().UTC(),
+		Reason:          reason,
+		LastKnownFileID: item.DropboxFileID,
+	}
+	body, err := json.MarshalIndent(trashed, "", "  ")
+	if err != nil {
+		return err
+	}
+	st := getStore()
+	trashKey := sheetMusicTrashKey(key)
+	err = st.Put(ctx, webCfg.C.SheetMusicS3BucketName, trashKey, bytes.NewReader(body), PutOptions{
+		ContentType: "application/json",
+	})
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", trashKey, err)
+	}
+	log.Info().Msgf("Moved sheet JSON to trash: s3://%s/%s (%s)", webCfg.C.SheetMusicS3BucketName, trashKey, reason)
+	return DeleteSheetMusicFromS3(key)
+}
+
+// ListTrashedSheetMusic returns every trashed entry, most recently deleted
+// first.
+func ListTrashedSheetMusic(ctx context.Context) ([]TrashedSheetMusic, error) {
+	st := getStore()
+	objs, err := listAllObjects(ctx, st, webCfg.C.SheetMusicS3BucketName, sheetMusicTrashPrefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		if strings.HasSuffix(strings.ToLower(obj.Key), ".json") {
+			keys = append(keys, obj.Key)
+		}
+	}
+	results := fetchObjects(ctx, keys, fetchOptionsFromConfig(), func(ctx context.Context, key string) (TrashedSheetMusic, error) {
+		return readTrashedSheetMusic(ctx, st, key)
+	})
+	out := make([]TrashedSheetMusic, 0, len(results))
+	for _, r := range results {
+		if r.Err != nil {
+			log.Warn().Err(r.Err).Msgf("Failed reading %s", r.Key)
+			continue
+		}
+		out = append(out, r.Item)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DeletedAt.After(out[j].DeletedAt) })
+	return out, ctx.Err()
+}
+
+func readTrashedSheetMusic(ctx context.Context, st Store, key string) (TrashedSheetMusic, error) {
+	b, _, err := st.Get(ctx, webCfg.C.SheetMusicS3BucketName, key)
+	if err != nil {
+		return TrashedSheetMusic{}, err
+	}
+	var t TrashedSheetMusic
+	if err := json.Unmarshal(b, &t); err != nil {
+		return TrashedSheetMusic{}, fmt.Errorf("parsing %s: %w", key, err)
+	}
+	t.Key = key
+	if t.OriginalKey == "" {
+		t.OriginalKey = strings.TrimPrefix(key, sheetMusicTrashPrefix)
+	}
+	return t, nil
+}
+
+// RestoreSheetMusic puts a trashed entry back at its original key and removes
+// it from the trash. It refuses to replace a live entry at that key unless
+// overwrite is set.
+func RestoreSheetMusic(ctx context.Context, trashKey string, overwrite bool) (TrashedSheetMusic, error) {
+	st := getStore()
+	t, err := readTrashedSheetMusic(ctx, st, trashKey)
+	if err != nil {
+		return TrashedSheetMusic{}, err
+	}
+	bucket := webCfg.C.SheetMusicS3BucketName
+
+	if !overwrite {
+		_, _, err := st.Get(ctx, bucket, t.OriginalKey)
+		if err == nil {
+			return t, fmt.Errorf("an entry already exists at %s; pass overwrite to replace it", t.OriginalKey)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return t, err
+		}
+	}
+
+	body, err := json.MarshalIndent(t.Entry, "", "  ")
+	if err != nil {
+		return t, err
+	}
+	err = st.Put(ctx, bucket, t.OriginalKey, bytes.NewReader(body), PutOptions{ContentType: "application/json"})
+	if err != nil {
+		return t, err
+	}
+	log.Info().Msgf("Restored sheet JSON: s3://%s/%s", bucket, t.OriginalKey)
+
+	err = updateSheetMusicIndex(ctx, st, func(entries map[string]SheetMusicJSONObject) {
+		entries[t.OriginalKey] = t.Entry
+	})
+	if err != nil {
+		return t, fmt.Errorf("restored %s but failed to update the sheet music index (run rebuild-sheet-index): %w", t.OriginalKey, err)
+	}
+	if err := st.Delete(ctx, bucket, trashKey); err != nil {
+		return t, fmt.Errorf("restored %s but failed to remove %s from the trash: %w", t.OriginalKey, trashKey, err)
+	}
+	UpdateSheetMusicCache()
+	return t, nil
+}
+
+// PurgeSheetMusicTrash permanently deletes trashed entries older than the
+// retention period and returns how many were removed.
+func PurgeSheetMusicTrash(ctx context.Context) (int, error) {
+	trashed, err := ListTrashedSheetMusic(ctx)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-SheetTrashRetention())
+	st := getStore()
+	purged := 0
+	for _, t := range trashed {
+		if t.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := st.Delete(ctx, webCfg.C.SheetMusicS3BucketName, t.Key); err != nil {
+			return purged, fmt.Errorf("purging %s: %w", t.Key, err)
+		}
+		log.Info().Msgf("Purged trashed sheet music %q (deleted %s)", t.Entry.DisplayName, t.DeletedAt.Format(time.RFC3339))
+		notify.Record(ctx, "sheet music trash purge", "trash_purged", t.Entry.DisplayName, "deleted "+t.DeletedAt.Format(time.DateOnly)+": "+t.Reason)
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,73 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashAndRestoreSheetMusic(t *testing.T) {
+	resetContentCaches(t)
+	f := newFakeS3(t)
+	ctx := context.Background()
+	require.NoError(t, PutSheetJSON("Salt Creek", "https://www.dropbox.com/s/c/sc.pdf", "id:sc"))
+	_, err := RebuildSheetMusicIndex()
+	require.NoError(t, err)
+
+	item := SheetMusicJSONObject{DisplayName: "Salt Creek", DropboxURL: "https://www.dropbox.com/s/c/sc.pdf?dl=0", DropboxFileID: "id:sc"}
+	require.NoError(t, trashSheetMusic(ctx, "dropbox_sheetmusic/salt_creek.json", item, "dropbox file confirmed gone"))
+
+	// gone from the site, both from the index and a per-object listing
+	items, err := ListSheetMusicFromS3()
+	require.NoError(t, err)
+	require.Empty(t, items)
+	rows, err := listSheetJSONFromObjects(ctx, getStore())
+	require.NoError(t, err)
+	require.Empty(t, rows)
+	require.Contains(t, f.keys("sheet-bucket"), "trash/dropbox_sheetmusic/salt_creek.json")
+
+	trashed, err := ListTrashedSheetMusic(ctx)
+	require.NoError(t, err)
+	require.Len(t, trashed, 1)
+	require.Equal(t, item, trashed[0].Entry)
+	require.WithinDuration(t, time.Now(), trashed[0].DeletedAt, time.Minute)
+
+	// a new entry reusing the name blocks a plain restore
+	require.NoError(t, PutSheetJSON("Salt Creek", "https://www.dropbox.com/s/new/sc.pdf", "id:new"))
+	_, err = RestoreSheetMusic(ctx, trashed[0].Key, false)
+	require.Error(t, err)
+
+	restored, err := RestoreSheetMusic(ctx, trashed[0].Key, true)
+	require.NoError(t, err)
+	require.Equal(t, "dropbox_sheetmusic/salt_creek.json", restored.OriginalKey)
+	items, err = ListSheetMusicFromS3()
+	require.NoError(t, err)
+	require.Equal(t, []SheetMusicJSONObject{item}, items)
+	require.NotContains(t, f.keys("sheet-bucket"), "trash/dropbox_sheetmusic/salt_creek.json")
+}
+
+func TestPurgeSheetMusicTrash(t *testing.T) {
+	f := newFakeS3(t)
+	webCfg.C.SheetTrashRetentionDays = 7
+	seed := func(name string, age time.Duration) {
+		b, err := json.Marshal(TrashedSheetMusic{
+			OriginalKey: "dropbox_sheetmusic/" + slugify(name) + ".json",
+			Entry:       SheetMusicJSONObject{DisplayName: name},
+			DeletedAt:   time.Now().Add(-age).UTC(),
+			Reason:      "dropbox file confirmed gone",
+		})
+		require.NoError(t, err)
+		f.put("sheet-bucket", "trash/dropbox_sheetmusic/"+slugify(name)+".json", string(b), time.Now())
+	}
+	seed("Old Tune", 8*24*time.Hour)
+	seed("Recent Tune", 2*24*time.Hour)
+
+	n, err := PurgeSheetMusicTrash(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []string{"trash/dropbox_sheetmusic/recent_tune.json"}, f.keys("sheet-bucket"))
+}
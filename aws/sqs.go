@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,58 +17,158 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var (
-	sqsClient       *sqs.Client
-	sqsPollInterval = 10 * time.Second
+const (
+	// sqsLongPollSeconds is the ReceiveMessage wait; 20s is the SQS maximum.
+	sqsLongPollSeconds = 20
+	// sqsMaxBatch is the most messages SQS returns or deletes per call.
+	sqsMaxBatch = 10
 )
 
-func StartSQSPoller() {
-	go func() {
-		for {
-			msgs, err := receiveSQSMessages(webCfg.C.AudioSQSURL)
-			if err != nil {
-				log.Error().Msgf("Failed to receive SQS messages: %v", err)
-				time.Sleep(sqsPollInterval)
-				continue
-			}
+// sqsRetryInterval is how long the poller backs off after a failed receive.
+var sqsRetryInterval = 10 * time.Second
 
-			if len(msgs) == 0 {
-				time.Sleep(sqsPollInterval)
-				continue
-			}
+// RunSQSPoller long-polls the audio queue for S3 change notifications and
+// refreshes the matching cache until ctx is cancelled. Only messages that
+// were acted on are deleted; anything unparseable, unrelated or whose refresh
+// failed is left on the queue, so it becomes visible again after the
+// visibility timeout and is retried, and the queue's redrive policy can move
+// it to a dead-letter queue for inspection.
+func RunSQSPoller(ctx context.Context) {
+	client, err := newSQSClientFromConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create SQS client; not polling for S3 events")
+		return
+	}
+	runSQSPoller(ctx, client, webCfg.C.AudioSQSURL)
+}
 
-			for _, msg := range msgs {
-				handled := handleSQSEvent(msg)
-				if handled {
-					deleteSQSMessage(webCfg.C.AudioSQSURL, *msg.ReceiptHandle)
-				} else {
-					log.Info().Msg("SQS message on queue not related to audio, deleting it")
-					deleteSQSMessage(webCfg.C.AudioSQSURL, *msg.ReceiptHandle)
-				}
-			}
+func runSQSPoller(ctx context.Context, client *sqs.Client, queueURL string) {
+	for ctx.Err() == nil {
+		err := pollSQSOnce(ctx, client, queueURL)
+		if err == nil || ctx.Err() != nil {
+			continue
 		}
-	}()
+		log.Error().Msgf("Failed to receive SQS messages: %v", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(sqsRetryInterval):
+		}
+	}
+	log.Info().Msg("SQS poller stopped")
 }
 
-func receiveSQSMessages(queueURL string) ([]types.Message, error) {
-	if sqsClient == nil {
-		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(webCfg.C.AudioS3Region))
-		if err != nil {
-			return nil, err
-		}
-		sqsClient = sqs.NewFromConfig(cfg)
+func newSQSClientFromConfig() (*sqs.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(webCfg.C.AudioS3Region))
+	if err != nil {
+		return nil, err
 	}
+	return newSQSClient(cfg, webCfg.C.SQSEndpointURL), nil
+}
 
-	resp, err := sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(queueURL),
-		MaxNumberOfMessages: 5,
-		WaitTimeSeconds:     0,
+// newSQSClient builds an SQS client, pointing it at endpoint instead of AWS
+// when set (e.g. a local SQS-compatible server).
+func newSQSClient(cfg aws.Config, endpoint string) *sqs.Client {
+	return sqs.NewFromConfig(cfg, func(o *sqs.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
 	})
+}
+
+// sqsMaxMessages reads SQS_MAX_MESSAGES, clamped to what SQS allows.
+func sqsMaxMessages() int32 {
+	n := webCfg.C.SQSMaxMessages
+	if n <= 0 || n > sqsMaxBatch {
+		n = sqsMaxBatch
+	}
+	return int32(n)
+}
+
+// pollSQSOnce receives one batch from queueURL (waiting up to
+// sqsLongPollSeconds for it), refreshes the caches its messages touch and
+// deletes the messages whose refreshes succeeded in a single batch call.
+func pollSQSOnce(ctx context.Context, client *sqs.Client, queueURL string) error {
+	input := &sqs.ReceiveMessageInput{
+		QueueUrl:                    aws.String(queueURL),
+		MaxNumberOfMessages:         sqsMaxMessages(),
+		WaitTimeSeconds:             sqsLongPollSeconds,
+		MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameApproximateReceiveCount},
+	}
+	if v := webCfg.C.SQSVisibilityTimeout; v > 0 {
+		input.VisibilityTimeout = int32(v)
+	}
+	resp, err := client.ReceiveMessage(ctx, input)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	var parsed []types.Message
+	var msgKinds []map[contentKind]bool
+	affected := map[contentKind]bool{}
+	for _, msg := range resp.Messages {
+		kinds, ok := handleSQSEvent(msg)
+		if ok {
+			parsed = append(parsed, msg)
+			msgKinds = append(msgKinds, kinds)
+			for kind := range kinds {
+				affected[kind] = true
+			}
+			continue
+		}
+		logLeftOnQueue(msg)
+	}
+	// one refresh per content type, however many records in the batch touched it
+	failed := map[contentKind]bool{}
+	for _, kind := range contentKinds {
+		if !affected[kind] {
+			continue
+		}
+		if err := refreshContent(ctx, kind); err != nil {
+			log.Error().Err(err).Msgf("Failed to refresh %s cache after S3 event", kind)
+			failed[kind] = true
+		}
+	}
+	// a message is only done once every cache it touched has refreshed;
+	// otherwise it comes back after the visibility timeout and is retried
+	var handled []types.Message
+	for i, msg := range parsed {
+		ok := true
+		for kind := range msgKinds[i] {
+			ok = ok && !failed[kind]
+		}
+		if ok {
+			handled = append(handled, msg)
+		} else {
+			logLeftOnQueue(msg)
+		}
 	}
+	deleteSQSMessages(ctx, client, queueURL, handled)
+	return nil
+}
+
+// contentKind names a cached content type that S3 events can invalidate.
+type contentKind string
 
-	return resp.Messages, nil
+const (
+	contentAudio      contentKind = "audio"
+	contentSheetMusic contentKind = "sheet music"
+	contentShows      contentKind = "shows"
+)
+
+var contentKinds = []contentKind{contentAudio, contentSheetMusic, contentShows}
+
+// refreshContent reloads kind's cache, returning once it has finished. It
+// runs on the poller's goroutine under its ctx, so shutdown waits for it.
+var refreshContent = func(ctx context.Context, kind contentKind) error {
+	switch kind {
+	case contentAudio:
+		return audioCache.Refresh(ctx)
+	case contentSheetMusic:
+		return sheetCache.Refresh(ctx)
+	case contentShows:
+		return showsCache.Refresh(ctx)
+	}
+	return nil
 }
 
 type S3Event struct {
@@ -79,44 +180,101 @@ type S3Event struct {
 			} `json:"object"`
 		} `json:"s3"`
 	} `json:"Records"`
+	// Event is set instead of Records on the s3:TestEvent S3 sends when a
+	// notification configuration is created.
+	Event string `json:"Event"`
 }
 
-func handleSQSEvent(msg types.Message) bool {
-	var payload S3Event
+// snsEnvelope is the wrapper SNS puts around a message it fans out to SQS
+// (without raw message delivery).
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
 
-	if err := json.Unmarshal([]byte(*msg.Body), &payload); err != nil {
+// handleSQSEvent works out which content types an S3 notification affects,
+// looking at every record. ok is false for messages this poller doesn't
+// understand or that touch nothing it caches; those should stay on the queue.
+func handleSQSEvent(msg types.Message) (kinds map[contentKind]bool, ok bool) {
+	body := aws.ToString(msg.Body)
+
+	var envelope snsEnvelope
+	if err := json.Unmarshal([]byte(body), &envelope); err == nil && envelope.Type == "Notification" {
+		body = envelope.Message
+	}
+
+	var payload S3Event
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
 		log.Error().Msgf("Invalid SQS message format: %v", err)
-		return false
+		return nil, false
+	}
+
+	if payload.Event == "s3:TestEvent" {
+		log.Info().Msg("Received S3 test event, nothing to refresh")
+		return nil, true
 	}
 
+	kinds = map[contentKind]bool{}
 	for _, record := range payload.Records {
 		key, _ := url.QueryUnescape(record.S3.Object.Key)
-		switch {
-		case strings.HasPrefix(key, webCfg.C.AudioS3BucketPrefix):
-			log.Info().Msgf("Detected audiodata S3 event %s for %s — updating cache", record.EventName, record.S3.Object.Key)
-			go UpdateAudioCache()
-			return true
-		case strings.HasPrefix(key, webCfg.C.SheetMusicS3BucketPrefix):
-			log.Info().Msgf("Detected sheetmusic S3 event %s for %s — updating cache", record.EventName, record.S3.Object.Key)
-			go UpdateSheetMusicCache()
-			return true
-		case strings.HasPrefix(key, webCfg.C.ShowsS3BucketPrefix):
-			log.Info().Msgf("Detected shows S3 event %s for %s — updating cache", record.EventName, record.S3.Object.Key)
-			go UpdateShowsCache()
-			return true
+		kind, found := contentKindForKey(key)
+		if !found {
+			continue
+		}
+		if !kinds[kind] {
+			log.Info().Msgf("Detected %s S3 event %s for %s — updating cache", kind, record.EventName, record.S3.Object.Key)
 		}
+		kinds[kind] = true
 	}
 
-	log.Debug().Msg("SQS message not relevant to audio or sheetmusic, ignoring.")
-	return false
+	if len(kinds) == 0 {
+		log.Debug().Msg("SQS message not relevant to audio, sheet music or shows, ignoring.")
+		return nil, false
+	}
+	return kinds, true
 }
 
-func deleteSQSMessage(queueURL, receiptHandle string) {
-	_, err := sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(queueURL),
-		ReceiptHandle: aws.String(receiptHandle),
-	})
-	if err != nil {
-		log.Error().Msgf("Failed to delete SQS message: %v", err)
+func contentKindForKey(key string) (contentKind, bool) {
+	switch {
+	case strings.HasPrefix(key, webCfg.C.AudioS3BucketPrefix):
+		return contentAudio, true
+	case strings.HasPrefix(key, webCfg.C.SheetMusicS3BucketPrefix):
+		return contentSheetMusic, true
+	case strings.HasPrefix(key, webCfg.C.ShowsS3BucketPrefix):
+		return contentShows, true
+	}
+	return "", false
+}
+
+// logLeftOnQueue notes a message that isn't deleted, so it will be received
+// again (or, after enough receives, moved to the dead-letter queue).
+func logLeftOnQueue(msg types.Message) {
+	log.Warn().Msgf("Leaving SQS message %s on the queue for redrive (receive count %s)",
+		aws.ToString(msg.MessageId), msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+}
+
+// deleteSQSMessages removes msgs from the queue in batches of sqsMaxBatch.
+// Entries SQS fails to delete are logged; they'll be received again.
+func deleteSQSMessages(ctx context.Context, client *sqs.Client, queueURL string, msgs []types.Message) {
+	for start := 0; start < len(msgs); start += sqsMaxBatch {
+		batch := msgs[start:min(start+sqsMaxBatch, len(msgs))]
+		entries := make([]types.DeleteMessageBatchRequestEntry, len(batch))
+		for i, msg := range batch {
+			entries[i] = types.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: msg.ReceiptHandle,
+			}
+		}
+		resp, err := client.DeleteMessageBatch(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: aws.String(queueURL),
+			Entries:  entries,
+		})
+		if err != nil {
+			log.Error().Msgf("Failed to delete SQS messages: %v", err)
+			continue
+		}
+		for _, f := range resp.Failed {
+			log.Error().Msgf("Failed to delete SQS message %s: %s %s", aws.ToString(f.Id), aws.ToString(f.Code), aws.ToString(f.Message))
+		}
 	}
 }
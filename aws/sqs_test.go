@@ -0,0 +1,223 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/stretchr/testify/require"
+)
+
+// stubRefreshContent records refreshContent calls instead of refreshing,
+// failing the refreshes of the kinds in fail.
+func stubRefreshContent(t *testing.T, fail ...contentKind) *[]contentKind {
+	t.Helper()
+	var mu sync.Mutex
+	var got []contentKind
+	prev := refreshContent
+	refreshContent = func(ctx context.Context, kind contentKind) error {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, kind)
+		if slices.Contains(fail, kind) {
+			return errors.New("s3 unavailable")
+		}
+		return nil
+	}
+	t.Cleanup(func() { refreshContent = prev })
+	return &got
+}
+
+func TestPollSQSOnce(t *testing.T) {
+	newFakeS3(t)
+	refreshed := stubRefreshContent(t)
+	q, client := newFakeSQS(t)
+	webCfg.C.SQSMaxMessages = 0
+	webCfg.C.SQSVisibilityTimeout = 45
+
+	const (
+		audioEvent     = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"audio/grey_eagle.wav"}}}]}`
+		unrelatedEvent = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"elsewhere/file.txt"}}}]}`
+		garbage        = `not json`
+	)
+	q.send(audioEvent)
+	q.send(unrelatedEvent)
+	q.send(garbage)
+
+	require.NoError(t, pollSQSOnce(context.Background(), client, "https://sqs.example/queue"))
+
+	// long polling with the full batch size and the configured visibility
+	require.Equal(t, fakeReceiveInput{
+		QueueUrl:            "https://sqs.example/queue",
+		MaxNumberOfMessages: 10,
+		WaitTimeSeconds:     20,
+		VisibilityTimeout:   45,
+	}, q.lastReceive)
+
+	// only the handled message is deleted, in one batch call
+	require.Equal(t, []string{unrelatedEvent, garbage}, q.bodies())
+	require.Equal(t, 1, q.calls["DeleteMessageBatch"])
+	require.Zero(t, q.calls["DeleteMessage"])
+
+	// the rest stay hidden until their visibility timeout, then come back
+	// (eventually the redrive policy moves them to the dead-letter queue)
+	require.NoError(t, pollSQSOnce(context.Background(), client, "https://sqs.example/queue"))
+	require.Equal(t, 1, q.calls["DeleteMessageBatch"])
+	q.expireVisibility()
+	require.NoError(t, pollSQSOnce(context.Background(), client, "https://sqs.example/queue"))
+	require.Equal(t, []string{unrelatedEvent, garbage}, q.bodies())
+	require.Equal(t, 2, q.messages[0].receiveCount)
+
+	require.Equal(t, []contentKind{contentAudio}, *refreshed)
+}
+
+func TestPollSQSOnceRefreshesEachContentTypeOnce(t *testing.T) {
+	newFakeS3(t)
+	refreshed := stubRefreshContent(t)
+	q, client := newFakeSQS(t)
+	q.send(`{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"audio/a.wav"}}},
+		{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"shows/jam.json"}}}]}`)
+	q.send(`{"Records":[{"eventName":"ObjectRemoved:Delete","s3":{"object":{"key":"audio/b.wav"}}}]}`)
+
+	require.NoError(t, pollSQSOnce(context.Background(), client, "q"))
+	require.Equal(t, []contentKind{contentAudio, contentShows}, *refreshed)
+	require.Empty(t, q.bodies())
+}
+
+func TestPollSQSOnceKeepsMessagesWhoseRefreshFailed(t *testing.T) {
+	newFakeS3(t)
+	refreshed := stubRefreshContent(t, contentShows)
+	q, client := newFakeSQS(t)
+	const (
+		audioOnly     = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"audio/a.wav"}}}]}`
+		audioAndShows = `{"Records":[
+			{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"audio/b.wav"}}},
+			{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"shows/jam.json"}}}]}`
+		testEvent = `{"Service":"Amazon S3","Event":"s3:TestEvent"}`
+	)
+	q.send(audioOnly)
+	q.send(audioAndShows)
+	q.send(testEvent)
+
+	require.NoError(t, pollSQSOnce(context.Background(), client, "q"))
+	require.Equal(t, []contentKind{contentAudio, contentShows}, *refreshed, "refreshes run before anything is deleted")
+	require.Equal(t, []string{audioAndShows}, q.bodies(), "the shows refresh failed, so that event is retried")
+
+	q.expireVisibility()
+	*refreshed = nil
+	require.NoError(t, pollSQSOnce(context.Background(), client, "q"))
+	require.Equal(t, []contentKind{contentAudio, contentShows}, *refreshed)
+	require.Equal(t, 2, q.messages[0].receiveCount)
+}
+
+func TestPollSQSOnceRefreshesUnderItsContext(t *testing.T) {
+	newFakeS3(t)
+	q, client := newFakeSQS(t)
+	const audioEvent = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"audio/a.wav"}}}]}`
+	q.send(audioEvent)
+
+	// shutdown arriving mid-refresh cancels it, and the event stays queued
+	ctx, cancel := context.WithCancel(context.Background())
+	prev := refreshContent
+	refreshContent = func(ctx context.Context, kind contentKind) error {
+		cancel()
+		return ctx.Err()
+	}
+	t.Cleanup(func() { refreshContent = prev })
+
+	require.NoError(t, pollSQSOnce(ctx, client, "q"))
+	require.Equal(t, []string{audioEvent}, q.bodies())
+	require.Zero(t, q.calls["DeleteMessageBatch"])
+}
+
+func TestHandleSQSEvent(t *testing.T) {
+	newFakeS3(t)
+	snsWrap := func(inner string) string {
+		b, err := json.Marshal(map[string]string{"Type": "Notification", "TopicArn": "arn:aws:sns:us-east-2:1:site", "Message": inner})
+		require.NoError(t, err)
+		return string(b)
+	}
+	record := func(key string) string {
+		return `{"eventName":"ObjectCreated:Put","s3":{"object":{"key":"` + key + `"}}}`
+	}
+	const testEvent = `{"Service":"Amazon S3","Event":"s3:TestEvent","Time":"2024-01-01T00:00:00.000Z","Bucket":"audio-bucket"}`
+
+	tests := []struct {
+		name      string
+		body      string
+		wantOK    bool
+		wantKinds []contentKind
+	}{
+		{"single audio record", `{"Records":[` + record("audio/a.wav") + `]}`, true, []contentKind{contentAudio}},
+		{"every record counts, not just the first match",
+			`{"Records":[` + record("audio/a.wav") + `,` + record("dropbox_sheetmusic/x.json") + `,` + record("shows/s.json") + `]}`,
+			true, []contentKind{contentAudio, contentSheetMusic, contentShows}},
+		{"duplicates collapse", `{"Records":[` + record("shows/a.json") + `,` + record("shows/b.json") + `]}`, true, []contentKind{contentShows}},
+		{"unrelated records are skipped", `{"Records":[` + record("other/a") + `,` + record("shows/b.json") + `]}`, true, []contentKind{contentShows}},
+		{"url-encoded keys", `{"Records":[` + record("audio%2Fgrey+eagle.wav") + `]}`, true, []contentKind{contentAudio}},
+		{"s3 test event is handled with nothing to refresh", testEvent, true, nil},
+		{"sns-wrapped records", snsWrap(`{"Records":[` + record("dropbox_sheetmusic/x.json") + `]}`), true, []contentKind{contentSheetMusic}},
+		{"sns-wrapped test event", snsWrap(testEvent), true, nil},
+		{"nothing relevant", `{"Records":[` + record("other/a") + `]}`, false, nil},
+		{"not json", `hello`, false, nil},
+		{"sns-wrapped garbage", snsWrap(`hello`), false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kinds, ok := handleSQSEvent(types.Message{Body: aws.String(tt.body)})
+			require.Equal(t, tt.wantOK, ok)
+			var got []contentKind
+			for _, kind := range contentKinds {
+				if kinds[kind] {
+					got = append(got, kind)
+				}
+			}
+			require.Equal(t, tt.wantKinds, got)
+		})
+	}
+}
+
+func TestPollSQSOnceHonorsMaxMessages(t *testing.T) {
+	q, client := newFakeSQS(t)
+	prev := webCfg.C
+	t.Cleanup(func() { webCfg.C = prev })
+	webCfg.C.SQSMaxMessages = 2
+	for i := 0; i < 3; i++ {
+		q.send(`not json`)
+	}
+
+	require.NoError(t, pollSQSOnce(context.Background(), client, "q"))
+	require.Equal(t, 2, q.lastReceive.MaxNumberOfMessages)
+	require.Zero(t, q.calls["DeleteMessageBatch"], "nothing handled, nothing deleted")
+}
+
+func TestRunSQSPollerStopsOnCancel(t *testing.T) {
+	q, client := newFakeSQS(t)
+	stubRefreshContent(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runSQSPoller(ctx, client, "q")
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.calls["ReceiveMessage"] > 0
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poller did not stop after cancel")
+	}
+}
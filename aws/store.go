@@ -0,0 +1,131 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	webCfg "github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// StorageBackendS3 stores content in the configured S3 buckets (the default).
+	StorageBackendS3 = "s3"
+	// StorageBackendLocal stores content in a directory on disk, one
+	// subdirectory per bucket, so the site and CLI can run fully offline.
+	StorageBackendLocal = "local"
+)
+
+// Store is the object storage backend the audio, sheet music and shows code
+// reads and writes through.
+type Store interface {
+	// ListPage returns one page of the objects in bucket whose keys start
+	// with prefix, in key order. token is "" for the first page and the
+	// previous page's NextToken afterwards. Use listAllObjects to get them all.
+	ListPage(ctx context.Context, bucket, prefix, token string) (ObjectPage, error)
+	// Get returns the full contents of an object and its ETag. It returns
+	// ErrNotFound if the key doesn't exist.
+	Get(ctx context.Context, bucket, key string) ([]byte, string, error)
+	// Put creates or overwrites an object. A conditional put (see PutOptions)
+	// that loses a race returns ErrPreconditionFailed.
+	Put(ctx context.Context, bucket, key string, body io.Reader, opts PutOptions) error
+	// Delete removes an object. Deleting a key that doesn't exist is not an error.
+	Delete(ctx context.Context, bucket, key string) error
+	// PresignGet returns a URL a browser can use to fetch the object until expiry.
+	PresignGet(ctx context.Context, bucket, key string, expiry time.Duration) (string, error)
+}
+
+// ObjectInfo is the listing metadata for a single stored object.
+type ObjectInfo struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// ObjectPage is a single page of a listing. NextToken is "" on the last page.
+type ObjectPage struct {
+	Objects   []ObjectInfo
+	NextToken string
+}
+
+// PutOptions controls how an object is written.
+type PutOptions struct {
+	ContentType string
+	// PublicRead makes the object readable without credentials (S3 canned ACL).
+	PublicRead bool
+	// IfMatch only writes if the stored object's ETag still equals this value.
+	IfMatch string
+	// IfNoneMatch set to "*" only writes if the key doesn't exist yet.
+	IfNoneMatch string
+}
+
+var (
+	// ErrNotFound is returned by Store.Get for a key that doesn't exist.
+	ErrNotFound = errors.New("object not found")
+	// ErrPreconditionFailed is returned by a conditional Store.Put whose
+	// condition no longer holds, i.e. someone else wrote the object first.
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+var (
+	store   Store
+	storeMu sync.Mutex
+)
+
+// getStore returns the package's Store, building it from config on first use.
+func getStore() Store {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store == nil {
+		store = newStoreFromConfig()
+	}
+	return store
+}
+
+// SetStore overrides the Store used by the package, e.g. to point tests at an
+// in-memory or on-disk backend.
+func SetStore(s Store) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
+}
+
+func newStoreFromConfig() Store {
+	switch strings.ToLower(strings.TrimSpace(webCfg.C.StorageBackend)) {
+	case StorageBackendLocal:
+		log.Info().Msgf("storage: using local directory %s", webCfg.C.LocalStorageDir)
+		return NewLocalStore(webCfg.C.LocalStorageDir, LocalStorageURLPrefix)
+	case "", StorageBackendS3:
+		return NewS3Store(initS3Session())
+	default:
+		log.Warn().Msgf("storage: unknown STORAGE_BACKEND %q, falling back to s3", webCfg.C.StorageBackend)
+		return NewS3Store(initS3Session())
+	}
+}
+
+// listAllObjects follows ListPage continuation tokens until every object in
+// bucket under prefix has been listed. A single page tops out at 1000 objects
+// on S3, so callers must never assume one call is enough.
+func listAllObjects(ctx context.Context, st Store, bucket, prefix string) ([]ObjectInfo, error) {
+	var objs []ObjectInfo
+	token := ""
+	for {
+		page, err := st.ListPage(ctx, bucket, prefix, token)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, page.Objects...)
+		if page.NextToken == "" {
+			return objs, nil
+		}
+		if page.NextToken == token {
+			return nil, fmt.Errorf("listing s3://%s/%s: continuation token did not advance", bucket, prefix)
+		}
+		token = page.NextToken
+	}
+}
@@ -0,0 +1,129 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pagedStore is a Store whose ListPage serves a fixed set of keys pageSize at
+// a time, using the page index as the continuation token.
+type pagedStore struct {
+	Store
+	keys     []string
+	pageSize int
+	calls    int
+}
+
+func (p *pagedStore) ListPage(ctx context.Context, bucket, prefix, token string) (ObjectPage, error) {
+	p.calls++
+	start := 0
+	if token != "" {
+		start, _ = strconv.Atoi(token)
+	}
+	end := min(start+p.pageSize, len(p.keys))
+	page := ObjectPage{}
+	for _, k := range p.keys[start:end] {
+		page.Objects = append(page.Objects, ObjectInfo{Key: k})
+	}
+	if end < len(p.keys) {
+		page.NextToken = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+func TestListAllObjectsFollowsPages(t *testing.T) {
+	tests := []struct {
+		name      string
+		keys      int
+		pageSize  int
+		wantCalls int
+	}{
+		{"empty", 0, 3, 1},
+		{"single partial page", 2, 3, 1},
+		{"exactly one page", 3, 3, 1},
+		{"several pages", 10, 3, 4},
+		{"past the S3 limit", 2500, 1000, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := &pagedStore{pageSize: tt.pageSize}
+			for i := 0; i < tt.keys; i++ {
+				st.keys = append(st.keys, fmt.Sprintf("k%05d", i))
+			}
+			objs, err := listAllObjects(context.Background(), st, "b", "")
+			require.NoError(t, err)
+			require.Len(t, objs, tt.keys)
+			require.Equal(t, tt.wantCalls, st.calls)
+		})
+	}
+}
+
+// stuckStore always hands back the same continuation token.
+type stuckStore struct{ Store }
+
+func (stuckStore) ListPage(ctx context.Context, bucket, prefix, token string) (ObjectPage, error) {
+	return ObjectPage{Objects: []ObjectInfo{{Key: "k"}}, NextToken: "same"}, nil
+}
+
+func TestListAllObjectsStopsOnStuckToken(t *testing.T) {
+	_, err := listAllObjects(context.Background(), stuckStore{}, "b", "")
+	require.Error(t, err)
+}
+
+func TestListingCallersPaginate(t *testing.T) {
+	f := newFakeS3(t)
+	f.maxKeys = 2
+	const n = 5
+	now := time.Now()
+	future := now.AddDate(0, 0, 7).Format("2006-01-02")
+	for i := 0; i < n; i++ {
+		f.put("audio-bucket", fmt.Sprintf("audio/tune_%d.wav", i), "RIFF", now)
+		f.put("sheet-bucket", fmt.Sprintf("dropbox_sheetmusic/tune_%d.json", i), fmt.Sprintf(`{"display_name":"Tune %d"}`, i), now)
+		f.put("shows-bucket", fmt.Sprintf("shows/show_%d.json", i), fmt.Sprintf(`{"title":"Show %d","date":"%s"}`, i, future), now)
+	}
+
+	songs, err := GetAudioFromS3()
+	require.NoError(t, err)
+	require.Len(t, songs, n)
+
+	keys, err := GetAudioKeysFromS3()
+	require.NoError(t, err)
+	require.Len(t, keys, n)
+
+	sheets, err := ListSheetMusicFromS3()
+	require.NoError(t, err)
+	require.Len(t, sheets, n)
+
+	shows, err := ListShowsFromS3()
+	require.NoError(t, err)
+	require.Len(t, shows, n)
+
+	showObjs, err := ListShowObjects()
+	require.NoError(t, err)
+	require.Len(t, showObjs, n)
+
+	// 3 pages per listing across 5 listings
+	require.Equal(t, 15, f.listCalls)
+}
+
+func TestLocalStoreListPages(t *testing.T) {
+	ctx := context.Background()
+	st := NewLocalStore(t.TempDir(), LocalStorageURLPrefix)
+	for i := 0; i < localListPageSize+5; i++ {
+		require.NoError(t, st.Put(ctx, "b", fmt.Sprintf("p/%05d", i), strings.NewReader(""), PutOptions{}))
+	}
+	page, err := st.ListPage(ctx, "b", "p/", "")
+	require.NoError(t, err)
+	require.Len(t, page.Objects, localListPageSize)
+	require.NotEmpty(t, page.NextToken)
+
+	objs, err := listAllObjects(ctx, st, "b", "p/")
+	require.NoError(t, err)
+	require.Len(t, objs, localListPageSize+5)
+}
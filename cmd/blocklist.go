@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/server/traffic"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	blockThreatFlag int
+	blockSourceFlag string
+)
+
+var blocklistCmd = &cobra.Command{
+	Use:   "blocklist",
+	Short: "Manage the IP blocklist (bad_ips) in the traffic database",
+	Long: `Entries are single IPs or CIDR ranges. A running server picks up changes
+within a minute.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := traffic.InitDB(config.C.TrafficDBPath); err != nil {
+			log.Fatal().Err(err).Msg("failed to open traffic database")
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		_ = traffic.Close()
+	},
+}
+
+var blocklistAddCmd = &cobra.Command{
+	Use:   "add <ip-or-cidr>...",
+	Short: "Block IPs or CIDR ranges",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, arg := range args {
+			entry, err := traffic.AddBlock(arg, traffic.BlockSourceManual, blockThreatFlag)
+			if err != nil {
+				log.Fatal().Err(err).Msgf("blocklist add %s failed", arg)
+			}
+			fmt.Printf("blocked %s\n", entry)
+		}
+	},
+}
+
+var blocklistRemoveCmd = &cobra.Command{
+	Use:   "remove <ip-or-cidr>...",
+	Short: "Unblock IPs or CIDR ranges",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, arg := range args {
+			removed, err := traffic.RemoveBlock(arg)
+			if err != nil {
+				log.Fatal().Err(err).Msgf("blocklist remove %s failed", arg)
+			}
+			if removed {
+				fmt.Printf("unblocked %s\n", arg)
+			} else {
+				fmt.Printf("%s was not blocked\n", arg)
+			}
+		}
+	},
+}
+
+var blocklistListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List blocked IPs and CIDR ranges",
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := traffic.ListBlocks()
+		if err != nil {
+			log.Fatal().Err(err).Msg("blocklist list failed")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "IP\tSOURCE\tTHREAT\tADDED\tEXPIRES")
+		for _, e := range entries {
+			expires := "never"
+			if !e.ExpiresAt.IsZero() {
+				expires = e.ExpiresAt.Local().Format(time.DateTime)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", e.IP, e.Source, e.ThreatLevel, e.AddedAt.Local().Format(time.DateTime), expires)
+		}
+		w.Flush()
+		fmt.Printf("%d entries\n", len(entries))
+	},
+}
+
+var blocklistImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import a plain-text or FireHOL (.ipset/.netset) list",
+	Long: `Reads one IP or CIDR per line, ignoring blank lines and # or ; comments.
+Entries are recorded under --source (default "import:<file name>"); importing
+the same source again replaces its previous entries, so addresses dropped from
+the list are unblocked.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal().Err(err).Msg("blocklist import failed")
+		}
+		defer f.Close()
+		source := strings.TrimSpace(blockSourceFlag)
+		if source == "" {
+			source = "import:" + filepath.Base(args[0])
+		}
+		res, err := traffic.ImportBlocklist(f, source, blockThreatFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("blocklist import failed")
+		}
+		for _, bad := range res.Invalid {
+			log.Warn().Msgf("skipped invalid entry %q", bad)
+		}
+		fmt.Printf("%s: %d entries imported, %d no longer listed, %d invalid lines skipped\n", source, res.Imported, res.Removed, len(res.Invalid))
+	},
+}
+
+func init() {
+	blocklistAddCmd.Flags().IntVarP(&blockThreatFlag, "threat", "t", 1, "Threat level to record")
+	blocklistImportCmd.Flags().IntVarP(&blockThreatFlag, "threat", "t", 1, "Threat level to record")
+	blocklistImportCmd.Flags().StringVarP(&blockSourceFlag, "source", "s", "", "Source name to record the entries under")
+	blocklistCmd.AddCommand(blocklistAddCmd, blocklistRemoveCmd, blocklistListCmd, blocklistImportCmd)
+	rootCmd.AddCommand(blocklistCmd)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/server/traffic"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Inspect and apply traffic database schema migrations",
+	Long: `Migrations are numbered SQL files built into the binary. The server applies
+any pending ones at startup; these commands let you check or apply them first.`,
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		_ = traffic.Close()
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List migrations and whether each has been applied",
+	Long: `Opens the database read-only and changes nothing. A database from before
+versioned migrations shows the ones its PRAGMA user_version implies as
+"unversioned"; migrate up (or starting the server) records them.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if err := traffic.OpenReadOnly(config.C.TrafficDBPath); err != nil {
+			log.Fatal().Err(err).Msg("failed to open traffic database")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		statuses, err := traffic.MigrationStatuses()
+		if err != nil {
+			log.Fatal().Err(err).Msg("migrate status failed")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		pending := 0
+		for _, s := range statuses {
+			applied := "pending"
+			switch {
+			case s.LegacyUserVersion > 0:
+				applied = fmt.Sprintf("unversioned (user_version %d)", s.LegacyUserVersion)
+			case s.Applied():
+				applied = s.AppliedAt.Local().Format(time.DateTime)
+			default:
+				pending++
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		w.Flush()
+		fmt.Printf("%d migrations, %d pending\n", len(statuses), pending)
+	},
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if err := traffic.Open(config.C.TrafficDBPath); err != nil {
+			log.Fatal().Err(err).Msg("failed to open traffic database")
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		applied, err := traffic.Migrate()
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("migrate up failed")
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+	},
+}
+
+func init() {
+	migrateCmd.AddCommand(migrateStatusCmd, migrateUpCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/andrewwillette/andrewwillettedotcom/aws"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var rebuildSheetIndexCmd = &cobra.Command{
+	Use:   "rebuild-sheet-index",
+	Short: "Regenerate the sheet music index.json manifest from the per-entry JSON objects in S3",
+	Long: `Reads every sheet music entry object and writes them all to a single index.json
+manifest, creating it if it doesn't exist. Once the manifest exists the site lists
+sheet music with one GET, and upload/delete commands keep it up to date.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := aws.RebuildSheetMusicIndex()
+		if err != nil {
+			log.Fatal().Err(err).Msg("rebuild-sheet-index failed")
+		}
+		log.Info().Msgf("Sheet music index rebuilt with %d entries", n)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rebuildSheetIndexCmd)
+}
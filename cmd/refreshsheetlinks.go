@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/andrewwillette/andrewwillettedotcom/aws"
+	"github.com/andrewwillette/andrewwillettedotcom/dropbox"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	linkRefreshDryRunFlag bool
+	linkRefreshJSONFlag   bool
+)
+
+var refreshSheetLinksCmd = &cobra.Command{
+	Use:   "refresh-sheet-links",
+	Short: "Run the sheet music link refresh job once and print what it did",
+	Long: `Checks every sheet music entry against Dropbox: refreshes stale shared links,
+backfills Dropbox file IDs for legacy entries and deletes entries whose file is
+confirmed gone. Use --dry-run to see what would change without touching S3 or
+Dropbox.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runRefreshSheetLinks(); err != nil {
+			log.Fatal().Err(err).Msg("refresh-sheet-links failed")
+		}
+	},
+}
+
+func init() {
+	refreshSheetLinksCmd.Flags().BoolVar(&linkRefreshDryRunFlag, "dry-run", false, "Report what would change without writing anything")
+	refreshSheetLinksCmd.Flags().BoolVar(&linkRefreshJSONFlag, "json", false, "Print the report as JSON")
+	rootCmd.AddCommand(refreshSheetLinksCmd)
+}
+
+func runRefreshSheetLinks() error {
+	dbx := dropbox.NewClientFromConfig()
+	if dbx == nil {
+		return fmt.Errorf("Dropbox API not configured (DROPBOX_REFRESH_TOKEN unset); run `dropbox-auth` first")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := aws.RefreshSheetMusicLinks(ctx, dbx, aws.LinkRefreshOptions{DryRun: linkRefreshDryRunFlag})
+	if linkRefreshJSONFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(report); encErr != nil {
+			return encErr
+		}
+		return err
+	}
+
+	for _, r := range report.Results {
+		line := fmt.Sprintf("%-20s %s", r.Outcome, r.Entry)
+		if r.NewURL != "" {
+			line += fmt.Sprintf("\n%20s %s -> %s", "", r.OldURL, r.NewURL)
+		}
+		if r.Detail != "" {
+			line += fmt.Sprintf("\n%20s %s", "", r.Detail)
+		}
+		fmt.Println(line)
+	}
+	outcomes := make([]string, 0, len(report.Counts))
+	for o := range report.Counts {
+		outcomes = append(outcomes, o)
+	}
+	sort.Strings(outcomes)
+	if report.DryRun {
+		fmt.Println("\ndry run, nothing was changed")
+	}
+	for _, o := range outcomes {
+		fmt.Printf("%s: %d\n", o, report.Counts[o])
+	}
+	return err
+}
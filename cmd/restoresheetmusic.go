@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/aws"
+	"github.com/andrewwillette/gofzf"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var restoreOverwriteFlag bool
+
+var restoreSheetMusicCmd = &cobra.Command{
+	Use:   "restore-sheet-music",
+	Short: "Restore a sheet music entry from the trash",
+	Long: `Lists sheet music entries the link refresh job moved to the trash (most recent
+first) and puts the selected one back on the site. Trashed entries are purged
+after SHEET_TRASH_RETENTION_DAYS (default 30).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := restoreSheetMusic(); err != nil {
+			log.Fatal().Err(err).Msg("restore-sheet-music failed")
+		}
+	},
+}
+
+func init() {
+	restoreSheetMusicCmd.Flags().BoolVarP(&restoreOverwriteFlag, "overwrite", "y", false, "Replace a live entry with the same key")
+	rootCmd.AddCommand(restoreSheetMusicCmd)
+}
+
+func restoreSheetMusic() error {
+	ctx := context.Background()
+	trashed, err := aws.ListTrashedSheetMusic(ctx)
+	if err != nil {
+		return err
+	}
+	if len(trashed) == 0 {
+		fmt.Println("The sheet music trash is empty.")
+		return nil
+	}
+	toselect := make([]string, len(trashed))
+	for i, t := range trashed {
+		toselect[i] = fmt.Sprintf("%s (deleted %s: %s)", t.Entry.DisplayName, t.DeletedAt.Local().Format(time.DateTime), t.Reason)
+	}
+	selected, err := gofzf.Select(toselect)
+	if err != nil {
+		return err
+	}
+	for i, label := range toselect {
+		if label != selected {
+			continue
+		}
+		restored, err := aws.RestoreSheetMusic(ctx, trashed[i].Key, restoreOverwriteFlag)
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("Restored %q to %s", restored.Entry.DisplayName, restored.OriginalKey)
+		return nil
+	}
+	return fmt.Errorf("no trashed entry selected")
+}
@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/andrewwillette/andrewwillettedotcom/server"
 	"github.com/rs/zerolog/log"
@@ -15,7 +18,11 @@ var serveCmd = &cobra.Command{
 		log.Info().Msg("starting andrewwillette.com server")
 		env := os.Getenv("ENV")
 		sslEnabled := env == "PROD"
-		server.StartServer(sslEnabled)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := server.StartServer(ctx, sslEnabled); err != nil {
+			log.Fatal().Err(err).Msg("server failed")
+		}
 	},
 }
 
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/server/traffic"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var trafficCmd = &cobra.Command{
+	Use:   "traffic",
+	Short: "Maintain the tracked requests in the traffic database",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := traffic.InitDB(config.C.TrafficDBPath); err != nil {
+			log.Fatal().Err(err).Msg("failed to open traffic database")
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		_ = traffic.Close()
+	},
+}
+
+var trafficAnonymizeCmd = &cobra.Command{
+	Use:   "anonymize",
+	Short: "Replace raw IPs in tracked requests with visitor hashes and truncated addresses",
+	Long: `Converts requests recorded before TRAFFIC_PRIVACY_MODE was turned on to the
+form privacy mode stores: a per-day visitor hash for counting unique visitors and
+the IP truncated to its /24 (IPv4) or /48 (IPv6) network. Days before yesterday
+are hashed with a salt that's discarded afterwards, so it can't be undone; today
+and yesterday share the salt new requests are hashed with, which is deleted in
+turn, so a visitor isn't counted twice. The security tables (suspicious
+requests, failed logins, bans) keep their raw IPs.
+
+Run it with the server stopped, or with privacy mode already on so new requests
+aren't recorded with raw IPs in the meantime.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !config.C.TrafficPrivacyMode {
+			log.Warn().Msg("TRAFFIC_PRIVACY_MODE is off: requests recorded from now on will still store raw IPs")
+		}
+		n, err := traffic.AnonymizeRequests()
+		if err != nil {
+			log.Fatal().Err(err).Msgf("traffic anonymize failed after %d requests", n)
+		}
+		fmt.Printf("%d requests anonymized\n", n)
+	},
+}
+
+var (
+	exportTableFlag  string
+	exportFormatFlag string
+	exportFromFlag   string
+	exportToFlag     string
+	exportOutputFlag string
+)
+
+var trafficExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export tracked requests, suspicious requests or failed logins as CSV or NDJSON",
+	Long: `Writes one table (requests, suspicious_requests or failed_auths) to --output, or
+stdout, oldest first. --from and --to take an RFC 3339 time or a YYYY-MM-DD date
+(midnight UTC); --to is exclusive, and either can be left out.
+
+To move the data to another host, export each table and run traffic import there.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, err := traffic.ParseExportFormat(exportFormatFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("traffic export failed")
+		}
+		from, err := parseExportTime(exportFromFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("traffic export: bad --from")
+		}
+		to, err := parseExportTime(exportToFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("traffic export: bad --to")
+		}
+		var w io.Writer = os.Stdout
+		if exportOutputFlag != "" && exportOutputFlag != "-" {
+			f, err := os.Create(exportOutputFlag)
+			if err != nil {
+				log.Fatal().Err(err).Msg("traffic export failed")
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := traffic.Export(w, exportTableFlag, format, from, to)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("traffic export failed after %d rows", n)
+		}
+		fmt.Fprintf(os.Stderr, "%d %s rows exported\n", n, exportTableFlag)
+	},
+}
+
+var trafficImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Import a table written by traffic export",
+	Long: `Loads a CSV or NDJSON file written by traffic export into --table, taking the
+format from the file extension (.csv, .ndjson or .jsonl) unless --format is set.
+Use - to read stdin.
+
+Rows get new IDs, so an old database's export can be merged into a live one.
+Rows already present (same timestamp, IP and path) are skipped, so re-running an
+import is harmless. The file is imported in one transaction: a bad row imports
+nothing.
+
+With TRAFFIC_PRIVACY_MODE on, imported requests are stored as privacy mode
+records them: IPs truncated to their /24 (IPv4) or /48 (IPv6) network, and rows
+without a visitor hash hashed per day the way traffic anonymize does. Suspicious requests and failed logins keep raw IPs.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		formatName := exportFormatFlag
+		if !cmd.Flags().Changed("format") {
+			formatName = strings.TrimPrefix(filepath.Ext(args[0]), ".")
+		}
+		format, err := traffic.ParseExportFormat(formatName)
+		if err != nil {
+			log.Fatal().Err(err).Msg("traffic import failed: set --format")
+		}
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				log.Fatal().Err(err).Msg("traffic import failed")
+			}
+			defer f.Close()
+			r = f
+		}
+		res, err := traffic.ImportTable(r, exportTableFlag, format)
+		if err != nil {
+			log.Fatal().Err(err).Msg("traffic import failed")
+		}
+		fmt.Printf("%s: %d rows imported, %d already present\n", exportTableFlag, res.Imported, res.Skipped)
+	},
+}
+
+// parseExportTime reads an RFC 3339 time or a YYYY-MM-DD date; "" is the zero
+// time.
+func parseExportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+func init() {
+	tables := strings.Join(traffic.ExportTables, ", ")
+	for _, c := range []*cobra.Command{trafficExportCmd, trafficImportCmd} {
+		c.Flags().StringVarP(&exportTableFlag, "table", "t", "requests", "Table to "+c.Name()+": "+tables)
+		c.Flags().StringVarP(&exportFormatFlag, "format", "f", "csv", "csv or ndjson")
+	}
+	trafficExportCmd.Flags().StringVar(&exportFromFlag, "from", "", "Only rows recorded at or after this time")
+	trafficExportCmd.Flags().StringVar(&exportToFlag, "to", "", "Only rows recorded before this time")
+	trafficExportCmd.Flags().StringVarP(&exportOutputFlag, "output", "o", "", "File to write (default stdout)")
+	trafficCmd.AddCommand(trafficAnonymizeCmd, trafficExportCmd, trafficImportCmd)
+	rootCmd.AddCommand(trafficCmd)
+}
@@ -51,6 +51,37 @@ type Config struct {
 	DropboxAppSecret         string `mapstructure:"DROPBOX_APP_SECRET"`
 	DropboxRefreshToken      string `mapstructure:"DROPBOX_REFRESH_TOKEN"`
 	DropboxSheetMusicFolder  string `mapstructure:"DROPBOX_SHEET_MUSIC_FOLDER"` // relative to the app's Dropbox access root; "" means that root itself
+	StorageBackend           string `mapstructure:"STORAGE_BACKEND"`            // "s3" (default) or "local"
+	LocalStorageDir          string `mapstructure:"LOCAL_STORAGE_DIR"`          // root directory for the "local" storage backend
+	S3EndpointURL            string `mapstructure:"S3_ENDPOINT_URL"`            // overrides the S3 endpoint (path-style), e.g. a local S3-compatible server
+	S3FetchConcurrency       int    `mapstructure:"S3_FETCH_CONCURRENCY"`       // max parallel object reads when listing sheet music/shows; default 8
+	S3FetchTimeoutSeconds    int    `mapstructure:"S3_FETCH_TIMEOUT_SECONDS"`   // per-object read timeout; default 10
+	CacheSnapshotPath        string `mapstructure:"CACHE_SNAPSHOT_PATH"`        // last-known-good content caches, restored at startup
+	SQSEndpointURL           string `mapstructure:"SQS_ENDPOINT_URL"`           // overrides the SQS endpoint, e.g. a local SQS-compatible server
+	SQSMaxMessages           int    `mapstructure:"SQS_MAX_MESSAGES"`           // messages per receive, 1-10; default 10
+	SQSVisibilityTimeout     int    `mapstructure:"SQS_VISIBILITY_TIMEOUT"`     // seconds a received message stays hidden; 0 uses the queue's setting
+	SheetTrashRetentionDays  int    `mapstructure:"SHEET_TRASH_RETENTION_DAYS"` // days trashed sheet music is kept before purging; default 30
+	NotifyWebhookURL         string `mapstructure:"NOTIFY_WEBHOOK_URL"`         // JSON POST target for change/failure digests
+	SMTPAddr                 string `mapstructure:"SMTP_ADDR"`                  // host:port of the mail server for email digests
+	SMTPUsername             string `mapstructure:"SMTP_USERNAME"`
+	SMTPPassword             string `mapstructure:"SMTP_PASSWORD"`
+	NotifyEmailFrom          string `mapstructure:"NOTIFY_EMAIL_FROM"`          // defaults to the first NOTIFY_EMAIL_TO address
+	NotifyEmailTo            string `mapstructure:"NOTIFY_EMAIL_TO"`            // comma-separated recipients; email is off when empty
+	AutobanSuspiciousLimit   int    `mapstructure:"AUTOBAN_SUSPICIOUS_LIMIT"`   // suspicious 404s per window that ban an IP; default 10, negative disables
+	AutobanFailedAuthLimit   int    `mapstructure:"AUTOBAN_FAILED_AUTH_LIMIT"`  // failed admin logins per window that ban an IP; default 5, negative disables
+	AutobanWindowMinutes     int    `mapstructure:"AUTOBAN_WINDOW_MINUTES"`     // default 10
+	AutobanDurationHours     int    `mapstructure:"AUTOBAN_DURATION_HOURS"`     // how long an automatic ban lasts; default 24
+	RetentionRequestsDays    int    `mapstructure:"RETENTION_REQUESTS_DAYS"`    // raw requests kept before rolling up into daily totals; default 30
+	RetentionSuspiciousDays  int    `mapstructure:"RETENTION_SUSPICIOUS_DAYS"`  // default 90
+	RetentionFailedAuthDays  int    `mapstructure:"RETENTION_FAILED_AUTH_DAYS"` // default 90
+	RetentionBanDays         int    `mapstructure:"RETENTION_BAN_DAYS"`         // ban decisions; default 365
+	RetentionRollupDays      int    `mapstructure:"RETENTION_ROLLUP_DAYS"`      // daily rollups; default forever
+	TrafficWriteBuffer       int    `mapstructure:"TRAFFIC_WRITE_BUFFER"`       // requests queued for writing before new ones are dropped; default 4096
+	TrafficBatchSize         int    `mapstructure:"TRAFFIC_BATCH_SIZE"`         // max requests per insert transaction; default 200
+	TrafficFlushMillis       int    `mapstructure:"TRAFFIC_FLUSH_MS"`           // max time a queued request waits to be written; default 500
+	TrafficUAPatternsFile    string `mapstructure:"TRAFFIC_UA_PATTERNS_FILE"`   // extra "<class> <pattern>" lines checked before the built-in list
+	TrafficPrivacyMode       bool   `mapstructure:"TRAFFIC_PRIVACY_MODE"`       // store hashed visitors and truncated IPs instead of raw IPs in requests
+	BotRequestsPerMinute     int    `mapstructure:"BOT_REQUESTS_PER_MINUTE"`    // requests/min from one IP with an unknown user agent that count as a crawler; default 120, negative disables
 }
 
 func LoadDefaultConfig(fallbackpath string) (config Config, err error) {
@@ -105,6 +136,21 @@ func LoadDefaultConfig(fallbackpath string) (config Config, err error) {
 		}
 	}
 
+	if config.CacheSnapshotPath == "" {
+		if envVal == "PROD" {
+			config.CacheSnapshotPath = "/app/cache-snapshot.json"
+		} else {
+			config.CacheSnapshotPath = "./cache-snapshot.json"
+		}
+	}
+
+	if config.StorageBackend == "" {
+		config.StorageBackend = "s3"
+	}
+	if config.LocalStorageDir == "" {
+		config.LocalStorageDir = "./localstorage"
+	}
+
 	log.Info().Msgf("config: AdminPassword set=%v", config.AdminPassword != "")
 
 	return config, nil
@@ -82,9 +82,9 @@ func (c *Client) ListFolder(ctx context.Context, folderPath string) ([]FileMetad
 	return files, nil
 }
 
-// GetOrCreateSharedLink returns the current shareable URL for a file, creating
-// one if it doesn't already have one.
-func (c *Client) GetOrCreateSharedLink(ctx context.Context, pathOrID string) (string, error) {
+// GetSharedLink returns the file's existing shareable URL, or "" if it has
+// none. Unlike GetOrCreateSharedLink it never changes anything in Dropbox.
+func (c *Client) GetSharedLink(ctx context.Context, pathOrID string) (string, error) {
 	var listResp struct {
 		Links []struct {
 			URL string `json:"url"`
@@ -99,11 +99,21 @@ func (c *Client) GetOrCreateSharedLink(ctx context.Context, pathOrID string) (st
 	if len(listResp.Links) > 0 {
 		return listResp.Links[0].URL, nil
 	}
+	return "", nil
+}
+
+// GetOrCreateSharedLink returns the current shareable URL for a file, creating
+// one if it doesn't already have one.
+func (c *Client) GetOrCreateSharedLink(ctx context.Context, pathOrID string) (string, error) {
+	link, err := c.GetSharedLink(ctx, pathOrID)
+	if err != nil || link != "" {
+		return link, err
+	}
 
 	var createResp struct {
 		URL string `json:"url"`
 	}
-	err := c.rpc(ctx, "/sharing/create_shared_link_with_settings", map[string]interface{}{
+	err = c.rpc(ctx, "/sharing/create_shared_link_with_settings", map[string]interface{}{
 		"path": pathOrID,
 	}, &createResp)
 	if err == nil {
@@ -113,11 +123,8 @@ func (c *Client) GetOrCreateSharedLink(ctx context.Context, pathOrID string) (st
 	var dbxErr *Err
 	if ok := asErr(err, &dbxErr); ok && dbxErr.StatusCode == 409 && dbxErr.HasTag("shared_link_already_exists") {
 		// Someone/something created a link between our list and create calls; fetch it again.
-		if err2 := c.rpc(ctx, "/sharing/list_shared_links", map[string]interface{}{
-			"path":        pathOrID,
-			"direct_only": true,
-		}, &listResp); err2 == nil && len(listResp.Links) > 0 {
-			return listResp.Links[0].URL, nil
+		if link, err2 := c.GetSharedLink(ctx, pathOrID); err2 == nil && link != "" {
+			return link, nil
 		}
 	}
 	return "", err
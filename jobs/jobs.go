@@ -0,0 +1,365 @@
+// Package jobs runs the site's periodic background work (cache refreshes,
+// link checks, show expiry, ...) on interval or cron schedules, records every
+// run in SQLite and lets the admin page list that history and trigger a run
+// by hand.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Trigger values recorded with each run.
+const (
+	TriggerSchedule = "schedule"
+	TriggerStartup  = "startup"
+	TriggerManual   = "manual"
+)
+
+// Outcome values recorded with each run.
+const (
+	OutcomeRunning     = "running"
+	OutcomeSuccess     = "success"
+	OutcomeFailed      = "failed"
+	OutcomeTimeout     = "timeout"
+	OutcomeInterrupted = "interrupted"
+)
+
+var (
+	ErrUnknownJob = errors.New("jobs: unknown job")
+	ErrDuplicate  = errors.New("jobs: job already registered")
+)
+
+// Job is a unit of periodic background work.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	// Timeout cancels a run's context after this long; 0 means no limit.
+	Timeout time.Duration
+	// Jitter delays each scheduled run by a random amount up to this long, so
+	// jobs sharing a schedule don't all hit S3/Dropbox at the same instant.
+	Jitter time.Duration
+	// RunAtStartup runs the job once as soon as the scheduler starts, before
+	// waiting for its first scheduled time.
+	RunAtStartup bool
+	Run          func(ctx context.Context) error
+}
+
+// Run is one recorded execution of a job.
+type Run struct {
+	ID        int64
+	Job       string
+	Trigger   string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Outcome   string
+	Error     string
+}
+
+// Duration is how long the run took, or zero while it is still running.
+func (r Run) Duration() time.Duration {
+	if r.EndedAt.IsZero() {
+		return 0
+	}
+	return r.EndedAt.Sub(r.StartedAt).Round(time.Millisecond)
+}
+
+// Status is a registered job's schedule and most recent run, for the admin
+// page.
+type Status struct {
+	Name     string
+	Schedule string
+	NextRun  time.Time
+	Running  bool
+	LastRun  *Run
+}
+
+type entry struct {
+	job     Job
+	trigger chan struct{}
+	next    time.Time
+	running bool
+	lastRun *Run
+}
+
+// Scheduler runs registered jobs. Runs of the same job never overlap; a
+// manual trigger arriving mid-run queues one more run right after it.
+type Scheduler struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	entries []*entry
+	byName  map[string]*entry
+}
+
+// NewScheduler returns a Scheduler recording run history in db's job_runs
+// table, which the traffic database's migrations create. A nil db is allowed
+// (e.g. the traffic database failed to open): jobs still run, only their
+// history isn't kept.
+func NewScheduler(db *sql.DB) (*Scheduler, error) {
+	s := &Scheduler{db: db, byName: map[string]*entry{}}
+	if db == nil {
+		return s, nil
+	}
+	// runs still marked running were cut off by a crash or hard restart
+	if _, err := db.Exec("UPDATE job_runs SET outcome = ? WHERE outcome = ?", OutcomeInterrupted, OutcomeRunning); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Register adds a job. It must be called before Run.
+func (s *Scheduler) Register(job Job) error {
+	if job.Name == "" || job.Run == nil || job.Schedule == nil {
+		return fmt.Errorf("jobs: %q needs a name, schedule and run func", job.Name)
+	}
+	if job.Schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("jobs: %q: schedule %s never fires", job.Name, job.Schedule)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byName[job.Name]; ok {
+		return fmt.Errorf("%w: %s", ErrDuplicate, job.Name)
+	}
+	e := &entry{job: job, trigger: make(chan struct{}, 1)}
+	if last, err := s.lastRun(job.Name); err != nil {
+		log.Error().Err(err).Msgf("jobs: failed to load last run of %s", job.Name)
+	} else {
+		e.lastRun = last
+	}
+	s.entries = append(s.entries, e)
+	s.byName[job.Name] = e
+	return nil
+}
+
+// Run runs every registered job on its schedule until ctx is cancelled, then
+// waits for in-flight runs to return.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	entries := append([]*entry(nil), s.entries...)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, e := range entries {
+		wg.Go(func() { s.loop(ctx, e) })
+	}
+	wg.Wait()
+}
+
+// Trigger asks for an immediate run of the named job.
+func (s *Scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	e, ok := s.byName[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownJob, name)
+	}
+	select {
+	case e.trigger <- struct{}{}:
+	default:
+		// a manual run is already queued
+	}
+	return nil
+}
+
+// Statuses reports every registered job in registration order.
+func (s *Scheduler) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		st := Status{
+			Name:     e.job.Name,
+			Schedule: e.job.Schedule.String(),
+			NextRun:  e.next,
+			Running:  e.running,
+		}
+		if e.lastRun != nil {
+			r := *e.lastRun
+			st.LastRun = &r
+		}
+		out = append(out, st)
+	}
+	return out
+}
+
+// RecentRuns returns up to limit runs across all jobs, newest first.
+func (s *Scheduler) RecentRuns(limit int) ([]Run, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+	rows, err := s.db.Query(
+		"SELECT id, job, trigger, started_at, ended_at, outcome, error FROM job_runs ORDER BY started_at DESC, id DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var runs []Run
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (s *Scheduler) loop(ctx context.Context, e *entry) {
+	if e.job.RunAtStartup {
+		s.runOnce(ctx, e, TriggerStartup)
+	}
+	for ctx.Err() == nil {
+		next := e.job.Schedule.Next(time.Now())
+		if e.job.Jitter > 0 {
+			next = next.Add(rand.N(e.job.Jitter))
+		}
+		s.mu.Lock()
+		e.next = next
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.runOnce(ctx, e, TriggerSchedule)
+		case <-e.trigger:
+			timer.Stop()
+			s.runOnce(ctx, e, TriggerManual)
+		}
+	}
+}
+
+// runOnce executes the job and records the run.
+func (s *Scheduler) runOnce(ctx context.Context, e *entry, trigger string) {
+	run := &Run{Job: e.job.Name, Trigger: trigger, StartedAt: time.Now().UTC(), Outcome: OutcomeRunning}
+	s.mu.Lock()
+	e.running = true
+	e.lastRun = run
+	s.mu.Unlock()
+	s.recordStart(run)
+	log.Info().Msgf("jobs: running %s (%s)", run.Job, trigger)
+
+	runCtx := ctx
+	if e.job.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, e.job.Timeout)
+		defer cancel()
+	}
+	err := safeRun(runCtx, e.job.Run)
+
+	s.mu.Lock()
+	run.EndedAt = time.Now().UTC()
+	switch {
+	case err == nil:
+		run.Outcome = OutcomeSuccess
+	case errors.Is(runCtx.Err(), context.DeadlineExceeded):
+		run.Outcome = OutcomeTimeout
+		run.Error = err.Error()
+	case ctx.Err() != nil:
+		run.Outcome = OutcomeInterrupted
+		run.Error = err.Error()
+	default:
+		run.Outcome = OutcomeFailed
+		run.Error = err.Error()
+	}
+	e.running = false
+	done := *run
+	s.mu.Unlock()
+	s.recordEnd(done)
+
+	if err != nil {
+		log.Error().Err(err).Msgf("jobs: %s %s after %v", done.Job, done.Outcome, done.Duration())
+		return
+	}
+	log.Info().Msgf("jobs: %s finished in %v", done.Job, done.Duration())
+}
+
+// safeRun turns a panicking job into a failed run instead of a crashed server.
+func safeRun(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+func (s *Scheduler) recordStart(run *Run) {
+	if s.db == nil {
+		return
+	}
+	res, err := s.db.Exec(
+		"INSERT INTO job_runs (job, trigger, started_at, outcome) VALUES (?, ?, ?, ?)",
+		run.Job, run.Trigger, run.StartedAt.Format(time.RFC3339Nano), run.Outcome,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("jobs: failed to record run start")
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Error().Err(err).Msg("jobs: failed to record run start")
+		return
+	}
+	s.mu.Lock()
+	run.ID = id
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) recordEnd(run Run) {
+	if s.db == nil || run.ID == 0 {
+		return
+	}
+	_, err := s.db.Exec(
+		"UPDATE job_runs SET ended_at = ?, outcome = ?, error = ? WHERE id = ?",
+		run.EndedAt.Format(time.RFC3339Nano), run.Outcome, run.Error, run.ID,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("jobs: failed to record run end")
+	}
+}
+
+func (s *Scheduler) lastRun(name string) (*Run, error) {
+	if s.db == nil {
+		return nil, nil
+	}
+	row := s.db.QueryRow(
+		"SELECT id, job, trigger, started_at, ended_at, outcome, error FROM job_runs WHERE job = ? ORDER BY started_at DESC, id DESC LIMIT 1",
+		name,
+	)
+	r, err := scanRun(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func scanRun(row interface{ Scan(...any) error }) (Run, error) {
+	var r Run
+	var started string
+	var ended, errMsg sql.NullString
+	if err := row.Scan(&r.ID, &r.Job, &r.Trigger, &started, &ended, &r.Outcome, &errMsg); err != nil {
+		return Run{}, err
+	}
+	r.StartedAt, _ = time.Parse(time.RFC3339Nano, started)
+	if ended.Valid {
+		r.EndedAt, _ = time.Parse(time.RFC3339Nano, ended.String)
+	}
+	r.Error = errMsg.String
+	return r, nil
+}
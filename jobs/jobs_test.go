@@ -0,0 +1,190 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "jobs.db")+"?_pragma=busy_timeout(5000)")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	// the table's migration lives with the traffic database's, which imports
+	// this package
+	schema, err := os.ReadFile("../server/traffic/migrations/0015_job_runs.sql")
+	require.NoError(t, err)
+	_, err = db.Exec(string(schema))
+	require.NoError(t, err)
+	return db
+}
+
+// startScheduler runs s in the background until the test ends.
+func startScheduler(t *testing.T, s *Scheduler) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitForRuns waits until n runs have finished and returns them, newest first.
+func waitForRuns(t *testing.T, s *Scheduler, n int) []Run {
+	t.Helper()
+	var runs []Run
+	require.Eventually(t, func() bool {
+		var err error
+		runs, err = s.RecentRuns(100)
+		require.NoError(t, err)
+		finished := 0
+		for _, r := range runs {
+			if r.Outcome != OutcomeRunning {
+				finished++
+			}
+		}
+		return finished >= n
+	}, 5*time.Second, 5*time.Millisecond)
+	return runs
+}
+
+func TestSchedulerRecordsOutcomes(t *testing.T) {
+	s, err := NewScheduler(openTestDB(t))
+	require.NoError(t, err)
+	never := Every(time.Hour)
+
+	require.NoError(t, s.Register(Job{Name: "ok", Schedule: never, Run: func(ctx context.Context) error { return nil }}))
+	require.NoError(t, s.Register(Job{Name: "fails", Schedule: never, Run: func(ctx context.Context) error { return errors.New("s3 unreachable") }}))
+	require.NoError(t, s.Register(Job{Name: "slow", Schedule: never, Timeout: 10 * time.Millisecond, Run: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}))
+	require.NoError(t, s.Register(Job{Name: "panics", Schedule: never, Run: func(ctx context.Context) error { panic("boom") }}))
+	startScheduler(t, s)
+
+	for _, name := range []string{"ok", "fails", "slow", "panics"} {
+		require.NoError(t, s.Trigger(name))
+	}
+	runs := waitForRuns(t, s, 4)
+
+	got := map[string]Run{}
+	for _, r := range runs {
+		got[r.Job] = r
+	}
+	require.Equal(t, OutcomeSuccess, got["ok"].Outcome)
+	require.Empty(t, got["ok"].Error)
+	require.Equal(t, OutcomeFailed, got["fails"].Outcome)
+	require.Equal(t, "s3 unreachable", got["fails"].Error)
+	require.Equal(t, OutcomeTimeout, got["slow"].Outcome)
+	require.Equal(t, OutcomeFailed, got["panics"].Outcome)
+	require.Equal(t, "panic: boom", got["panics"].Error)
+	for _, r := range runs {
+		require.Equal(t, TriggerManual, r.Trigger)
+		require.False(t, r.EndedAt.Before(r.StartedAt))
+	}
+
+	for _, st := range s.Statuses() {
+		require.NotNil(t, st.LastRun, st.Name)
+		require.Equal(t, got[st.Name].Outcome, st.LastRun.Outcome)
+		require.Equal(t, "every 1h0m0s", st.Schedule)
+		require.False(t, st.NextRun.IsZero())
+	}
+}
+
+func TestSchedulerRunsOnSchedule(t *testing.T) {
+	s, err := NewScheduler(nil)
+	require.NoError(t, err)
+	var runs atomic.Int32
+	require.NoError(t, s.Register(Job{
+		Name:         "tick",
+		Schedule:     Every(10 * time.Millisecond),
+		RunAtStartup: true,
+		Run: func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		},
+	}))
+	startScheduler(t, s)
+	require.Eventually(t, func() bool { return runs.Load() >= 3 }, 5*time.Second, time.Millisecond)
+
+	// no database: history is simply not kept
+	history, err := s.RecentRuns(10)
+	require.NoError(t, err)
+	require.Empty(t, history)
+}
+
+func TestSchedulerRunsDontOverlap(t *testing.T) {
+	s, err := NewScheduler(openTestDB(t))
+	require.NoError(t, err)
+	var inFlight, peak, total atomic.Int32
+	release := make(chan struct{})
+	require.NoError(t, s.Register(Job{Name: "busy", Schedule: Every(time.Hour), Run: func(ctx context.Context) error {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		if n > peak.Load() {
+			peak.Store(n)
+		}
+		if total.Add(1) == 1 {
+			<-release
+		}
+		return nil
+	}}))
+	startScheduler(t, s)
+
+	require.NoError(t, s.Trigger("busy"))
+	require.Eventually(t, func() bool { return total.Load() == 1 }, 5*time.Second, time.Millisecond)
+	// triggers while running collapse into one queued run
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.Trigger("busy"))
+	}
+	close(release)
+
+	waitForRuns(t, s, 2)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int32(2), total.Load())
+	require.Equal(t, int32(1), peak.Load())
+}
+
+func TestSchedulerRegisterAndTriggerErrors(t *testing.T) {
+	s, err := NewScheduler(nil)
+	require.NoError(t, err)
+	job := Job{Name: "a", Schedule: Every(time.Hour), Run: func(ctx context.Context) error { return nil }}
+	require.NoError(t, s.Register(job))
+	require.ErrorIs(t, s.Register(job), ErrDuplicate)
+	require.Error(t, s.Register(Job{Name: "no-run", Schedule: Every(time.Hour)}))
+	require.Error(t, s.Register(Job{Name: "never", Schedule: MustParseCron("0 0 31 2 *"), Run: job.Run}))
+	require.ErrorIs(t, s.Trigger("missing"), ErrUnknownJob)
+}
+
+func TestNewSchedulerMarksCrashedRunsInterrupted(t *testing.T) {
+	db := openTestDB(t)
+	s, err := NewScheduler(db)
+	require.NoError(t, err)
+	s.recordStart(&Run{Job: "a", Trigger: TriggerSchedule, StartedAt: time.Now().UTC(), Outcome: OutcomeRunning})
+
+	// the process dies mid-run; on the next start the run is closed out
+	s, err = NewScheduler(db)
+	require.NoError(t, err)
+	runs, err := s.RecentRuns(10)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	require.Equal(t, OutcomeInterrupted, runs[0].Outcome)
+
+	// and shows up as the job's last run once it's registered again
+	require.NoError(t, s.Register(Job{Name: "a", Schedule: Every(time.Hour), Run: func(ctx context.Context) error { return nil }}))
+	require.Equal(t, OutcomeInterrupted, s.Statuses()[0].LastRun.Outcome)
+}
@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		require.NoError(t, err)
+		return tm
+	}
+	tests := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"5 0 * * *", "2024-03-10 12:00", "2024-03-11 00:05"},
+		{"5 0 * * *", "2024-03-10 00:04", "2024-03-10 00:05"},
+		{"5 0 * * *", "2024-03-10 00:05", "2024-03-11 00:05"},
+		{"*/15 * * * *", "2024-03-10 12:07", "2024-03-10 12:15"},
+		{"0 9-17/4 * * *", "2024-03-10 10:00", "2024-03-10 13:00"},
+		{"30 2 1,15 * *", "2024-03-02 00:00", "2024-03-15 02:30"},
+		{"0 0 * * 1-5", "2024-03-09 08:00", "2024-03-11 00:00"}, // Saturday -> Monday
+		{"0 0 * * 7", "2024-03-09 08:00", "2024-03-10 00:00"},   // 7 is Sunday
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 13 * 5", "2024-03-01 00:00", "2024-03-01 00:00"}, // day-of-month OR day-of-week
+		{"0 12 31 12 *", "2024-12-31 12:00", "2025-12-31 12:00"},
+		{"@daily", "2024-03-10 12:00", "2024-03-11 00:00"},
+		{"@hourly", "2024-03-10 12:00", "2024-03-10 13:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" from "+tt.from, func(t *testing.T) {
+			s, err := ParseCron(tt.expr)
+			require.NoError(t, err)
+			from := at(tt.from)
+			if tt.expr == "0 0 13 * 5" {
+				// 2024-03-01 is a Friday; start just before it
+				from = from.Add(-time.Minute)
+			}
+			require.Equal(t, at(tt.want), s.Next(from))
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		_, err := ParseCron(expr)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestCronNeverMatching(t *testing.T) {
+	s, err := ParseCron("0 0 31 2 *")
+	require.NoError(t, err)
+	require.True(t, s.Next(time.Now()).IsZero())
+}
+
+func TestEvery(t *testing.T) {
+	now := time.Now()
+	require.Equal(t, now.Add(90*time.Minute), Every(90*time.Minute).Next(now))
+	require.Equal(t, "every 1h30m0s", Every(90*time.Minute).String())
+}
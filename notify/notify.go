@@ -0,0 +1,214 @@
+// Package notify tells the site owner about changes the site makes on its own
+// (the Link Refresh Job rewriting or trashing entries, shows expiring, caches
+// failing to refresh). Events raised during a job run are collected into one
+// Digest and sent when the run ends, so a run that touches twenty entries is
+// one message, not twenty.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Event is one thing worth telling someone about.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Digest is a batch of events from one source, typically one job run.
+type Digest struct {
+	Source     string    `json:"source"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Events     []Event   `json:"events"`
+}
+
+// Title is a one-line summary, used as the email subject.
+func (d Digest) Title() string {
+	noun := "events"
+	if len(d.Events) == 1 {
+		noun = "event"
+	}
+	return fmt.Sprintf("%s: %d %s", d.Source, len(d.Events), noun)
+}
+
+// Text renders the digest as plain text, one event per line.
+func (d Digest) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", d.Title())
+	for _, e := range d.Events {
+		fmt.Fprintf(&b, "%s  %-24s %s", e.Time.UTC().Format(time.RFC3339), e.Kind, e.Subject)
+		if e.Detail != "" {
+			fmt.Fprintf(&b, " (%s)", e.Detail)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Notifier delivers digests somewhere a person will see them.
+type Notifier interface {
+	Notify(ctx context.Context, d Digest) error
+}
+
+// Multi sends every digest to each of its notifiers.
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, d Digest) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sendTimeout bounds a single delivery so a dead webhook or mail server
+// can't hold up the job (or cache refresh) that raised the events.
+const sendTimeout = 15 * time.Second
+
+var (
+	defaultMu       sync.Mutex
+	defaultNotifier Notifier
+)
+
+// SetDefault sets the notifier used by Send, Record and Batch.Flush. nil
+// turns notifications off.
+func SetDefault(n Notifier) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultNotifier = n
+}
+
+// Default returns the notifier set by SetDefault, or nil.
+func Default() Notifier {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultNotifier
+}
+
+// Send delivers d through the default notifier. Empty digests, and any digest
+// while notifications are off, are dropped.
+func Send(ctx context.Context, d Digest) error {
+	n := Default()
+	if n == nil || len(d.Events) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sendTimeout)
+	defer cancel()
+	if err := n.Notify(ctx, d); err != nil {
+		return fmt.Errorf("notify: sending %q: %w", d.Title(), err)
+	}
+	return nil
+}
+
+// Batch collects the events raised during one job run.
+type Batch struct {
+	source    string
+	startedAt time.Time
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewBatch starts collecting events for source (usually a job name).
+func NewBatch(source string) *Batch {
+	return &Batch{source: source, startedAt: time.Now().UTC()}
+}
+
+// Add records an event.
+func (b *Batch) Add(kind, subject, detail string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, Event{Time: time.Now().UTC(), Kind: kind, Subject: subject, Detail: detail})
+}
+
+// Digest returns everything collected so far.
+func (b *Batch) Digest() Digest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Digest{
+		Source:     b.source,
+		StartedAt:  b.startedAt,
+		FinishedAt: time.Now().UTC(),
+		Events:     append([]Event(nil), b.events...),
+	}
+}
+
+// Flush sends the collected events as one digest, if there are any.
+func (b *Batch) Flush(ctx context.Context) error {
+	return Send(ctx, b.Digest())
+}
+
+type batchKey struct{}
+
+// WithBatch returns a context that Record adds events to.
+func WithBatch(ctx context.Context, b *Batch) context.Context {
+	return context.WithValue(ctx, batchKey{}, b)
+}
+
+// Record adds an event to the batch carried by ctx. Outside a batch (e.g. a
+// cache refresh prompted by SQS) the event is sent on its own straight away.
+func Record(ctx context.Context, source, kind, subject, detail string) {
+	if b, ok := ctx.Value(batchKey{}).(*Batch); ok {
+		b.Add(kind, subject, detail)
+		return
+	}
+	if Default() == nil {
+		return
+	}
+	now := time.Now().UTC()
+	d := Digest{
+		Source:     source,
+		StartedAt:  now,
+		FinishedAt: now,
+		Events:     []Event{{Time: now, Kind: kind, Subject: subject, Detail: detail}},
+	}
+	if err := Send(ctx, d); err != nil {
+		log.Error().Err(err).Msg("failed to send notification")
+	}
+}
+
+// FromConfig builds the notifiers configured in config.C: a webhook if
+// NOTIFY_WEBHOOK_URL is set, email if SMTP_ADDR and NOTIFY_EMAIL_TO are. It
+// returns nil if neither is.
+func FromConfig() Notifier {
+	var m Multi
+	if url := strings.TrimSpace(config.C.NotifyWebhookURL); url != "" {
+		m = append(m, &Webhook{URL: url})
+	}
+	var to []string
+	for _, addr := range strings.Split(config.C.NotifyEmailTo, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if config.C.SMTPAddr != "" && len(to) > 0 {
+		from := config.C.NotifyEmailFrom
+		if from == "" {
+			from = to[0]
+		}
+		m = append(m, &SMTP{
+			Addr:     config.C.SMTPAddr,
+			Username: config.C.SMTPUsername,
+			Password: config.C.SMTPPassword,
+			From:     from,
+			To:       to,
+		})
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,64 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a Notifier that keeps every digest it's given.
+type recorder struct {
+	mu      sync.Mutex
+	digests []Digest
+}
+
+func (r *recorder) Notify(ctx context.Context, d Digest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.digests = append(r.digests, d)
+	return nil
+}
+
+func useRecorder(t *testing.T) *recorder {
+	t.Helper()
+	r := &recorder{}
+	SetDefault(r)
+	t.Cleanup(func() { SetDefault(nil) })
+	return r
+}
+
+func TestBatchSendsOneDigestPerRun(t *testing.T) {
+	r := useRecorder(t)
+	b := NewBatch("expire-shows")
+	ctx := WithBatch(context.Background(), b)
+	Record(ctx, "show expiry", "show_expired", "Pickin' Party", "2024-03-01")
+	Record(ctx, "show expiry", "show_expired", "Bluegrass Brunch", "2024-03-02")
+	require.Empty(t, r.digests, "nothing is sent until the run ends")
+
+	require.NoError(t, b.Flush(ctx))
+	require.Len(t, r.digests, 1)
+	d := r.digests[0]
+	require.Equal(t, "expire-shows", d.Source)
+	require.Equal(t, "expire-shows: 2 events", d.Title())
+	require.Len(t, d.Events, 2)
+	require.Contains(t, d.Text(), "Bluegrass Brunch (2024-03-02)")
+
+	// a run with nothing to report sends nothing
+	require.NoError(t, NewBatch("expire-shows").Flush(ctx))
+	require.Len(t, r.digests, 1)
+}
+
+func TestRecordOutsideBatchSendsImmediately(t *testing.T) {
+	r := useRecorder(t)
+	Record(context.Background(), "audio cache", "cache_refresh_failing", "audio cache refresh failed", "s3 unreachable")
+	require.Len(t, r.digests, 1)
+	require.Equal(t, "audio cache: 1 event", r.digests[0].Title())
+}
+
+func TestRecordWithNotificationsOff(t *testing.T) {
+	SetDefault(nil)
+	Record(context.Background(), "audio cache", "cache_refresh_failing", "x", "")
+	require.NoError(t, Send(context.Background(), Digest{Events: []Event{{Kind: "x"}}}))
+}
@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"mime"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTP is a minimal SMTP server that accepts every message and keeps
+// the envelope and data.
+type fakeSMTP struct {
+	net.Listener
+
+	mu   sync.Mutex
+	from string
+	to   []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeSMTP{Listener: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "MAIL":
+			f.mu.Lock()
+			f.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			f.mu.Unlock()
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			f.mu.Lock()
+			f.to = append(f.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			f.mu.Unlock()
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.data = string(b)
+			f.mu.Unlock()
+			_ = tp.PrintfLine("250 queued")
+		case "QUIT":
+			_ = tp.PrintfLine("221 bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPSendsDigestEmail(t *testing.T) {
+	f := newFakeSMTP(t)
+	s := &SMTP{
+		Addr: f.Addr().String(),
+		From: "site@example.com",
+		To:   []string{"andrew@example.com", "backup@example.com"},
+	}
+	d := Digest{
+		Source: "expire-shows",
+		Events: []Event{
+			{Time: time.Now(), Kind: "show_expired", Subject: "Pickin' Party", Detail: "2024-03-01"},
+			{Time: time.Now(), Kind: "show_expired", Subject: "Bluegrass Brunch", Detail: "2024-03-02"},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Notify(ctx, d))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	require.Equal(t, "site@example.com", f.from)
+	require.Equal(t, []string{"andrew@example.com", "backup@example.com"}, f.to)
+	msg, err := textproto.NewReader(bufio.NewReader(strings.NewReader(f.data))).ReadMIMEHeader()
+	require.NoError(t, err)
+	require.Equal(t, "expire-shows: 2 events", msg.Get("Subject"))
+	require.Equal(t, "andrew@example.com, backup@example.com", msg.Get("To"))
+	require.Contains(t, f.data, "Pickin' Party (2024-03-01)")
+	require.Contains(t, f.data, "Bluegrass Brunch (2024-03-02)")
+}
+
+func TestSMTPEncodesSubject(t *testing.T) {
+	s := &SMTP{From: "site@example.com", To: []string{"andrew@example.com"}}
+	msg := string(s.message(Digest{Source: "Café Señor\r\nBcc: victim@example.com", Events: []Event{{Kind: "show_expired"}}}))
+	header, _, _ := strings.Cut(msg, "\r\n\r\n")
+	require.NotContains(t, header, "\r\nBcc:")
+
+	h, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg))).ReadMIMEHeader()
+	require.NoError(t, err)
+	require.Empty(t, h.Get("Bcc"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(h.Get("Subject"))
+	require.NoError(t, err)
+	require.Equal(t, "Café Señor Bcc: victim@example.com: 1 event", subject)
+}
+
+func TestSMTPUnreachable(t *testing.T) {
+	f := newFakeSMTP(t)
+	addr := f.Addr().String()
+	f.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := (&SMTP{Addr: addr, From: "a@example.com", To: []string{"b@example.com"}}).Notify(ctx, Digest{Source: "x", Events: []Event{{Kind: "y"}}})
+	require.Error(t, err)
+}
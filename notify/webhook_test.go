@@ -0,0 +1,46 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookPostsDigestJSON(t *testing.T) {
+	var got map[string]any
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		contentType = r.Header.Get("Content-Type")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	d := Digest{
+		Source:    "sheet-music-link-refresh",
+		StartedAt: time.Now().UTC(),
+		Events: []Event{
+			{Time: time.Now().UTC(), Kind: "confirmed_gone", Subject: "Salt Creek", Detail: "moved to the trash"},
+		},
+	}
+	require.NoError(t, (&Webhook{URL: srv.URL}).Notify(context.Background(), d))
+	require.Equal(t, "application/json", contentType)
+	require.Equal(t, "sheet-music-link-refresh", got["source"])
+	require.Len(t, got["events"], 1)
+	require.Contains(t, got["text"], "Salt Creek (moved to the trash)")
+}
+
+func TestWebhookErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	err := (&Webhook{URL: srv.URL}).Notify(context.Background(), Digest{Source: "x", Events: []Event{{Kind: "y"}}})
+	require.ErrorContains(t, err, "500")
+}
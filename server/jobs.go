@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+
+	"github.com/andrewwillette/andrewwillettedotcom/aws"
+	"github.com/andrewwillette/andrewwillettedotcom/dropbox"
+	"github.com/andrewwillette/andrewwillettedotcom/jobs"
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
+	"github.com/andrewwillette/andrewwillettedotcom/server/traffic"
+)
+
+const (
+	adminRunJobEndpoint      = "/admin/jobs/:name/run"
+	adminLinkRefreshPreview  = "/admin/sheet-music/link-refresh/preview"
+	linkRefreshPreviewWindow = 5 * time.Minute
+)
+
+// newScheduler registers the site's background jobs.
+func newScheduler() *jobs.Scheduler {
+	sched, err := jobs.NewScheduler(traffic.DB())
+	if err != nil {
+		log.Error().Err(err).Msg("failed to set up job history; running jobs without it")
+		sched, _ = jobs.NewScheduler(nil)
+	}
+
+	register := func(job jobs.Job) {
+		job.Run = withDigest(job.Name, job.Run)
+		if err := sched.Register(job); err != nil {
+			log.Error().Err(err).Msg("failed to register job")
+		}
+	}
+
+	// presigned URLs in the audio cache expire; rebuild it well before then
+	register(jobs.Job{
+		Name:     "audio-presign-refresh",
+		Schedule: jobs.Every(aws.AudioPresignRefreshInterval),
+		Timeout:  5 * time.Minute,
+		Jitter:   time.Minute,
+		Run:      aws.RefreshAudioCache,
+	})
+
+	register(jobs.Job{
+		Name:         "expire-shows",
+		Schedule:     jobs.MustParseCron("5 0 * * *"),
+		Timeout:      5 * time.Minute,
+		RunAtStartup: true,
+		Run: func(ctx context.Context) error {
+			_, err := aws.ExpireShows(ctx)
+			return err
+		},
+	})
+
+	// sheet music the link refresh job trashed is kept for a while so it can
+	// be restored, then removed for good
+	register(jobs.Job{
+		Name:     "sheet-music-trash-purge",
+		Schedule: jobs.MustParseCron("15 0 * * *"),
+		Timeout:  10 * time.Minute,
+		Run: func(ctx context.Context) error {
+			_, err := aws.PurgeSheetMusicTrash(ctx)
+			return err
+		},
+	})
+
+	if traffic.DB() != nil {
+		register(jobs.Job{
+			Name:     "traffic-retention",
+			Schedule: jobs.MustParseCron("30 3 * * *"),
+			Timeout:  30 * time.Minute,
+			Run: func(ctx context.Context) error {
+				_, err := traffic.RunRetention(ctx)
+				return err
+			},
+		})
+	}
+
+	if dbx := dropbox.NewClientFromConfig(); dbx != nil {
+		register(jobs.Job{
+			Name:         "sheet-music-link-refresh",
+			Schedule:     jobs.Every(24 * time.Hour),
+			Timeout:      30 * time.Minute,
+			Jitter:       10 * time.Minute,
+			RunAtStartup: true,
+			Run: func(ctx context.Context) error {
+				_, err := aws.RefreshSheetMusicLinks(ctx, dbx, aws.LinkRefreshOptions{})
+				return err
+			},
+		})
+	} else {
+		log.Warn().Msg("Dropbox API not configured (DROPBOX_REFRESH_TOKEN unset); sheet music link refresh job disabled")
+	}
+
+	return sched
+}
+
+// withDigest collects the notifications a job run raises and sends them as
+// one digest when the run ends, whether or not it succeeded.
+func withDigest(name string, run func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		batch := notify.NewBatch(name)
+		err := run(notify.WithBatch(ctx, batch))
+		if nerr := batch.Flush(ctx); nerr != nil {
+			log.Error().Err(nerr).Msgf("job %s: failed to send notifications", name)
+		}
+		return err
+	}
+}
+
+// handleRunJob triggers an immediate run of a job from the admin page.
+func handleRunJob(sched *jobs.Scheduler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("name")
+		if err := sched.Trigger(name); err != nil {
+			if errors.Is(err, jobs.ErrUnknownJob) {
+				return echo.NewHTTPError(http.StatusNotFound, "unknown job")
+			}
+			return err
+		}
+		log.Info().Msgf("job %s triggered manually from %s", name, c.RealIP())
+		return c.Redirect(http.StatusSeeOther, adminEndpoint)
+	}
+}
+
+// handleLinkRefreshPreview runs the Link Refresh Job as a dry run and returns
+// the per-entry report as JSON, so the admin can see what the job would change
+// (and delete) before it does. The real run is triggered from the jobs table.
+func handleLinkRefreshPreview(c echo.Context) error {
+	dbx := dropbox.NewClientFromConfig()
+	if dbx == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Dropbox API not configured")
+	}
+	// a dry run checks every entry against Dropbox and can outlast the
+	// server's write timeout
+	deadline := time.Now().Add(linkRefreshPreviewWindow)
+	if err := http.NewResponseController(c.Response().Writer).SetWriteDeadline(deadline); err != nil {
+		log.Debug().Err(err).Msg("link refresh preview: could not extend write deadline")
+	}
+	ctx, cancel := context.WithDeadline(c.Request().Context(), deadline)
+	defer cancel()
+
+	report, err := aws.RefreshSheetMusicLinks(ctx, dbx, aws.LinkRefreshOptions{DryRun: true})
+	if err != nil {
+		log.Error().Err(err).Msg("link refresh preview failed")
+		return echo.NewHTTPError(http.StatusInternalServerError, "link refresh preview failed")
+	}
+	return c.JSON(http.StatusOK, report)
+}
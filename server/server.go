@@ -1,13 +1,17 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/andrewwillette/keyofday/key"
@@ -21,6 +25,8 @@ import (
 
 	"github.com/andrewwillette/andrewwillettedotcom/aws"
 	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/jobs"
+	"github.com/andrewwillette/andrewwillettedotcom/notify"
 	"github.com/andrewwillette/andrewwillettedotcom/server/blog"
 	"github.com/andrewwillette/andrewwillettedotcom/server/echopprof"
 	"github.com/andrewwillette/andrewwillettedotcom/server/traffic"
@@ -49,7 +55,13 @@ const (
 
 	keyOfDayEndpoint = "/key-of-the-day"
 
-	adminEndpoint = "/admin/traffic"
+	adminEndpoint          = "/admin/traffic"
+	adminAnalyticsEndpoint = "/admin/analytics"
+	adminExportEndpoint    = "/admin/traffic/export"
+
+	adminAPISummaryEndpoint    = "/admin/api/traffic/summary"
+	adminAPIRequestsEndpoint   = "/admin/api/traffic/requests"
+	adminAPISuspiciousEndpoint = "/admin/api/traffic/suspicious"
 )
 
 var (
@@ -57,64 +69,104 @@ var (
 	basepath   = filepath.Dir(b)
 )
 
-// StartServer start the server with https certificate configurable
-func StartServer(sslEnabled bool) {
+// StartServer start the server with https certificate configurable. It runs
+// until ctx is cancelled (e.g. on SIGTERM during a deploy), then stops taking
+// new connections, lets in-flight requests finish for up to shutdownTimeout,
+// stops the background workers and closes the traffic database.
+func StartServer(ctx context.Context, sslEnabled bool) error {
 	if err := traffic.InitDB(config.C.TrafficDBPath); err != nil {
 		zlog.Error().Err(err).Msg("failed to initialize traffic database")
+	} else if err := traffic.ReloadBlocklist(); err != nil {
+		zlog.Error().Err(err).Msg("failed to load IP blocklist")
+	}
+	defer func() {
+		if err := traffic.Close(); err != nil {
+			zlog.Error().Err(err).Msg("failed to close traffic database")
+		}
+	}()
+
+	// cancelled on shutdown, or if a listener fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if n := notify.FromConfig(); n != nil {
+		notify.SetDefault(n)
+	} else {
+		zlog.Info().Msg("no notifier configured (NOTIFY_WEBHOOK_URL / SMTP_ADDR); unattended changes are only logged")
 	}
+	sched := newScheduler()
+
 	e := echo.New()
 	e.HideBanner = true
 	e.Logger = newZerologAdapter(zlog.Logger)
-	addRoutes(e)
+	addRoutes(e, sched)
 	addMiddleware(e)
 	if config.C.PProfEnabled {
 		echopprof.Wrap(e)
 	}
 	e.Renderer = getTemplateRenderer()
 	blog.InitializeBlogs()
-	aws.UpdateAudioCache()
-	aws.UpdateSheetMusicCache()
-	aws.UpdateShowsCache()
-	go aws.UpdateAudioCacheOnPresignExpiry()
-	go aws.StartSQSPoller()
-	aws.StartSheetMusicLinkRefreshJob()
+	aws.WarmCaches(ctx, config.C.CacheSnapshotPath)
+
+	var workers sync.WaitGroup
+	workers.Go(func() { sched.Run(ctx) })
+	workers.Go(func() { aws.RunSQSPoller(ctx) })
+	workers.Go(func() { traffic.RunBlocklistRefresher(ctx) })
+
 	const (
-		readTimeout  = 10 * time.Second
-		writeTimeout = 30 * time.Second
-		idleTimeout  = 120 * time.Second
+		readTimeout     = 10 * time.Second
+		writeTimeout    = 30 * time.Second
+		idleTimeout     = 120 * time.Second
+		shutdownTimeout = 20 * time.Second
 	)
+	for _, s := range []*http.Server{e.Server, e.TLSServer} {
+		s.ReadTimeout = readTimeout
+		s.WriteTimeout = writeTimeout
+		s.IdleTimeout = idleTimeout
+	}
+
+	serveErr := make(chan error, 2)
 	if sslEnabled {
 		e.Pre(middleware.HTTPSRedirect())
 		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist("andrewwillette.com")
 		const sslCacheDir = "/var/www/.cache"
 		e.AutoTLSManager.Cache = autocert.DirCache(sslCacheDir)
-		// Configure timeouts on the TLS server Echo uses internally for StartAutoTLS
-		e.TLSServer.ReadTimeout = readTimeout
-		e.TLSServer.WriteTimeout = writeTimeout
-		e.TLSServer.IdleTimeout = idleTimeout
-		go func(c *echo.Echo) {
-			redirectServer := &http.Server{
-				Addr:         ":80",
-				ReadTimeout:  readTimeout,
-				WriteTimeout: writeTimeout,
-				IdleTimeout:  idleTimeout,
-			}
-			e.Logger.Fatal(e.StartServer(redirectServer))
-		}(e)
-		e.Logger.Fatal(e.StartAutoTLS(":443"))
-	} else {
-		s := &http.Server{
-			Addr:         ":80",
-			ReadTimeout:  readTimeout,
-			WriteTimeout: writeTimeout,
-			IdleTimeout:  idleTimeout,
-		}
-		e.Logger.Fatal(e.StartServer(s))
+		go func() { serveErr <- e.StartAutoTLS(":443") }()
+	}
+	// plain HTTP: the site itself, or just the redirect to HTTPS
+	go func() { serveErr <- e.Start(":80") }()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		zlog.Info().Msg("shutting down server")
+	case err = <-serveErr:
+		zlog.Error().Err(err).Msg("server stopped unexpectedly; shutting down")
+	}
+	cancel()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if serr := e.Shutdown(shutdownCtx); serr != nil {
+		zlog.Error().Err(serr).Msg("failed to drain in-flight requests")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-shutdownCtx.Done():
+		zlog.Warn().Msg("background workers did not stop before the shutdown timeout")
 	}
+	zlog.Info().Msg("server stopped")
+	return err
 }
 
 // addRoutes add routes to the echo webserver
-func addRoutes(e *echo.Echo) {
+func addRoutes(e *echo.Echo, sched *jobs.Scheduler) {
 	e.GET(homeEndpoint, handleHomePage)
 	e.GET(resumeEndpoint, handleResumePage)
 	e.GET(musicEndpoint, handleRecordingsPage)
@@ -126,18 +178,76 @@ func addRoutes(e *echo.Echo) {
 	e.GET(blogEndpoint, blog.HandleIndividualBlogPage)
 	e.File(cssEndpoint, cssResource)
 	e.File(robotsEndpoint, robotsTxtResource)
-	e.GET(adminEndpoint, traffic.HandleAdminPage, adminRateLimiter(), traffic.BasicAuthMiddleware())
+	// one limiter for every admin page, so each IP gets a single budget of
+	// password guesses however many routes it spreads them over
+	adminLimiter := adminRateLimiter()
+	// browsers resend basic auth credentials on cross-site requests, so the
+	// page hands out a token the run-job form must send back
+	adminCSRF := adminCSRFMiddleware()
+	e.GET(adminEndpoint, traffic.AdminPageHandler(sched), adminLimiter, traffic.BasicAuthMiddleware(), adminCSRF)
+	e.GET(adminAnalyticsEndpoint, traffic.AnalyticsPageHandler, adminLimiter, traffic.BasicAuthMiddleware())
+	e.GET(adminExportEndpoint, traffic.ExportHandler, adminLimiter, traffic.BasicAuthMiddleware())
+	e.POST(adminRunJobEndpoint, handleRunJob(sched), adminLimiter, traffic.BasicAuthMiddleware(), adminCSRF)
+	e.GET(adminLinkRefreshPreview, handleLinkRefreshPreview, adminLimiter, traffic.BasicAuthMiddleware())
+	// scripts page through results, so the API shares a looser limit
+	apiLimiter := adminAPIRateLimiter()
+	e.GET(adminAPISummaryEndpoint, traffic.APISummaryHandler, apiLimiter, traffic.BasicAuthMiddleware())
+	e.GET(adminAPIRequestsEndpoint, traffic.APIRequestsHandler, apiLimiter, traffic.BasicAuthMiddleware())
+	e.GET(adminAPISuspiciousEndpoint, traffic.APISuspiciousHandler, apiLimiter, traffic.BasicAuthMiddleware())
+	if config.C.StorageBackend == aws.StorageBackendLocal {
+		// stands in for S3 presigned URLs when running offline
+		e.GET(aws.LocalStorageURLPrefix+"/*", handleLocalStorage)
+	}
 }
 
-// adminRateLimiter returns a rate limiter middleware scoped to the admin route.
+// handleLocalStorage serves an object from the local storage directory, the
+// way a presigned S3 URL would, except for objects that aren't public.
+func handleLocalStorage(c echo.Context) error {
+	p, err := url.PathUnescape(c.Param("*"))
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	// clean first so ../ can't reach a hidden object by another path
+	bucket, key, _ := strings.Cut(path.Clean("/" + p)[1:], "/")
+	if bucket == "" || key == "" || !aws.LocalStorageServes(bucket, key) {
+		return echo.ErrNotFound
+	}
+	return c.File(filepath.Join(config.C.LocalStorageDir, bucket, filepath.FromSlash(key)))
+}
+
+// adminRateLimiter returns the rate limiter for the admin pages.
 // Allows 5 requests per minute per IP to mitigate brute-force attacks.
 func adminRateLimiter() echo.MiddlewareFunc {
+	return ipRateLimiter(5)
+}
+
+// adminCSRFMiddleware guards the admin forms against cross-site requests.
+// Browsers that send Sec-Fetch-Site are checked by that alone; others must
+// post back the token the admin page put in the form, matching its cookie.
+func adminCSRFMiddleware() echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		TokenLookup:    "form:_csrf",
+		CookiePath:     "/admin",
+		CookieHTTPOnly: true,
+		CookieSameSite: http.SameSiteStrictMode,
+	})
+}
+
+// adminAPIRateLimiter returns the rate limiter for the admin JSON API.
+// Allows 60 requests per minute per IP; failed logins still count towards
+// autoban.
+func adminAPIRateLimiter() echo.MiddlewareFunc {
+	return ipRateLimiter(60)
+}
+
+// ipRateLimiter limits each IP to perMinute requests a minute.
+func ipRateLimiter(perMinute int) echo.MiddlewareFunc {
 	config := middleware.RateLimiterConfig{
 		Skipper: middleware.DefaultSkipper,
 		Store: middleware.NewRateLimiterMemoryStoreWithConfig(
 			middleware.RateLimiterMemoryStoreConfig{
-				Rate:      rate.Limit(5.0 / 60.0), // 5 requests per minute
-				Burst:     5,
+				Rate:      rate.Limit(float64(perMinute) / 60.0),
+				Burst:     perMinute,
 				ExpiresIn: 5 * time.Minute,
 			},
 		),
@@ -155,6 +265,11 @@ func adminRateLimiter() echo.MiddlewareFunc {
 }
 
 func addMiddleware(e *echo.Echo) {
+	// nothing proxies in front of the server, so the peer address is the
+	// client; X-Forwarded-For and X-Real-IP are whatever the client sent and
+	// would let it dodge the blocklist
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.Pre(traffic.BlocklistMiddleware)
 	e.Use(logmiddleware)
 	e.Use(traffic.TrackingMiddleware)
 	e.Use(middleware.Secure())
@@ -240,6 +355,7 @@ func getTemplateRenderer() *Template {
 		"templates/blogs/blogspage.tmpl",
 		"templates/blogs/singleblogpage.tmpl",
 		"templates/adminpage.tmpl",
+		"templates/analyticspage.tmpl",
 		"templates/showspage.tmpl",
 	}
 
@@ -1,14 +1,23 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/andrewwillette/keyofday/key"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/require"
+
+	"github.com/andrewwillette/andrewwillettedotcom/aws"
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/jobs"
+	"github.com/andrewwillette/andrewwillettedotcom/server/traffic"
 )
 
 func TestHandleHomePage(t *testing.T) {
@@ -58,3 +67,213 @@ func BenchmarkHandleHomePage(b *testing.B) {
 		require.NoError(b, err)
 	}
 }
+
+func TestHandleRunJob(t *testing.T) {
+	sched, err := jobs.NewScheduler(nil)
+	require.NoError(t, err)
+	require.NoError(t, sched.Register(jobs.Job{
+		Name:     "expire-shows",
+		Schedule: jobs.Every(time.Hour),
+		Run:      func(ctx context.Context) error { return nil },
+	}))
+	e := echo.New()
+	e.POST(adminRunJobEndpoint, handleRunJob(sched))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/jobs/expire-shows/run", nil))
+	require.Equal(t, http.StatusSeeOther, rec.Code)
+	require.Equal(t, adminEndpoint, rec.Header().Get("Location"))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/jobs/nope/run", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAdminPageListsJobs(t *testing.T) {
+	sched, err := jobs.NewScheduler(nil)
+	require.NoError(t, err)
+	require.NoError(t, sched.Register(jobs.Job{
+		Name:     "expire-shows",
+		Schedule: jobs.MustParseCron("5 0 * * *"),
+		Run:      func(ctx context.Context) error { return nil },
+	}))
+	e := echo.New()
+	e.Renderer = getTemplateRenderer()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, adminEndpoint, nil), rec)
+	require.NoError(t, traffic.AdminPageHandler(sched)(c))
+	require.Contains(t, rec.Body.String(), "expire-shows")
+	require.Contains(t, rec.Body.String(), `action="/admin/jobs/expire-shows/run"`)
+}
+
+func TestAnalyticsPageRenders(t *testing.T) {
+	start := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	a := traffic.Analytics{
+		Range:    traffic.ParseAnalyticsRange("24h"),
+		Series:   []traffic.SeriesPoint{{Start: start, Requests: 2, Uniques: 1}},
+		Totals:   traffic.SeriesPoint{Requests: 2, Uniques: 1},
+		TopPages: []traffic.PageCount{{Path: "/sheet-music", Requests: 2, Uniques: 1}},
+		NotFound: []traffic.NotFoundCount{{Path: "/old-post", Requests: 1, Last: start}},
+	}
+	rec := httptest.NewRecorder()
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, adminAnalyticsEndpoint, nil), rec)
+	require.NoError(t, getTemplateRenderer().Render(rec, "analyticspage", traffic.NewAnalyticsPageData(a), c))
+	body := rec.Body.String()
+	require.Contains(t, body, `<svg class="chart"`)
+	require.Contains(t, body, "<h3>Unique visitors (1)</h3>")
+	require.Contains(t, body, "/sheet-music")
+	require.Contains(t, body, "/old-post")
+	require.Contains(t, body, `href="?range=7d"`)
+	require.Contains(t, body, `href="?range=24h&class=scanner"`)
+}
+
+func TestBlocklistIgnoresForwardedFor(t *testing.T) {
+	require.NoError(t, traffic.InitDB(t.TempDir()+"/traffic.db"))
+	t.Cleanup(func() { _ = traffic.Close() })
+	_, err := traffic.AddBlock("203.0.113.9", traffic.BlockSourceManual, 1)
+	require.NoError(t, err)
+	e := echo.New()
+	addMiddleware(e)
+	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "hi") })
+
+	for _, tc := range []struct {
+		remote, forwardedFor string
+		want                 int
+	}{
+		{"203.0.113.9", "192.0.2.1", http.StatusForbidden},
+		{"192.0.2.1", "203.0.113.9", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote + ":1234"
+		req.Header.Set(echo.HeaderXForwardedFor, tc.forwardedFor)
+		req.Header.Set(echo.HeaderXRealIP, tc.forwardedFor)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, tc.want, rec.Code, tc.remote)
+	}
+}
+
+func TestAutobanIgnoresForwardedFor(t *testing.T) {
+	require.NoError(t, traffic.InitDB(t.TempDir()+"/traffic.db"))
+	t.Cleanup(func() { _ = traffic.Close() })
+	prev := config.C
+	config.C.AdminPassword = "secret"
+	config.C.AutobanFailedAuthLimit = 2
+	t.Cleanup(func() { config.C = prev })
+	e := echo.New()
+	addMiddleware(e)
+	e.GET(adminEndpoint, func(c echo.Context) error { return c.String(http.StatusOK, "admin") }, traffic.BasicAuthMiddleware())
+
+	const attacker, owner = "198.51.100.9", "192.0.2.1"
+	get := func(password string) int {
+		req := httptest.NewRequest(http.MethodGet, adminEndpoint, nil)
+		req.RemoteAddr = attacker + ":1234"
+		req.Header.Set(echo.HeaderXForwardedFor, owner)
+		req.SetBasicAuth("admin", password)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, http.StatusUnauthorized, get("guess1"))
+	require.Equal(t, http.StatusUnauthorized, get("guess2"))
+	require.False(t, traffic.IsBlocked(owner), "the spoofed address isn't banned")
+	require.True(t, traffic.IsBlocked(attacker))
+	require.Equal(t, http.StatusForbidden, get("secret"), "spoofing doesn't escape the ban")
+}
+
+func TestAdminRoutesShareRateLimit(t *testing.T) {
+	sched, err := jobs.NewScheduler(nil)
+	require.NoError(t, err)
+	e := echo.New()
+	addMiddleware(e)
+	addRoutes(e, sched)
+
+	var codes []int
+	for _, target := range []string{adminEndpoint, adminAnalyticsEndpoint, adminExportEndpoint, adminLinkRefreshPreview, adminEndpoint, adminAnalyticsEndpoint} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+	const denied, limited = http.StatusUnauthorized, http.StatusTooManyRequests
+	require.Equal(t, []int{denied, denied, denied, denied, denied, limited}, codes, "five guesses in all, not five per route")
+}
+
+func TestRunJobRequiresCSRFToken(t *testing.T) {
+	prev := config.C
+	config.C.AdminPassword = "secret"
+	t.Cleanup(func() { config.C = prev })
+	sched, err := jobs.NewScheduler(nil)
+	require.NoError(t, err)
+	require.NoError(t, sched.Register(jobs.Job{
+		Name:     "expire-shows",
+		Schedule: jobs.Every(time.Hour),
+		Run:      func(ctx context.Context) error { return nil },
+	}))
+	e := echo.New()
+	e.Renderer = getTemplateRenderer()
+	addRoutes(e, sched)
+
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	runJob := func(form string, cookies ...*http.Cookie) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/admin/jobs/expire-shows/run", strings.NewReader(form))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return req
+	}
+
+	page := send(httptest.NewRequest(http.MethodGet, adminEndpoint, nil))
+	require.Equal(t, http.StatusOK, page.Code)
+	cookies := page.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.Contains(t, page.Body.String(), `name="_csrf" value="`+cookies[0].Value+`"`)
+
+	// a cross-site form carries the browser's credentials but not the token
+	require.Equal(t, http.StatusBadRequest, send(runJob("")).Code)
+	require.Equal(t, http.StatusForbidden, send(runJob("_csrf=guess", cookies...)).Code)
+	crossSite := runJob("_csrf="+cookies[0].Value, cookies...)
+	crossSite.Header.Set(echo.HeaderSecFetchSite, "cross-site")
+	require.Equal(t, http.StatusForbidden, send(crossSite).Code)
+
+	require.Equal(t, http.StatusSeeOther, send(runJob("_csrf="+cookies[0].Value, cookies...)).Code)
+}
+
+func TestLocalStorageHidesTrash(t *testing.T) {
+	dir := t.TempDir()
+	prev := config.C
+	config.C.StorageBackend = aws.StorageBackendLocal
+	config.C.LocalStorageDir = dir
+	config.C.SheetMusicS3BucketName = "sheets"
+	t.Cleanup(func() { config.C = prev })
+	for _, name := range []string{"sheets/dropbox_sheetmusic/reel.json", "sheets/trash/dropbox_sheetmusic/old.json"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(`{}`), 0644))
+	}
+	sched, err := jobs.NewScheduler(nil)
+	require.NoError(t, err)
+	e := echo.New()
+	addRoutes(e, sched)
+
+	for target, want := range map[string]int{
+		"/storage/sheets/dropbox_sheetmusic/reel.json":                            http.StatusOK,
+		"/storage/sheets/trash/dropbox_sheetmusic/old.json":                       http.StatusNotFound,
+		"/storage/sheets/dropbox_sheetmusic/../trash/dropbox_sheetmusic/old.json": http.StatusNotFound,
+		"/storage/sheets/%74rash/dropbox_sheetmusic/old.json":                     http.StatusNotFound,
+		"/storage/sheets/../../etc/passwd":                                        http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, want, rec.Code, target)
+	}
+}
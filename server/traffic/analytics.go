@@ -0,0 +1,506 @@
+package traffic
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// AnalyticsRange is a span of time the analytics page can show, as a
+// number of hourly or daily buckets ending with the current one.
+type AnalyticsRange struct {
+	Name    string
+	Hourly  bool // hourly buckets; daily otherwise
+	Buckets int
+}
+
+var AnalyticsRanges = []AnalyticsRange{
+	{Name: "24h", Hourly: true, Buckets: 24},
+	{Name: "7d", Buckets: 7},
+	{Name: "30d", Buckets: 30},
+	{Name: "1y", Buckets: 365},
+}
+
+// ParseAnalyticsRange returns the range named s, or the 7 day range if there
+// isn't one.
+func ParseAnalyticsRange(s string) AnalyticsRange {
+	for _, r := range AnalyticsRanges {
+		if r.Name == s {
+			return r
+		}
+	}
+	return AnalyticsRanges[1]
+}
+
+// How many rows the analytics page lists per table.
+const (
+	analyticsTopShown      = 20
+	analyticsNotFoundShown = 50
+)
+
+// SeriesPoint is one bucket of a time series. Errors counts 5xx responses.
+type SeriesPoint struct {
+	Start    time.Time
+	Requests int
+	Uniques  int
+	Errors   int
+}
+
+type PageCount struct {
+	Path     string
+	Requests int
+	Uniques  int
+}
+
+type ReferrerCount struct {
+	Host     string
+	Requests int
+}
+
+type NotFoundCount struct {
+	Path     string
+	Requests int
+	Last     time.Time
+}
+
+// Analytics summarizes the traffic in a range. Counts combine raw requests
+// with the Daily Rollups for days already rolled up; unique visitors on
+// rolled-up days, and across days in privacy mode, are counted once per day.
+type Analytics struct {
+	Range        AnalyticsRange
+	Class        Class
+	Series       []SeriesPoint
+	Totals       SeriesPoint
+	TopPages     []PageCount
+	TopReferrers []ReferrerCount
+	NotFound     []NotFoundCount
+}
+
+// GetAnalytics aggregates the traffic in the range ending now, limited to
+// one class unless class is "". Referrers from siteHost (the site itself)
+// are left out of the top referrers.
+func GetAnalytics(r AnalyticsRange, class Class, siteHost string, now time.Time) (Analytics, error) {
+	a := Analytics{Range: r, Class: class}
+	if db == nil {
+		return a, fmt.Errorf("traffic database is not open")
+	}
+	now = now.UTC()
+	var start time.Time
+	if r.Hourly {
+		start = now.Truncate(time.Hour).Add(-time.Duration(r.Buckets-1) * time.Hour)
+	} else {
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -(r.Buckets - 1))
+	}
+	q := analyticsQuery{
+		since:    start.Format(time.RFC3339Nano),
+		sinceDay: start.Format(time.DateOnly),
+		hourly:   r.Hourly,
+	}
+	q.filter, q.args = classFilter(class)
+
+	var err error
+	if a.Series, a.Totals, err = q.series(start, r.Buckets); err != nil {
+		return a, err
+	}
+	if a.TopPages, err = q.topPages(); err != nil {
+		return a, err
+	}
+	if a.TopReferrers, err = q.topReferrers(siteHost); err != nil {
+		return a, err
+	}
+	if a.NotFound, err = q.notFound(); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+type analyticsQuery struct {
+	since    string // raw request timestamps
+	sinceDay string // rollup days
+	hourly   bool   // hourly ranges are too recent to have been rolled up
+	filter   string
+	args     []any
+}
+
+// rawArgs and rollupArgs are the arguments for a query's time bound followed
+// by its class filter.
+func (q analyticsQuery) rawArgs() []any    { return append([]any{q.since}, q.args...) }
+func (q analyticsQuery) rollupArgs() []any { return append([]any{q.sinceDay}, q.args...) }
+
+func (q analyticsQuery) series(start time.Time, n int) ([]SeriesPoint, SeriesPoint, error) {
+	points := make([]SeriesPoint, n)
+	index := map[string]int{}
+	keyFormat, bucketExpr := time.DateOnly, "substr(timestamp, 1, 10)"
+	if q.hourly {
+		// older rows may use a space rather than a T between date and time
+		keyFormat, bucketExpr = "2006-01-02T15", "replace(substr(timestamp, 1, 13), ' ', 'T')"
+	}
+	for i := range points {
+		if q.hourly {
+			points[i].Start = start.Add(time.Duration(i) * time.Hour)
+		} else {
+			points[i].Start = start.AddDate(0, 0, i)
+		}
+		index[points[i].Start.Format(keyFormat)] = i
+	}
+	add := func(key string, requests, uniques, errors int) {
+		if i, ok := index[key]; ok {
+			points[i].Requests += requests
+			points[i].Uniques += uniques
+			points[i].Errors += errors
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT `+bucketExpr+` AS bucket, COUNT(*), COUNT(DISTINCT COALESCE(visitor_hash, ip)), COALESCE(SUM(status >= 500), 0)
+		FROM requests
+		WHERE timestamp >= ?`+q.filter+`
+		GROUP BY bucket
+	`, q.rawArgs()...)
+	if err != nil {
+		return nil, SeriesPoint{}, err
+	}
+	err = scanRows(rows, func() error {
+		var key string
+		var requests, uniques, errors int
+		if err := rows.Scan(&key, &requests, &uniques, &errors); err != nil {
+			return err
+		}
+		add(key, requests, uniques, errors)
+		return nil
+	})
+	if err != nil {
+		return nil, SeriesPoint{}, err
+	}
+
+	if !q.hourly {
+		// daily_totals has exact uniques per day but no class; with a class
+		// filter the largest of the class's groups is the best lower bound
+		rows, err := db.Query(`
+			SELECT day, SUM(requests), MAX(unique_ips), SUM(CASE WHEN status >= 500 THEN requests ELSE 0 END)
+			FROM daily_requests
+			WHERE day >= ?`+q.filter+`
+			GROUP BY day
+		`, q.rollupArgs()...)
+		if err != nil {
+			return nil, SeriesPoint{}, err
+		}
+		rolledUp := map[string]bool{}
+		err = scanRows(rows, func() error {
+			var day string
+			var requests, uniques, errors int
+			if err := rows.Scan(&day, &requests, &uniques, &errors); err != nil {
+				return err
+			}
+			if q.filter != "" {
+				add(day, requests, uniques, errors)
+			} else {
+				add(day, requests, 0, errors)
+				rolledUp[day] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, SeriesPoint{}, err
+		}
+		if len(rolledUp) > 0 {
+			rows, err := db.Query("SELECT day, unique_ips FROM daily_totals WHERE day >= ?", q.sinceDay)
+			if err != nil {
+				return nil, SeriesPoint{}, err
+			}
+			err = scanRows(rows, func() error {
+				var day string
+				var uniques int
+				if err := rows.Scan(&day, &uniques); err != nil {
+					return err
+				}
+				if rolledUp[day] {
+					add(day, 0, uniques, 0)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, SeriesPoint{}, err
+			}
+		}
+	}
+
+	var totals SeriesPoint
+	for _, p := range points {
+		totals.Requests += p.Requests
+		totals.Errors += p.Errors
+	}
+	// a visitor seen in several buckets counts once over the range
+	if err := db.QueryRow(`
+		SELECT COUNT(DISTINCT COALESCE(visitor_hash, ip))
+		FROM requests
+		WHERE timestamp >= ?`+q.filter, q.rawArgs()...).Scan(&totals.Uniques); err != nil {
+		return nil, SeriesPoint{}, err
+	}
+	if !q.hourly {
+		var rolledUpUniques int
+		query := "SELECT COALESCE(SUM(unique_ips), 0) FROM daily_totals WHERE day >= ?"
+		args := []any{q.sinceDay}
+		if q.filter != "" {
+			query = "SELECT COALESCE(SUM(u), 0) FROM (SELECT MAX(unique_ips) AS u FROM daily_requests WHERE day >= ?" + q.filter + " GROUP BY day)"
+			args = q.rollupArgs()
+		}
+		if err := db.QueryRow(query, args...).Scan(&rolledUpUniques); err != nil {
+			return nil, SeriesPoint{}, err
+		}
+		totals.Uniques += rolledUpUniques
+	}
+	return points, totals, nil
+}
+
+// topPages ranks the paths that served pages (anything short of a 4xx or
+// 5xx) by requests.
+func (q analyticsQuery) topPages() ([]PageCount, error) {
+	pages := map[string]*PageCount{}
+	add := func(path string, requests, uniques int) {
+		p := pages[path]
+		if p == nil {
+			p = &PageCount{Path: path}
+			pages[path] = p
+		}
+		p.Requests += requests
+		p.Uniques += uniques
+	}
+	rows, err := db.Query(`
+		SELECT path, COUNT(*), COUNT(DISTINCT COALESCE(visitor_hash, ip))
+		FROM requests
+		WHERE timestamp >= ? AND (status IS NULL OR status < 400)`+q.filter+`
+		GROUP BY path
+	`, q.rawArgs()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := scanCounts(rows, add); err != nil {
+		return nil, err
+	}
+	if !q.hourly {
+		rows, err := db.Query(`
+			SELECT path, SUM(requests), SUM(unique_ips)
+			FROM daily_requests
+			WHERE day >= ? AND status < 400`+q.filter+`
+			GROUP BY path
+		`, q.rollupArgs()...)
+		if err != nil {
+			return nil, err
+		}
+		if err := scanCounts(rows, add); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]PageCount, 0, len(pages))
+	for _, p := range pages {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Path < result[j].Path
+	})
+	return truncate(result, analyticsTopShown), nil
+}
+
+// topReferrers ranks the hosts that sent visitors, leaving out the site's
+// own pages linking to each other.
+func (q analyticsQuery) topReferrers(siteHost string) ([]ReferrerCount, error) {
+	if h, _, err := net.SplitHostPort(siteHost); err == nil {
+		siteHost = h
+	}
+	siteHost = strings.TrimPrefix(strings.ToLower(siteHost), "www.")
+	hosts := map[string]int{}
+	add := func(host string, requests, _ int) {
+		if host != "" && host != siteHost {
+			hosts[host] += requests
+		}
+	}
+	rows, err := db.Query(`
+		SELECT referrer, COUNT(*), 0
+		FROM requests
+		WHERE timestamp >= ? AND referrer != ''`+q.filter+`
+		GROUP BY referrer
+	`, q.rawArgs()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := scanCounts(rows, func(referrer string, requests, _ int) {
+		add(referrerHost(referrer), requests, 0)
+	}); err != nil {
+		return nil, err
+	}
+	if !q.hourly {
+		rows, err := db.Query(`
+			SELECT referrer_host, SUM(requests), 0
+			FROM daily_requests
+			WHERE day >= ? AND referrer_host != ''`+q.filter+`
+			GROUP BY referrer_host
+		`, q.rollupArgs()...)
+		if err != nil {
+			return nil, err
+		}
+		if err := scanCounts(rows, add); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]ReferrerCount, 0, len(hosts))
+	for host, n := range hosts {
+		result = append(result, ReferrerCount{Host: host, Requests: n})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Host < result[j].Host
+	})
+	return truncate(result, analyticsTopShown), nil
+}
+
+// notFound lists the paths that got 404s, most requested first.
+func (q analyticsQuery) notFound() ([]NotFoundCount, error) {
+	paths := map[string]*NotFoundCount{}
+	add := func(path string, requests int, last time.Time) {
+		p := paths[path]
+		if p == nil {
+			p = &NotFoundCount{Path: path}
+			paths[path] = p
+		}
+		p.Requests += requests
+		if last.After(p.Last) {
+			p.Last = last
+		}
+	}
+	scan := func(rows *sql.Rows) error {
+		return scanRows(rows, func() error {
+			var path, last string
+			var requests int
+			if err := rows.Scan(&path, &requests, &last); err != nil {
+				return err
+			}
+			add(path, requests, parseNotFoundLast(last))
+			return nil
+		})
+	}
+	rows, err := db.Query(`
+		SELECT path, COUNT(*), MAX(timestamp)
+		FROM requests
+		WHERE timestamp >= ? AND status = 404`+q.filter+`
+		GROUP BY path
+	`, q.rawArgs()...)
+	if err != nil {
+		return nil, err
+	}
+	if err := scan(rows); err != nil {
+		return nil, err
+	}
+	if !q.hourly {
+		rows, err := db.Query(`
+			SELECT path, SUM(requests), MAX(day)
+			FROM daily_requests
+			WHERE day >= ? AND status = 404`+q.filter+`
+			GROUP BY path
+		`, q.rollupArgs()...)
+		if err != nil {
+			return nil, err
+		}
+		if err := scan(rows); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]NotFoundCount, 0, len(paths))
+	for _, p := range paths {
+		result = append(result, *p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Path < result[j].Path
+	})
+	return truncate(result, analyticsNotFoundShown), nil
+}
+
+// parseNotFoundLast reads a raw timestamp or a rollup's day.
+func parseNotFoundLast(s string) time.Time {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t
+	}
+	return parseTimestamp(s)
+}
+
+// scanRows calls scan for each row, then closes rows.
+func scanRows(rows *sql.Rows, scan func() error) error {
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanCounts reads rows of (key, count, count).
+func scanCounts(rows *sql.Rows, add func(key string, a, b int)) error {
+	return scanRows(rows, func() error {
+		var key string
+		var a, b int
+		if err := rows.Scan(&key, &a, &b); err != nil {
+			return err
+		}
+		add(key, a, b)
+		return nil
+	})
+}
+
+func truncate[T any](s []T, n int) []T {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+type AnalyticsPageData struct {
+	CurrentYear int
+	Analytics
+	Ranges  []AnalyticsRange
+	Classes []Class
+	Charts  []Chart
+}
+
+// AnalyticsPageHandler renders the analytics dashboard for ?range= (24h, 7d,
+// 30d or 1y; 7d by default), limited to ?class= if it names a traffic class.
+func AnalyticsPageHandler(c echo.Context) error {
+	r := ParseAnalyticsRange(c.QueryParam("range"))
+	class, _ := ParseClass(c.QueryParam("class"))
+	a, err := GetAnalytics(r, class, c.Request().Host, time.Now())
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load analytics")
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to load analytics")
+	}
+	return c.Render(http.StatusOK, "analyticspage", NewAnalyticsPageData(a))
+}
+
+// NewAnalyticsPageData lays out a for the analytics page, drawing its
+// charts.
+func NewAnalyticsPageData(a Analytics) AnalyticsPageData {
+	return AnalyticsPageData{
+		CurrentYear: time.Now().Year(),
+		Analytics:   a,
+		Ranges:      AnalyticsRanges,
+		Classes:     Classes,
+		Charts:      seriesCharts(a.Series, a.Totals, a.Range.Hourly),
+	}
+}
@@ -0,0 +1,100 @@
+package traffic
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func seedAnalytics(t *testing.T, now time.Time) {
+	t.Helper()
+	insert := func(at time.Time, path, ip, referrer string, status int, class Class) {
+		_, err := db.Exec(
+			"INSERT INTO requests (path, ip, user_agent, referrer, timestamp, status, class) VALUES (?, ?, '', ?, ?, ?, ?)",
+			path, ip, referrer, at.UTC().Format(time.RFC3339Nano), status, class,
+		)
+		require.NoError(t, err)
+	}
+	today := now.Add(-time.Hour)
+	insert(today, "/", "192.0.2.1", "https://www.google.com/search?q=fiddle", 200, ClassHuman)
+	insert(today, "/", "192.0.2.1", "", 200, ClassHuman)
+	insert(today, "/", "192.0.2.2", "", 200, ClassHuman)
+	insert(today, "/missing", "192.0.2.3", "", 404, ClassScanner)
+	insert(today, "/blog", "192.0.2.4", "", 500, ClassCrawler)
+	insert(now.AddDate(0, 0, -2), "/", "192.0.2.5", "https://andrewwillette.com/blog", 200, ClassHuman)
+	insert(now.AddDate(0, 0, -10), "/", "192.0.2.6", "", 200, ClassHuman)
+
+	rolledUp := now.AddDate(0, 0, -5).Format(time.DateOnly)
+	_, err := db.Exec(`INSERT INTO daily_requests (day, path, referrer_host, status, class, requests, unique_ips) VALUES
+		(?, '/', 'news.ycombinator.com', 200, 'human', 10, 8),
+		(?, '/missing', '', 404, 'scanner', 4, 1)`, rolledUp, rolledUp)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO daily_totals (day, requests, unique_ips) VALUES (?, 14, 9)", rolledUp)
+	require.NoError(t, err)
+}
+
+func TestGetAnalyticsWeek(t *testing.T) {
+	openTestDB(t)
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	seedAnalytics(t, now)
+
+	a, err := GetAnalytics(ParseAnalyticsRange("7d"), "", "andrewwillette.com", now)
+	require.NoError(t, err)
+	require.Len(t, a.Series, 7)
+	require.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), a.Series[0].Start)
+	require.Equal(t, SeriesPoint{Start: time.Date(2026, 10, 13, 0, 0, 0, 0, time.UTC), Requests: 14, Uniques: 9}, a.Series[1], "rolled-up day")
+	require.Equal(t, 1, a.Series[4].Requests)
+	require.Equal(t, SeriesPoint{Start: time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), Requests: 5, Uniques: 4, Errors: 1}, a.Series[6])
+	require.Equal(t, SeriesPoint{Requests: 20, Uniques: 5 + 9, Errors: 1}, a.Totals)
+
+	require.Equal(t, []PageCount{{Path: "/", Requests: 14, Uniques: 11}}, a.TopPages)
+	require.Equal(t, []ReferrerCount{{"news.ycombinator.com", 10}, {"google.com", 1}}, a.TopReferrers, "the site's own pages aren't referrers")
+	require.Len(t, a.NotFound, 1)
+	require.Equal(t, "/missing", a.NotFound[0].Path)
+	require.Equal(t, 5, a.NotFound[0].Requests)
+	require.Equal(t, now.Add(-time.Hour), a.NotFound[0].Last)
+}
+
+func TestGetAnalyticsByClass(t *testing.T) {
+	openTestDB(t)
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	seedAnalytics(t, now)
+
+	a, err := GetAnalytics(ParseAnalyticsRange("7d"), ClassScanner, "andrewwillette.com", now)
+	require.NoError(t, err)
+	require.Equal(t, SeriesPoint{Requests: 5, Uniques: 2}, a.Totals)
+	require.Empty(t, a.TopPages)
+	require.Equal(t, 5, a.NotFound[0].Requests)
+
+	a, err = GetAnalytics(ParseAnalyticsRange("7d"), ClassHuman, "andrewwillette.com", now)
+	require.NoError(t, err)
+	require.Equal(t, 4+10, a.Totals.Requests)
+	require.Empty(t, a.NotFound)
+}
+
+func TestGetAnalyticsDay(t *testing.T) {
+	openTestDB(t)
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	seedAnalytics(t, now)
+
+	a, err := GetAnalytics(ParseAnalyticsRange("24h"), "", "andrewwillette.com", now)
+	require.NoError(t, err)
+	require.Len(t, a.Series, 24)
+	require.Equal(t, time.Date(2026, 10, 17, 13, 0, 0, 0, time.UTC), a.Series[0].Start)
+	require.Equal(t, 5, a.Series[22].Requests)
+	require.Equal(t, SeriesPoint{Requests: 5, Uniques: 4, Errors: 1}, a.Totals, "rollups are older than a day")
+	require.Equal(t, []ReferrerCount{{"google.com", 1}}, a.TopReferrers)
+}
+
+func TestBarChart(t *testing.T) {
+	start := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	series := []SeriesPoint{{Start: start, Requests: 3}, {Start: start.Add(time.Hour), Requests: 6}, {Start: start.Add(2 * time.Hour)}}
+	svg := string(barChart(series, true, func(p SeriesPoint) int { return p.Requests }))
+	require.True(t, strings.HasPrefix(svg, "<svg"))
+	require.Equal(t, 3, strings.Count(svg, `<rect class="bar"`))
+	require.Contains(t, svg, "<title>Oct 18 01:00: 6</title>")
+	require.Contains(t, svg, `height="140.00"`, "the tallest bar fills the plot")
+	require.Contains(t, svg, ">02:00</text>")
+}
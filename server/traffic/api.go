@@ -0,0 +1,471 @@
+package traffic
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Page sizes for the JSON API's list endpoints.
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+// apiDefaultWindow is how far back the API looks when no from is given.
+const apiDefaultWindow = 24 * time.Hour
+
+// RequestRecord is a tracked request as the JSON API (and exports) present
+// it.
+type RequestRecord struct {
+	ID          int64     `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path"`
+	Route       string    `json:"route,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Bytes       int64     `json:"bytes,omitempty"`
+	LatencyUS   int64     `json:"latency_us,omitempty"`
+	IP          string    `json:"ip"`
+	VisitorHash string    `json:"visitor_hash,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Referrer    string    `json:"referrer,omitempty"`
+	Class       Class     `json:"class,omitempty"`
+	Proto       string    `json:"proto,omitempty"`
+	TLSVersion  string    `json:"tls_version,omitempty"`
+}
+
+// SuspiciousRecord is a suspicious request as the JSON API presents it.
+type SuspiciousRecord struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	IP        string    `json:"ip"`
+	Path      string    `json:"path"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// Page is one page of a list endpoint. NextCursor fetches the next (older)
+// page and is empty on the last one. It carries the first page's time
+// window, so paging through "the last day" doesn't drift as time passes.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// RequestFilter narrows the requests the API lists. From is inclusive and
+// To exclusive; Path matches exactly, or as a prefix if it ends in "*".
+type RequestFilter struct {
+	From  time.Time
+	To    time.Time
+	Path  string
+	IP    string
+	Class Class
+}
+
+// Summary is the headline numbers for a window.
+type Summary struct {
+	From            time.Time      `json:"from"`
+	To              time.Time      `json:"to"`
+	Class           Class          `json:"class,omitempty"`
+	Requests        int            `json:"requests"`
+	UniqueVisitors  int            `json:"unique_visitors"`
+	StatusClasses   map[string]int `json:"status_classes"`
+	Classes         map[Class]int  `json:"classes"`
+	Suspicious      int            `json:"suspicious_requests"`
+	FailedAuths     int            `json:"failed_auths"`
+	TotalTracked    int            `json:"total_tracked"`
+	DroppedRequests uint64         `json:"dropped_requests"`
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+// pageCursor is where the next page starts: after the last item returned,
+// in the same window. Pages are ordered by timestamp then ID, since imported
+// rows get IDs newer than their timestamps, so the cursor carries both, with
+// the timestamp as stored. It's sent to clients as opaque base64 so the
+// paging scheme can change.
+type pageCursor struct {
+	Timestamp string    `json:"ts"`
+	ID        int64     `json:"id"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+}
+
+func encodeCursor(c pageCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (pageCursor, error) {
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, errBadCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil || c.ID <= 0 || c.Timestamp == "" {
+		return c, errBadCursor
+	}
+	return c, nil
+}
+
+// timeWindow builds the WHERE conditions for [from, to); a zero time leaves
+// that end open.
+func timeWindow(from, to time.Time) (string, []any) {
+	where := "1 = 1"
+	var args []any
+	if !from.IsZero() {
+		where += " AND timestamp >= ?"
+		args = append(args, from.UTC().Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		where += " AND timestamp < ?"
+		args = append(args, to.UTC().Format(time.RFC3339Nano))
+	}
+	return where, args
+}
+
+// pageWindow resolves the window a list query covers: from and to on the
+// first page, the cursor's on later ones, whatever the request says. after
+// is the zero cursor on the first page.
+func pageWindow(from, to time.Time, cursor string) (pageFrom, pageTo time.Time, after pageCursor, err error) {
+	if cursor == "" {
+		return from, to, after, nil
+	}
+	after, err = decodeCursor(cursor)
+	if err != nil {
+		return from, to, after, err
+	}
+	return after.From, after.To, after, nil
+}
+
+// keyset adds the cursor condition and page limit to a query listing rows
+// newest first. It fetches one extra row to learn whether there's another
+// page.
+func keyset(where string, args []any, after pageCursor, limit int) (string, []any) {
+	if after.ID > 0 {
+		where += " AND (timestamp < ? OR (timestamp = ? AND id < ?))"
+		args = append(args, after.Timestamp, after.Timestamp, after.ID)
+	}
+	return where + " ORDER BY timestamp DESC, id DESC LIMIT ?", append(args, limit+1)
+}
+
+// QueryRequests lists tracked requests matching f, newest first, limit at a
+// time. Pages after the first keep the first page's window.
+func QueryRequests(f RequestFilter, cursor string, limit int) (Page[RequestRecord], error) {
+	page := Page[RequestRecord]{Items: []RequestRecord{}}
+	if db == nil {
+		return page, errors.New("traffic database is not open")
+	}
+	var after pageCursor
+	var err error
+	if f.From, f.To, after, err = pageWindow(f.From, f.To, cursor); err != nil {
+		return page, err
+	}
+	where, args := timeWindow(f.From, f.To)
+	if strings.HasSuffix(f.Path, "*") {
+		// escape LIKE's wildcards so only the trailing * is one
+		prefix := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.TrimSuffix(f.Path, "*"))
+		where += ` AND path LIKE ? ESCAPE '\'`
+		args = append(args, prefix+"%")
+	} else if f.Path != "" {
+		where += " AND path = ?"
+		args = append(args, f.Path)
+	}
+	if f.IP != "" {
+		where += " AND ip = ?"
+		args = append(args, f.IP)
+	}
+	filter, classArgs := classFilter(f.Class)
+	where += filter
+	args = append(args, classArgs...)
+	where, args = keyset(where, args, after, limit)
+
+	rows, err := db.Query(`
+		SELECT id, timestamp, method, path, route, status, bytes, latency_us, ip, visitor_hash,
+			user_agent, referrer, class, proto, tls_version
+		FROM requests WHERE `+where, args...)
+	if err != nil {
+		return page, err
+	}
+	var timestamps []string
+	err = scanRows(rows, func() error {
+		r, timestamp, err := scanRequestRecord(rows)
+		if err != nil {
+			return err
+		}
+		page.Items = append(page.Items, r)
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil {
+		return page, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = encodeCursor(pageCursor{Timestamp: timestamps[limit-1], ID: page.Items[limit-1].ID, From: f.From, To: f.To})
+	}
+	return page, nil
+}
+
+// scanRequestRecord reads the columns QueryRequests selects, also returning
+// the timestamp as stored for the page cursor.
+func scanRequestRecord(rows *sql.Rows) (RequestRecord, string, error) {
+	var r RequestRecord
+	var timestamp string
+	var method, route, visitorHash, userAgent, referrer, class, proto, tlsVersion sql.NullString
+	var status, bytes, latencyUS sql.NullInt64
+	if err := rows.Scan(&r.ID, &timestamp, &method, &r.Path, &route, &status, &bytes, &latencyUS, &r.IP, &visitorHash,
+		&userAgent, &referrer, &class, &proto, &tlsVersion); err != nil {
+		return r, "", err
+	}
+	r.Timestamp = parseTimestamp(timestamp)
+	r.Method = method.String
+	r.Route = route.String
+	r.Status = int(status.Int64)
+	r.Bytes = bytes.Int64
+	r.LatencyUS = latencyUS.Int64
+	r.VisitorHash = visitorHash.String
+	r.UserAgent = userAgent.String
+	r.Referrer = referrer.String
+	r.Class = Class(class.String)
+	r.Proto = proto.String
+	r.TLSVersion = tlsVersion.String
+	return r, timestamp, nil
+}
+
+// QuerySuspicious lists suspicious requests in [from, to), optionally from
+// one IP, newest first, limit at a time. Pages after the first keep the
+// first page's window.
+func QuerySuspicious(from, to time.Time, ip, cursor string, limit int) (Page[SuspiciousRecord], error) {
+	page := Page[SuspiciousRecord]{Items: []SuspiciousRecord{}}
+	if db == nil {
+		return page, errors.New("traffic database is not open")
+	}
+	from, to, after, err := pageWindow(from, to, cursor)
+	if err != nil {
+		return page, err
+	}
+	where, args := timeWindow(from, to)
+	if ip != "" {
+		where += " AND ip = ?"
+		args = append(args, ip)
+	}
+	where, args = keyset(where, args, after, limit)
+	rows, err := db.Query("SELECT id, timestamp, ip, path, user_agent FROM suspicious_requests WHERE "+where, args...)
+	if err != nil {
+		return page, err
+	}
+	var timestamps []string
+	err = scanRows(rows, func() error {
+		var r SuspiciousRecord
+		var timestamp string
+		var userAgent sql.NullString
+		if err := rows.Scan(&r.ID, &timestamp, &r.IP, &r.Path, &userAgent); err != nil {
+			return err
+		}
+		r.Timestamp = parseTimestamp(timestamp)
+		r.UserAgent = userAgent.String
+		page.Items = append(page.Items, r)
+		timestamps = append(timestamps, timestamp)
+		return nil
+	})
+	if err != nil {
+		return page, err
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.NextCursor = encodeCursor(pageCursor{Timestamp: timestamps[limit-1], ID: page.Items[limit-1].ID, From: from, To: to})
+	}
+	return page, nil
+}
+
+// GetSummary counts the traffic in [from, to), limited to one class unless
+// class is "". The security counts and totals ignore class.
+func GetSummary(from, to time.Time, class Class) (Summary, error) {
+	s := Summary{From: from, To: to, Class: class, StatusClasses: map[string]int{}, Classes: map[Class]int{}}
+	if db == nil {
+		return s, errors.New("traffic database is not open")
+	}
+	window, windowArgs := timeWindow(from, to)
+	filter, classArgs := classFilter(class)
+	args := append(append([]any{}, windowArgs...), classArgs...)
+
+	if err := db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT COALESCE(visitor_hash, ip)) FROM requests WHERE "+window+filter, args...).
+		Scan(&s.Requests, &s.UniqueVisitors); err != nil {
+		return s, err
+	}
+	rows, err := db.Query("SELECT status / 100 AS status_class, COUNT(*) FROM requests WHERE "+window+filter+" AND status > 0 GROUP BY status_class", args...)
+	if err != nil {
+		return s, err
+	}
+	if err := scanRows(rows, func() error {
+		var statusClass, n int
+		if err := rows.Scan(&statusClass, &n); err != nil {
+			return err
+		}
+		s.StatusClasses[fmt.Sprintf("%dxx", statusClass)] = n
+		return nil
+	}); err != nil {
+		return s, err
+	}
+	rows, err = db.Query("SELECT class, COUNT(*) FROM requests WHERE "+window+filter+" AND class IS NOT NULL GROUP BY class", args...)
+	if err != nil {
+		return s, err
+	}
+	if err := scanRows(rows, func() error {
+		var class string
+		var n int
+		if err := rows.Scan(&class, &n); err != nil {
+			return err
+		}
+		s.Classes[Class(class)] = n
+		return nil
+	}); err != nil {
+		return s, err
+	}
+	for table, n := range map[string]*int{"suspicious_requests": &s.Suspicious, "failed_auths": &s.FailedAuths} {
+		if err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE "+window, windowArgs...).Scan(n); err != nil {
+			return s, err
+		}
+	}
+	s.TotalTracked = getTotalRequestCount("")
+	s.DroppedRequests = DroppedRequests()
+	return s, nil
+}
+
+// apiError is the JSON body the API answers errors with.
+func apiError(c echo.Context, code int, msg string) error {
+	return c.JSON(code, map[string]string{"error": msg})
+}
+
+// parseAPITime reads an RFC 3339 time or a YYYY-MM-DD date (midnight UTC).
+func parseAPITime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time or YYYY-MM-DD date", s)
+}
+
+// apiWindow reads ?from= and ?to=; from defaults to a day ago and to to
+// now.
+func apiWindow(c echo.Context) (from, to time.Time, err error) {
+	to = time.Now().UTC()
+	if s := c.QueryParam("to"); s != "" {
+		if to, err = parseAPITime(s); err != nil {
+			return from, to, fmt.Errorf("to: %w", err)
+		}
+	}
+	from = to.Add(-apiDefaultWindow)
+	if s := c.QueryParam("from"); s != "" {
+		if from, err = parseAPITime(s); err != nil {
+			return from, to, fmt.Errorf("from: %w", err)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+func apiLimit(c echo.Context) (int, error) {
+	s := c.QueryParam("limit")
+	if s == "" {
+		return apiDefaultLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > apiMaxLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+	}
+	return n, nil
+}
+
+func apiClass(c echo.Context) (Class, error) {
+	s := c.QueryParam("class")
+	if s == "" {
+		return "", nil
+	}
+	class, ok := ParseClass(s)
+	if !ok {
+		return "", fmt.Errorf("unknown class %q", s)
+	}
+	return class, nil
+}
+
+// APISummaryHandler serves GET /admin/api/traffic/summary?from=&to=&class=.
+func APISummaryHandler(c echo.Context) error {
+	from, to, err := apiWindow(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	class, err := apiClass(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	s, err := GetSummary(from, to, class)
+	if err != nil {
+		log.Error().Err(err).Msg("traffic api: summary failed")
+		return apiError(c, http.StatusInternalServerError, "summary failed")
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+// APIRequestsHandler serves GET
+// /admin/api/traffic/requests?from=&to=&path=&ip=&class=&limit=&cursor=.
+func APIRequestsHandler(c echo.Context) error {
+	from, to, err := apiWindow(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	class, err := apiClass(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	limit, err := apiLimit(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	f := RequestFilter{From: from, To: to, Path: c.QueryParam("path"), IP: c.QueryParam("ip"), Class: class}
+	page, err := QueryRequests(f, c.QueryParam("cursor"), limit)
+	if errors.Is(err, errBadCursor) {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("traffic api: listing requests failed")
+		return apiError(c, http.StatusInternalServerError, "listing requests failed")
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// APISuspiciousHandler serves GET
+// /admin/api/traffic/suspicious?from=&to=&ip=&limit=&cursor=.
+func APISuspiciousHandler(c echo.Context) error {
+	from, to, err := apiWindow(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	limit, err := apiLimit(c)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	page, err := QuerySuspicious(from, to, c.QueryParam("ip"), c.QueryParam("cursor"), limit)
+	if errors.Is(err, errBadCursor) {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("traffic api: listing suspicious requests failed")
+		return apiError(c, http.StatusInternalServerError, "listing suspicious requests failed")
+	}
+	return c.JSON(http.StatusOK, page)
+}
@@ -0,0 +1,154 @@
+package traffic
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryRequestsPaginates(t *testing.T) {
+	openTestDB(t)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		insertRequestAt(t, now.Add(time.Duration(i)*time.Minute).Format(time.RFC3339Nano), "/blog/post", "192.0.2.1", "", 200)
+	}
+	insertRequestAt(t, now.Format(time.RFC3339Nano), "/music", "192.0.2.2", "", 200)
+	insertRequestAt(t, now.Add(-48*time.Hour).Format(time.RFC3339Nano), "/blog/old", "192.0.2.1", "", 200)
+
+	f := RequestFilter{From: now.Add(-time.Hour), To: now.Add(time.Hour), Path: "/blog/*"}
+	var seen []int64
+	cursor := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		page, err := QueryRequests(f, cursor, 2)
+		require.NoError(t, err)
+		for _, r := range page.Items {
+			require.Equal(t, "/blog/post", r.Path)
+			seen = append(seen, r.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	require.Equal(t, []int64{5, 4, 3, 2, 1}, seen, "newest first, each request once")
+
+	// a client that leaves out to gets a later one on each page; the cursor
+	// keeps the first page's window so rows don't fall off its start
+	first, err := QueryRequests(f, "", 2)
+	require.NoError(t, err)
+	drifted := f
+	drifted.From = now.Add(3 * time.Minute)
+	second, err := QueryRequests(drifted, first.NextCursor, 10)
+	require.NoError(t, err)
+	require.Len(t, second.Items, 3)
+	require.Equal(t, int64(1), second.Items[2].ID)
+
+	page, err := QueryRequests(RequestFilter{From: now.Add(-time.Hour), IP: "192.0.2.2"}, "", 10)
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	require.Equal(t, "/music", page.Items[0].Path)
+	require.Equal(t, now, page.Items[0].Timestamp)
+
+	_, err = QueryRequests(f, "not-a-cursor", 2)
+	require.ErrorIs(t, err, errBadCursor)
+}
+
+func TestQueryRequestsPagesImportedRowsByTime(t *testing.T) {
+	openTestDB(t)
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		insertRequestAt(t, now.Add(time.Duration(i)*time.Hour).Format(time.RFC3339Nano), "/live", "192.0.2.1", "", 200)
+	}
+	// merged in from an old database afterwards: older rows, newer IDs
+	var csv strings.Builder
+	csv.WriteString("timestamp,ip,path\n")
+	for i := range 3 {
+		csv.WriteString(now.Add(time.Duration(i)*time.Hour-30*time.Minute).Format(time.RFC3339Nano) + ",192.0.2.2,/imported\n")
+	}
+	_, err := ImportTable(strings.NewReader(csv.String()), "requests", FormatCSV)
+	require.NoError(t, err)
+
+	var seen []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 4)
+		page, err := QueryRequests(RequestFilter{From: now.Add(-time.Hour)}, cursor, 2)
+		require.NoError(t, err)
+		for _, r := range page.Items {
+			seen = append(seen, r.Timestamp.Format("15:04")+" "+r.Path)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	require.Equal(t, []string{"14:00 /live", "13:30 /imported", "13:00 /live", "12:30 /imported", "12:00 /live", "11:30 /imported"}, seen)
+}
+
+func TestGetSummary(t *testing.T) {
+	openTestDB(t)
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.UTC)
+	seedAnalytics(t, now)
+
+	s, err := GetSummary(now.Add(-24*time.Hour), now, "")
+	require.NoError(t, err)
+	require.Equal(t, 5, s.Requests)
+	require.Equal(t, 4, s.UniqueVisitors)
+	require.Equal(t, map[string]int{"2xx": 3, "4xx": 1, "5xx": 1}, s.StatusClasses)
+	require.Equal(t, map[Class]int{ClassHuman: 3, ClassScanner: 1, ClassCrawler: 1}, s.Classes)
+	require.Equal(t, 7, s.TotalTracked)
+
+	s, err = GetSummary(now.Add(-24*time.Hour), now, ClassHuman)
+	require.NoError(t, err)
+	require.Equal(t, 3, s.Requests)
+	require.Equal(t, map[string]int{"2xx": 3}, s.StatusClasses)
+}
+
+func TestAPIHandlers(t *testing.T) {
+	openTestDB(t)
+	now := time.Now().UTC()
+	insertRequestAt(t, now.Add(-time.Minute).Format(time.RFC3339Nano), "/", "192.0.2.1", "", 200)
+	_, err := db.Exec("INSERT INTO suspicious_requests (path, ip, user_agent, timestamp) VALUES ('/.env', '192.0.2.9', 'curl', ?)",
+		now.Add(-time.Minute).Format(time.RFC3339Nano))
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.GET("/summary", APISummaryHandler)
+	e.GET("/requests", APIRequestsHandler)
+	e.GET("/suspicious", APISuspiciousHandler)
+	call := func(target string, body any) int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if body != nil {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), body))
+		}
+		return rec.Code
+	}
+
+	var summary Summary
+	require.Equal(t, http.StatusOK, call("/summary", &summary))
+	require.Equal(t, 1, summary.Requests)
+	require.Equal(t, 1, summary.Suspicious)
+
+	var requests Page[RequestRecord]
+	require.Equal(t, http.StatusOK, call("/requests?path=/&from="+now.Format(time.DateOnly), &requests))
+	require.Len(t, requests.Items, 1)
+	require.Empty(t, requests.NextCursor)
+
+	var suspicious Page[SuspiciousRecord]
+	require.Equal(t, http.StatusOK, call("/suspicious?ip=192.0.2.9", &suspicious))
+	require.Equal(t, []SuspiciousRecord{{ID: 1, Timestamp: suspicious.Items[0].Timestamp, IP: "192.0.2.9", Path: "/.env", UserAgent: "curl"}}, suspicious.Items)
+
+	for _, target := range []string{"/requests?from=yesterday", "/requests?limit=0", "/requests?cursor=%21", "/summary?class=robot", "/suspicious?from=2026-10-18&to=2026-10-17"} {
+		var body map[string]string
+		require.Equal(t, http.StatusBadRequest, call(target, &body), target)
+		require.NotEmpty(t, body["error"], target)
+	}
+}
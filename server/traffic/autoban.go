@@ -0,0 +1,181 @@
+package traffic
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+// BlockSourceAutoban is the bad_ips source for bans added by the autoban
+// rules.
+const BlockSourceAutoban = "autoban"
+
+// Autoban rule names, recorded with each ban decision.
+const (
+	RuleSuspiciousPaths = "suspicious_paths"
+	RuleFailedAuths     = "failed_auths"
+)
+
+// Defaults for the AUTOBAN_* settings left unset (0).
+const (
+	defaultAutobanSuspiciousLimit = 10
+	defaultAutobanFailedAuthLimit = 5
+	defaultAutobanWindow          = 10 * time.Minute
+	defaultAutobanDuration        = 24 * time.Hour
+)
+
+// autobanThreatLevel is recorded with automatic bans; manual entries default
+// to 1.
+const autobanThreatLevel = 2
+
+// BanDecision is one automatic ban: which rule fired, on how many hits in
+// what window, and until when the IP is blocked.
+type BanDecision struct {
+	IP          string
+	Rule        string
+	Hits        int
+	Window      time.Duration
+	DecidedAt   time.Time
+	BannedUntil time.Time
+}
+
+// autobanSettings resolves the configured limits. A negative limit turns
+// that rule off.
+func autobanSettings() (suspicious, failedAuths int, window, duration time.Duration) {
+	suspicious = config.C.AutobanSuspiciousLimit
+	if suspicious == 0 {
+		suspicious = defaultAutobanSuspiciousLimit
+	}
+	failedAuths = config.C.AutobanFailedAuthLimit
+	if failedAuths == 0 {
+		failedAuths = defaultAutobanFailedAuthLimit
+	}
+	window = defaultAutobanWindow
+	if config.C.AutobanWindowMinutes > 0 {
+		window = time.Duration(config.C.AutobanWindowMinutes) * time.Minute
+	}
+	duration = defaultAutobanDuration
+	if config.C.AutobanDurationHours > 0 {
+		duration = time.Duration(config.C.AutobanDurationHours) * time.Hour
+	}
+	return suspicious, failedAuths, window, duration
+}
+
+// checkAutoban bans ip if it has hit the rule's limit within the window. It
+// runs after each suspicious request or failed auth is recorded.
+func checkAutoban(ip, rule string) {
+	if db == nil || ip == "" {
+		return
+	}
+	suspiciousLimit, failedAuthLimit, window, duration := autobanSettings()
+	var limit int
+	var table, filter string
+	switch rule {
+	case RuleSuspiciousPaths:
+		// misses under /admin are recorded but never count; see isAdminPath
+		limit, table = suspiciousLimit, "suspicious_requests"
+		filter = " AND path != '/admin' AND path NOT LIKE '/admin/%'"
+	case RuleFailedAuths:
+		limit, table = failedAuthLimit, "failed_auths"
+	default:
+		return
+	}
+	if limit < 0 {
+		return
+	}
+
+	since := time.Now().UTC().Add(-window).Format(time.RFC3339Nano)
+	var hits int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE ip = ? AND timestamp >= ?%s", table, filter), ip, since).Scan(&hits)
+	if err != nil {
+		log.Error().Err(err).Msg("autoban: failed to count hits")
+		return
+	}
+	if hits < limit {
+		return
+	}
+	d := BanDecision{IP: ip, Rule: rule, Hits: hits, Window: window, DecidedAt: time.Now().UTC()}
+	d.BannedUntil = d.DecidedAt.Add(duration)
+	if err := ban(d); err != nil {
+		log.Error().Err(err).Msgf("autoban: failed to ban %s", ip)
+	}
+}
+
+// ban records the decision and adds the temporary bad_ips entry. An IP that
+// is already permanently listed is left as it is.
+func ban(d BanDecision) error {
+	entry, err := normalizeBlockEntry(d.IP)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		INSERT INTO bad_ips (ip, source, threat_level, added_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(ip) DO UPDATE SET expires_at = excluded.expires_at
+		WHERE bad_ips.expires_at IS NOT NULL`,
+		entry, BlockSourceAutoban, autobanThreatLevel,
+		d.DecidedAt.Format(time.RFC3339Nano), d.BannedUntil.Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO ban_decisions (ip, rule, hits, window_seconds, decided_at, banned_until) VALUES (?, ?, ?, ?, ?, ?)",
+		entry, d.Rule, d.Hits, int(d.Window.Seconds()),
+		d.DecidedAt.Format(time.RFC3339Nano), d.BannedUntil.Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Warn().
+		Str("ip", entry).
+		Str("rule", d.Rule).
+		Int("hits", d.Hits).
+		Dur("window", d.Window).
+		Time("banned_until", d.BannedUntil).
+		Msg("autoban: banned IP")
+	return ReloadBlocklist()
+}
+
+// GetBanDecisions returns the most recent automatic bans, newest first.
+func GetBanDecisions(limit int) []BanDecision {
+	if db == nil {
+		return nil
+	}
+	rows, err := db.Query(`
+		SELECT ip, rule, hits, window_seconds, decided_at, banned_until
+		FROM ban_decisions
+		ORDER BY decided_at DESC, id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query ban decisions")
+		return nil
+	}
+	defer rows.Close()
+
+	var results []BanDecision
+	for rows.Next() {
+		var d BanDecision
+		var windowSeconds int
+		var decidedStr, untilStr string
+		if err := rows.Scan(&d.IP, &d.Rule, &d.Hits, &windowSeconds, &decidedStr, &untilStr); err != nil {
+			log.Error().Err(err).Msg("failed to scan ban decision row")
+			continue
+		}
+		d.Window = time.Duration(windowSeconds) * time.Second
+		d.DecidedAt = parseTimestamp(decidedStr)
+		d.BannedUntil = parseTimestamp(untilStr)
+		results = append(results, d)
+	}
+	return results
+}
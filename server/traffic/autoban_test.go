@@ -0,0 +1,134 @@
+package traffic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func setAutobanConfig(t *testing.T, suspicious, failedAuths int) {
+	t.Helper()
+	prev := config.C
+	config.C.AutobanSuspiciousLimit = suspicious
+	config.C.AutobanFailedAuthLimit = failedAuths
+	config.C.AutobanWindowMinutes = 10
+	config.C.AutobanDurationHours = 1
+	config.C.AdminPassword = "secret"
+	t.Cleanup(func() { config.C = prev })
+}
+
+func newTrackedEcho() *echo.Echo {
+	e := echo.New()
+	e.Pre(BlocklistMiddleware)
+	e.Use(TrackingMiddleware)
+	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "home") })
+	e.GET("/admin/traffic", func(c echo.Context) error { return c.String(http.StatusOK, "admin") }, BasicAuthMiddleware())
+	return e
+}
+
+func get(e *echo.Echo, ip, path string, auth ...string) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = ip + ":1234"
+	if len(auth) == 2 {
+		req.SetBasicAuth(auth[0], auth[1])
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAutobanSuspiciousPaths(t *testing.T) {
+	openTestDB(t)
+	setAutobanConfig(t, 3, -1)
+	e := newTrackedEcho()
+
+	require.Equal(t, http.StatusNotFound, get(e, "203.0.113.5", "/wp-login.php"))
+	require.Equal(t, http.StatusNotFound, get(e, "203.0.113.5", "/.env"))
+	require.Equal(t, http.StatusOK, get(e, "203.0.113.5", "/"))
+	require.False(t, IsBlocked("203.0.113.5"))
+	require.Equal(t, http.StatusNotFound, get(e, "203.0.113.5", "/phpmyadmin"))
+	require.True(t, IsBlocked("203.0.113.5"))
+	require.Equal(t, http.StatusForbidden, get(e, "203.0.113.5", "/"))
+	require.Equal(t, http.StatusOK, get(e, "192.0.2.1", "/"), "other IPs are unaffected")
+
+	decisions := GetBanDecisions(10)
+	require.Len(t, decisions, 1)
+	d := decisions[0]
+	require.Equal(t, "203.0.113.5", d.IP)
+	require.Equal(t, RuleSuspiciousPaths, d.Rule)
+	require.Equal(t, 3, d.Hits)
+	require.Equal(t, 10*time.Minute, d.Window)
+	require.WithinDuration(t, time.Now().Add(time.Hour), d.BannedUntil, time.Minute)
+
+	entries, err := ListBlocks()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, BlockSourceAutoban, entries[0].Source)
+	require.False(t, entries[0].ExpiresAt.IsZero())
+}
+
+func TestAutobanIgnoresRoutedAdminPages(t *testing.T) {
+	openTestDB(t)
+	setAutobanConfig(t, 2, -1)
+	e := newTrackedEcho()
+	for i := 0; i < 5; i++ {
+		require.Equal(t, http.StatusOK, get(e, "192.0.2.10", "/admin/traffic", "admin", "secret"))
+	}
+	require.False(t, IsBlocked("192.0.2.10"))
+	require.Empty(t, GetSuspiciousSummary())
+}
+
+func TestAutobanIgnoresAdminTypos(t *testing.T) {
+	openTestDB(t)
+	setAutobanConfig(t, 2, -1)
+	e := newTrackedEcho()
+	for _, path := range []string{"/admin/analytic", "/admin/api/traffic/summry", "/admin", "/admin/analytic"} {
+		require.Equal(t, http.StatusNotFound, get(e, "192.0.2.10", path, "admin", "secret"), path)
+	}
+	require.False(t, IsBlocked("192.0.2.10"))
+	require.NotEmpty(t, GetSuspiciousSummary(), "they're still recorded")
+
+	require.Equal(t, http.StatusNotFound, get(e, "192.0.2.10", "/api/v1/users"))
+	require.Equal(t, http.StatusNotFound, get(e, "192.0.2.10", "/wp-admin"))
+	require.True(t, IsBlocked("192.0.2.10"), "probes outside /admin still count")
+	require.Equal(t, 2, GetBanDecisions(10)[0].Hits, "the /admin misses aren't among the hits")
+}
+
+func TestAutobanFailedAuths(t *testing.T) {
+	openTestDB(t)
+	setAutobanConfig(t, -1, 2)
+	e := newTrackedEcho()
+
+	require.Equal(t, http.StatusUnauthorized, get(e, "198.51.100.9", "/admin/traffic", "admin", "guess1"))
+	require.False(t, IsBlocked("198.51.100.9"))
+	require.Equal(t, http.StatusUnauthorized, get(e, "198.51.100.9", "/admin/traffic", "admin", "guess2"))
+	require.True(t, IsBlocked("198.51.100.9"))
+	require.Equal(t, http.StatusForbidden, get(e, "198.51.100.9", "/admin/traffic", "admin", "secret"))
+	require.Equal(t, RuleFailedAuths, GetBanDecisions(10)[0].Rule)
+}
+
+func TestAutobanExpires(t *testing.T) {
+	openTestDB(t)
+	_, err := AddBlock("192.0.2.50", BlockSourceManual, 1)
+	require.NoError(t, err)
+	past := time.Now().Add(-2 * time.Hour).UTC()
+	require.NoError(t, ban(BanDecision{IP: "198.51.100.1", Rule: RuleFailedAuths, Hits: 5, Window: time.Minute, DecidedAt: past, BannedUntil: past.Add(time.Hour)}))
+	require.False(t, IsBlocked("198.51.100.1"), "an expired ban doesn't block")
+
+	// a ban never downgrades a permanent entry
+	now := time.Now().UTC()
+	require.NoError(t, ban(BanDecision{IP: "192.0.2.50", Rule: RuleFailedAuths, Hits: 5, Window: time.Minute, DecidedAt: now, BannedUntil: now.Add(time.Hour)}))
+
+	require.NoError(t, deleteExpiredBlocks())
+	entries, err := ListBlocks()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "192.0.2.50", entries[0].IP)
+	require.True(t, entries[0].ExpiresAt.IsZero())
+	require.Len(t, GetBanDecisions(10), 2, "decisions are kept after the ban lifts")
+}
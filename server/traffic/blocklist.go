@@ -0,0 +1,342 @@
+package traffic
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// BlockSourceManual is the bad_ips source for entries added by hand.
+const BlockSourceManual = "manual"
+
+// blocklistRefreshInterval is how often the server re-reads bad_ips, picking
+// up entries added or removed by the CLI.
+const blocklistRefreshInterval = 30 * time.Second
+
+// BlockEntry is one row of bad_ips: a single IP or a CIDR range.
+type BlockEntry struct {
+	IP          string
+	Source      string
+	ThreatLevel int
+	AddedAt     time.Time
+	// ExpiresAt is when an automatic ban lifts; zero for permanent entries.
+	ExpiresAt time.Time
+}
+
+// Expired reports whether the entry no longer blocks anything.
+func (e BlockEntry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+// blocklist is the in-memory copy of bad_ips checked on every request.
+type blocklist struct {
+	mu       sync.RWMutex
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+var blocked = &blocklist{addrs: map[netip.Addr]struct{}{}}
+
+func (b *blocklist) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, ok := b.addrs[addr]; ok {
+		return true
+	}
+	for _, p := range b.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blocklist) set(entries []BlockEntry) {
+	addrs := make(map[netip.Addr]struct{}, len(entries))
+	var prefixes []netip.Prefix
+	now := time.Now()
+	for _, e := range entries {
+		if e.Expired(now) {
+			continue
+		}
+		if p, err := netip.ParsePrefix(e.IP); err == nil {
+			prefixes = append(prefixes, p)
+			continue
+		}
+		if a, err := netip.ParseAddr(e.IP); err == nil {
+			addrs[a] = struct{}{}
+			continue
+		}
+		log.Warn().Msgf("blocklist: ignoring unparseable bad_ips entry %q", e.IP)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = addrs
+	b.prefixes = prefixes
+}
+
+// IsBlocked reports whether ip is on the blocklist, either directly or
+// within a blocked range.
+func IsBlocked(ip string) bool {
+	return blocked.contains(ip)
+}
+
+// ReloadBlocklist replaces the in-memory blocklist with the contents of
+// bad_ips.
+func ReloadBlocklist() error {
+	entries, err := ListBlocks()
+	if err != nil {
+		return err
+	}
+	blocked.set(entries)
+	return nil
+}
+
+// RunBlocklistRefresher keeps the in-memory blocklist in step with bad_ips
+// until ctx is cancelled.
+func RunBlocklistRefresher(ctx context.Context) {
+	if db == nil {
+		return
+	}
+	ticker := time.NewTicker(blocklistRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := deleteExpiredBlocks(); err != nil {
+				log.Error().Err(err).Msg("blocklist: failed to delete expired bans")
+			}
+			if err := ReloadBlocklist(); err != nil {
+				log.Error().Err(err).Msg("blocklist: failed to reload")
+			}
+		}
+	}
+}
+
+// BlocklistMiddleware rejects requests from blocked IPs. It's meant for
+// e.Pre so they're turned away before routing, logging or tracking.
+func BlocklistMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if IsBlocked(c.RealIP()) {
+			return c.NoContent(http.StatusForbidden)
+		}
+		return next(c)
+	}
+}
+
+// normalizeBlockEntry canonicalizes an IP or CIDR so the same address is
+// always stored the same way. A CIDR covering a single address is stored as
+// that address.
+func normalizeBlockEntry(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid CIDR %q: %w", s, err)
+		}
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()).Masked()
+		if p.IsSingleIP() {
+			return p.Addr().String(), nil
+		}
+		return p.String(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid IP %q: %w", s, err)
+	}
+	return a.Unmap().String(), nil
+}
+
+// deleteExpiredBlocks removes automatic bans that have lifted.
+func deleteExpiredBlocks() error {
+	res, err := db.Exec("DELETE FROM bad_ips WHERE expires_at IS NOT NULL AND expires_at <= ?", time.Now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Info().Msgf("blocklist: %d automatic bans expired", n)
+	}
+	return nil
+}
+
+// AddBlock adds (or updates) an IP or CIDR on the blocklist. Adding an IP
+// that is temporarily banned makes the block permanent.
+func AddBlock(ipOrCIDR, source string, threatLevel int) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("traffic database not initialized")
+	}
+	entry, err := normalizeBlockEntry(ipOrCIDR)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(`
+		INSERT INTO bad_ips (ip, source, threat_level, added_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(ip) DO UPDATE SET source = excluded.source, threat_level = excluded.threat_level, expires_at = NULL`,
+		entry, source, threatLevel, time.Now().UTC().Format(time.RFC3339Nano),
+	)
+	if err != nil {
+		return "", err
+	}
+	return entry, ReloadBlocklist()
+}
+
+// RemoveBlock removes an IP or CIDR from the blocklist, reporting whether it
+// was there.
+func RemoveBlock(ipOrCIDR string) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("traffic database not initialized")
+	}
+	entry, err := normalizeBlockEntry(ipOrCIDR)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec("DELETE FROM bad_ips WHERE ip = ?", entry)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, ReloadBlocklist()
+}
+
+// ListBlocks returns every blocklist entry, newest first.
+func ListBlocks() ([]BlockEntry, error) {
+	if db == nil {
+		return nil, nil
+	}
+	rows, err := db.Query("SELECT ip, source, threat_level, added_at, expires_at FROM bad_ips ORDER BY added_at DESC, ip")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []BlockEntry
+	for rows.Next() {
+		var e BlockEntry
+		var addedAt string
+		var expiresAt sql.NullString
+		if err := rows.Scan(&e.IP, &e.Source, &e.ThreatLevel, &addedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		e.AddedAt = parseTimestamp(addedAt)
+		if expiresAt.Valid {
+			e.ExpiresAt = parseTimestamp(expiresAt.String)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ImportResult summarizes an ImportBlocklist call.
+type ImportResult struct {
+	Imported int
+	Removed  int
+	Invalid  []string
+}
+
+// ImportBlocklist loads a list of IPs and CIDRs, one per line, as the entries
+// for source. Blank lines and comments (# or ;, whole-line or trailing) are
+// skipped, so plain lists and FireHOL .ipset/.netset files both work.
+// Re-importing the same source replaces its previous entries, so addresses
+// dropped upstream are unblocked. Permanent entries from other sources are
+// untouched; a temporary ban on a listed address becomes this source's
+// permanent entry, as AddBlock does.
+func ImportBlocklist(r io.Reader, source string, threatLevel int) (ImportResult, error) {
+	var res ImportResult
+	if db == nil {
+		return res, fmt.Errorf("traffic database not initialized")
+	}
+	if source == BlockSourceManual || source == BlockSourceAutoban {
+		return res, fmt.Errorf("source %q is reserved", source)
+	}
+
+	seen := map[string]bool{}
+	var entries []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		entry, err := normalizeBlockEntry(fields[0])
+		if err != nil {
+			res.Invalid = append(res.Invalid, fields[0])
+			continue
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return res, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+	previous, err := tx.Query("SELECT ip FROM bad_ips WHERE source = ?", source)
+	if err != nil {
+		return res, err
+	}
+	for previous.Next() {
+		var ip string
+		if err := previous.Scan(&ip); err != nil {
+			previous.Close()
+			return res, err
+		}
+		if !seen[ip] {
+			res.Removed++
+		}
+	}
+	previous.Close()
+	if _, err := tx.Exec("DELETE FROM bad_ips WHERE source = ?", source); err != nil {
+		return res, err
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	stmt, err := tx.Prepare(`
+		INSERT INTO bad_ips (ip, source, threat_level, added_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(ip) DO UPDATE SET source = excluded.source, threat_level = excluded.threat_level, expires_at = NULL
+		WHERE bad_ips.expires_at IS NOT NULL`)
+	if err != nil {
+		return res, err
+	}
+	defer stmt.Close()
+	for _, entry := range entries {
+		r, err := stmt.Exec(entry, source, threatLevel, now)
+		if err != nil {
+			return res, err
+		}
+		if n, _ := r.RowsAffected(); n > 0 {
+			res.Imported++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	return res, ReloadBlocklist()
+}
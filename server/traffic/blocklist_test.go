@@ -0,0 +1,139 @@
+package traffic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDB(t *testing.T) {
+	t.Helper()
+	require.NoError(t, InitDB(filepath.Join(t.TempDir(), "traffic.db")))
+	t.Cleanup(func() {
+		Close()
+		db = nil
+		blocked.set(nil)
+	})
+}
+
+func TestBlocklistAddRemove(t *testing.T) {
+	openTestDB(t)
+
+	entry, err := AddBlock(" 203.0.113.7 ", BlockSourceManual, 2)
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7", entry)
+	entry, err = AddBlock("198.51.100.77/24", BlockSourceManual, 1)
+	require.NoError(t, err)
+	require.Equal(t, "198.51.100.0/24", entry, "ranges are stored masked")
+	entry, err = AddBlock("2001:db8::1/128", BlockSourceManual, 1)
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8::1", entry, "a single-address range is stored as the address")
+	_, err = AddBlock("not-an-ip", BlockSourceManual, 1)
+	require.Error(t, err)
+
+	require.True(t, IsBlocked("203.0.113.7"))
+	require.True(t, IsBlocked("::ffff:203.0.113.7"))
+	require.True(t, IsBlocked("198.51.100.200"))
+	require.True(t, IsBlocked("2001:db8::1"))
+	require.False(t, IsBlocked("198.51.101.1"))
+	require.False(t, IsBlocked(""))
+
+	entries, err := ListBlocks()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	removed, err := RemoveBlock("198.51.100.0/24")
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.False(t, IsBlocked("198.51.100.200"))
+	removed, err = RemoveBlock("198.51.100.0/24")
+	require.NoError(t, err)
+	require.False(t, removed)
+}
+
+func TestImportBlocklist(t *testing.T) {
+	openTestDB(t)
+	_, err := AddBlock("192.0.2.1", BlockSourceManual, 5)
+	require.NoError(t, err)
+
+	firehol := `#
+# firehol_level1 - ipset
+#
+# Source ...
+192.0.2.1
+192.0.2.0/28 ; trailing comment
+10.0.0.0/8
+bogus
+10.0.0.0/8
+`
+	res, err := ImportBlocklist(strings.NewReader(firehol), "import:firehol_level1.netset", 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, res.Imported, "the manual entry for 192.0.2.1 is left alone")
+	require.Equal(t, []string{"bogus"}, res.Invalid)
+	require.True(t, IsBlocked("10.20.30.40"))
+
+	// the list drops 10.0.0.0/8 upstream; re-importing unblocks it
+	res, err = ImportBlocklist(strings.NewReader("192.0.2.0/28\n"), "import:firehol_level1.netset", 3)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Imported)
+	require.Equal(t, 1, res.Removed)
+	require.False(t, IsBlocked("10.20.30.40"))
+
+	entries, err := ListBlocks()
+	require.NoError(t, err)
+	sources := map[string]string{}
+	for _, e := range entries {
+		sources[e.IP] = e.Source
+	}
+	require.Equal(t, map[string]string{"192.0.2.1": BlockSourceManual, "192.0.2.0/28": "import:firehol_level1.netset"}, sources)
+
+	_, err = ImportBlocklist(strings.NewReader("1.2.3.4\n"), BlockSourceManual, 1)
+	require.Error(t, err)
+}
+
+func TestImportBlocklistPromotesAutobans(t *testing.T) {
+	openTestDB(t)
+	now := time.Now().UTC()
+	require.NoError(t, ban(BanDecision{IP: "203.0.113.9", Rule: RuleFailedAuths, Hits: 5, Window: time.Minute, DecidedAt: now, BannedUntil: now.Add(time.Hour)}))
+
+	res, err := ImportBlocklist(strings.NewReader("203.0.113.9\n"), "import:firehol_level1.netset", 3)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Imported)
+
+	entries, err := ListBlocks()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "import:firehol_level1.netset", entries[0].Source)
+	require.Equal(t, 3, entries[0].ThreatLevel)
+	require.True(t, entries[0].ExpiresAt.IsZero(), "the list makes the block permanent")
+}
+
+func TestBlocklistMiddleware(t *testing.T) {
+	openTestDB(t)
+	_, err := AddBlock("203.0.113.0/24", BlockSourceManual, 1)
+	require.NoError(t, err)
+
+	e := echo.New()
+	e.Pre(BlocklistMiddleware)
+	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "hi") })
+
+	for ip, want := range map[string]int{"203.0.113.9": http.StatusForbidden, "192.0.2.9": http.StatusOK} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, want, rec.Code, ip)
+	}
+	// unrouted paths are refused too, before the router 404s them
+	req := httptest.NewRequest(http.MethodGet, "/wp-login.php", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
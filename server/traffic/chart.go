@@ -0,0 +1,94 @@
+package traffic
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"strings"
+)
+
+// Chart dimensions in SVG user units; the chart scales to its container.
+const (
+	chartWidth  = 720
+	chartHeight = 160
+	chartLeft   = 48 // room for y axis labels
+	chartBottom = 20 // room for x axis labels
+)
+
+// Chart is one series drawn as an inline SVG bar chart.
+type Chart struct {
+	Title string
+	Total int
+	SVG   template.HTML
+}
+
+// seriesCharts draws the requests, unique visitors and errors in series.
+func seriesCharts(series []SeriesPoint, totals SeriesPoint, hourly bool) []Chart {
+	return []Chart{
+		{Title: "Requests", Total: totals.Requests, SVG: barChart(series, hourly, func(p SeriesPoint) int { return p.Requests })},
+		{Title: "Unique visitors", Total: totals.Uniques, SVG: barChart(series, hourly, func(p SeriesPoint) int { return p.Uniques })},
+		{Title: "Server errors (5xx)", Total: totals.Errors, SVG: barChart(series, hourly, func(p SeriesPoint) int { return p.Errors })},
+	}
+}
+
+// barChart renders one bar per point, each with a tooltip giving its
+// bucket and value, so the page needs no JavaScript.
+func barChart(series []SeriesPoint, hourly bool, value func(SeriesPoint) int) template.HTML {
+	label := func(p SeriesPoint) string {
+		if hourly {
+			return p.Start.Format("Jan 2 15:00")
+		}
+		return p.Start.Format("Jan 2 2006")
+	}
+	axisLabel := func(p SeriesPoint) string {
+		if hourly {
+			return p.Start.Format("15:00")
+		}
+		return p.Start.Format("Jan 2")
+	}
+
+	top := 0
+	for _, p := range series {
+		top = max(top, value(p))
+	}
+	plotWidth := float64(chartWidth - chartLeft)
+	plotHeight := float64(chartHeight - chartBottom)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="chart" viewBox="0 0 %d %d" role="img" xmlns="http://www.w3.org/2000/svg">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<line class="axis" x1="%d" y1="%g" x2="%d" y2="%g"/>`, chartLeft, plotHeight, chartWidth, plotHeight)
+	fmt.Fprintf(&b, `<text class="label" x="%d" y="%g" text-anchor="end">0</text>`, chartLeft-6, plotHeight)
+	fmt.Fprintf(&b, `<text class="label" x="%d" y="10" text-anchor="end">%d</text>`, chartLeft-6, top)
+	if len(series) > 0 {
+		barWidth := plotWidth / float64(len(series))
+		gap := 0.0
+		if barWidth > 4 {
+			gap = 1
+		}
+		for i, p := range series {
+			v := value(p)
+			h := 0.0
+			if top > 0 {
+				h = plotHeight * float64(v) / float64(top)
+			}
+			fmt.Fprintf(&b, `<rect class="bar" x="%.2f" y="%.2f" width="%.2f" height="%.2f"><title>%s: %d</title></rect>`,
+				float64(chartLeft)+float64(i)*barWidth, plotHeight-h, barWidth-gap, h, html.EscapeString(label(p)), v)
+		}
+		// first, middle and last bucket along the x axis
+		last := len(series) - 1
+		for _, l := range []struct {
+			i      int
+			x      float64
+			anchor string
+		}{
+			{0, chartLeft, "start"},
+			{last / 2, float64(chartLeft) + (float64(last/2)+0.5)*barWidth, "middle"},
+			{last, chartWidth, "end"},
+		} {
+			fmt.Fprintf(&b, `<text class="label" x="%.2f" y="%d" text-anchor="%s">%s</text>`,
+				l.x, chartHeight-4, l.anchor, html.EscapeString(axisLabel(series[l.i])))
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
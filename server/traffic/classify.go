@@ -0,0 +1,232 @@
+package traffic
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Class is what kind of client a tracked request came from.
+type Class string
+
+const (
+	ClassHuman      Class = "human"
+	ClassCrawler    Class = "crawler"
+	ClassFeedReader Class = "feed_reader"
+	ClassMonitor    Class = "monitor"
+	ClassScanner    Class = "scanner"
+)
+
+// Classes lists every class in the order the admin page shows them.
+var Classes = []Class{ClassHuman, ClassCrawler, ClassFeedReader, ClassMonitor, ClassScanner}
+
+// ParseClass returns the class named s, if there is one.
+func ParseClass(s string) (Class, bool) {
+	for _, c := range Classes {
+		if string(c) == s {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// Defaults for the classifier settings left unset (0).
+const (
+	defaultBotRequestsPerMinute = 120
+	// scannerMemory is how long an IP stays classed as a scanner after it
+	// probes a path the site doesn't have.
+	scannerMemory = time.Hour
+	// classifierMaxIPs is how many IPs the classifier tracks before it sweeps
+	// out the idle ones.
+	classifierMaxIPs = 10000
+)
+
+//go:embed useragents.txt
+var defaultUAPatterns string
+
+type uaPattern struct {
+	class   Class
+	pattern string // lowercased
+}
+
+// parseUAPatterns reads "<class> <pattern>" lines, skipping blanks and #
+// comments.
+func parseUAPatterns(r io.Reader) ([]uaPattern, error) {
+	var patterns []uaPattern
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern, _ := strings.Cut(line, " ")
+		class, ok := ParseClass(name)
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("line %d: want \"<class> <pattern>\", got %q", n, line)
+		}
+		patterns = append(patterns, uaPattern{class: class, pattern: strings.ToLower(pattern)})
+	}
+	return patterns, scanner.Err()
+}
+
+// classifier tags requests with a Class from their user agent, whether they
+// probe suspicious paths, and how fast their IP is making requests.
+type classifier struct {
+	patterns      []uaPattern
+	perMinuteBots int // requests per minute from one IP that mark it automated; negative disables
+
+	mu  sync.Mutex
+	ips map[string]*ipActivity
+}
+
+type ipActivity struct {
+	minute       int64 // Unix minute count is for
+	count        int
+	scannerUntil time.Time
+}
+
+var reqClassifier *classifier
+
+// newClassifier loads the embedded user agent patterns, preceded by those in
+// TRAFFIC_UA_PATTERNS_FILE if it's set.
+func newClassifier() (*classifier, error) {
+	patterns, err := parseUAPatterns(strings.NewReader(defaultUAPatterns))
+	if err != nil {
+		return nil, fmt.Errorf("embedded user agent patterns: %w", err)
+	}
+	if path := config.C.TrafficUAPatternsFile; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		overrides, err := parseUAPatterns(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		patterns = append(overrides, patterns...)
+	}
+	perMinute := config.C.BotRequestsPerMinute
+	if perMinute == 0 {
+		perMinute = defaultBotRequestsPerMinute
+	}
+	return &classifier{patterns: patterns, perMinuteBots: perMinute, ips: map[string]*ipActivity{}}, nil
+}
+
+// matchUserAgent is the class of the first pattern ua contains.
+func (c *classifier) matchUserAgent(ua string) (Class, bool) {
+	ua = strings.ToLower(ua)
+	for _, p := range c.patterns {
+		if strings.Contains(ua, p.pattern) {
+			return p.class, true
+		}
+	}
+	return "", false
+}
+
+// classify tags a finished request. A probe for a suspicious path the site
+// doesn't have marks its IP as a scanner for a while, whatever its user
+// agent claims; otherwise the user agent decides, and an unrecognized one
+// making requests faster than a person would counts as a crawler.
+func (c *classifier) classify(req Request) Class {
+	class, ok := c.matchUserAgent(req.UserAgent)
+	if !ok {
+		class = ClassHuman
+		if req.UserAgent == "" {
+			class = ClassCrawler
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	act := c.activity(req.IP, req.Timestamp)
+	switch {
+	case isSuspiciousPath(req.Path) && isUnroutedStatus(req.Status):
+		act.scannerUntil = req.Timestamp.Add(scannerMemory)
+		return ClassScanner
+	case req.Timestamp.Before(act.scannerUntil):
+		return ClassScanner
+	case class == ClassHuman && c.perMinuteBots > 0 && act.count > c.perMinuteBots:
+		return ClassCrawler
+	}
+	return class
+}
+
+// activity counts a request from ip at t; c.mu must be held.
+func (c *classifier) activity(ip string, t time.Time) *ipActivity {
+	minute := t.Unix() / 60
+	if len(c.ips) >= classifierMaxIPs {
+		for k, a := range c.ips {
+			if a.minute < minute && !t.Before(a.scannerUntil) {
+				delete(c.ips, k)
+			}
+		}
+	}
+	act := c.ips[ip]
+	if act == nil {
+		act = &ipActivity{minute: minute}
+		c.ips[ip] = act
+	}
+	if act.minute != minute {
+		act.minute, act.count = minute, 0
+	}
+	act.count++
+	return act
+}
+
+// classFilter is an SQL condition, with its arguments, limiting requests to
+// class; both are empty when class is "".
+func classFilter(class Class) (string, []any) {
+	if class == "" {
+		return "", nil
+	}
+	return " AND class = ?", []any{string(class)}
+}
+
+// ClassCount is how many requests from one class arrived in a window.
+type ClassCount struct {
+	Class Class
+	Count int
+}
+
+// GetClassCounts counts requests since the given time for every class,
+// including those with none.
+func GetClassCounts(since time.Time) []ClassCount {
+	counts := make([]ClassCount, len(Classes))
+	for i, c := range Classes {
+		counts[i].Class = c
+	}
+	if db == nil {
+		return counts
+	}
+	rows, err := db.Query("SELECT class, COUNT(*) FROM requests WHERE timestamp >= ? AND class IS NOT NULL GROUP BY class",
+		since.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query class counts")
+		return counts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var class string
+		var n int
+		if err := rows.Scan(&class, &n); err != nil {
+			log.Error().Err(err).Msg("failed to scan class count row")
+			continue
+		}
+		for i := range counts {
+			if string(counts[i].Class) == class {
+				counts[i].Count = n
+			}
+		}
+	}
+	return counts
+}
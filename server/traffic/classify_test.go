@@ -0,0 +1,121 @@
+package traffic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/stretchr/testify/require"
+)
+
+const chromeUA = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36"
+
+func newTestClassifier(t *testing.T, perMinute int, overrides string) *classifier {
+	t.Helper()
+	prev := config.C
+	t.Cleanup(func() { config.C = prev })
+	config.C.BotRequestsPerMinute = perMinute
+	if overrides != "" {
+		path := filepath.Join(t.TempDir(), "useragents.txt")
+		require.NoError(t, os.WriteFile(path, []byte(overrides), 0o644))
+		config.C.TrafficUAPatternsFile = path
+	}
+	c, err := newClassifier()
+	require.NoError(t, err)
+	return c
+}
+
+func TestParseUAPatterns(t *testing.T) {
+	patterns, err := parseUAPatterns(strings.NewReader("# comment\n\ncrawler  Some Bot \nhuman MyApp\n"))
+	require.NoError(t, err)
+	require.Equal(t, []uaPattern{{ClassCrawler, "some bot"}, {ClassHuman, "myapp"}}, patterns)
+
+	_, err = parseUAPatterns(strings.NewReader("robot Foo\n"))
+	require.ErrorContains(t, err, "line 1")
+	_, err = parseUAPatterns(strings.NewReader("crawler\n"))
+	require.Error(t, err)
+}
+
+func TestClassifyUserAgents(t *testing.T) {
+	c := newTestClassifier(t, -1, "")
+	now := time.Now()
+	for ua, want := range map[string]Class{
+		chromeUA: ClassHuman,
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": ClassCrawler,
+		"Feedly/1.0 (+http://www.feedly.com/fetcher.html; 4 subscribers)":          ClassFeedReader,
+		"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)":   ClassMonitor,
+		"sqlmap/1.8#stable (https://sqlmap.org)":                                   ClassScanner,
+		"curl/8.5.0":                                                               ClassCrawler,
+		"SomeNewBot/0.1":                                                           ClassCrawler,
+		"":                                                                         ClassCrawler,
+	} {
+		got := c.classify(Request{Path: "/", IP: "192.0.2.1", UserAgent: ua, Status: http.StatusOK, Timestamp: now})
+		require.Equal(t, want, got, ua)
+	}
+}
+
+func TestClassifyOverridesComeFirst(t *testing.T) {
+	c := newTestClassifier(t, -1, "human Slackbot-LinkExpanding\n")
+	now := time.Now()
+	require.Equal(t, ClassHuman, c.classify(Request{Path: "/", IP: "192.0.2.1", UserAgent: "Slackbot-LinkExpanding 1.0", Timestamp: now}))
+	require.Equal(t, ClassCrawler, c.classify(Request{Path: "/", IP: "192.0.2.1", UserAgent: "Slackbot 1.0", Timestamp: now}))
+}
+
+func TestClassifyScannerIsSticky(t *testing.T) {
+	c := newTestClassifier(t, -1, "")
+	now := time.Now()
+	req := func(path string, status int, at time.Time) Class {
+		return c.classify(Request{Path: path, IP: "203.0.113.9", UserAgent: chromeUA, Status: status, Timestamp: at})
+	}
+
+	require.Equal(t, ClassHuman, req("/admin/traffic", http.StatusUnauthorized, now), "a routed suspicious path isn't a probe")
+	require.Equal(t, ClassScanner, req("/wp-login.php", http.StatusNotFound, now))
+	require.Equal(t, ClassScanner, req("/", http.StatusOK, now.Add(time.Minute)))
+	require.Equal(t, ClassHuman, req("/", http.StatusOK, now.Add(2*scannerMemory)))
+}
+
+func TestClassifyRequestRate(t *testing.T) {
+	c := newTestClassifier(t, 3, "")
+	minute := time.Now().Truncate(time.Minute)
+	req := func(ua string, at time.Time) Class {
+		return c.classify(Request{Path: "/", IP: "198.51.100.4", UserAgent: ua, Status: http.StatusOK, Timestamp: at})
+	}
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, ClassHuman, req(chromeUA, minute.Add(time.Duration(i)*time.Second)))
+	}
+	require.Equal(t, ClassCrawler, req(chromeUA, minute.Add(10*time.Second)))
+	require.Equal(t, ClassMonitor, req("UptimeRobot/2.0", minute.Add(11*time.Second)), "known clients keep their class")
+	require.Equal(t, ClassHuman, req(chromeUA, minute.Add(time.Minute)))
+}
+
+func TestTrafficViewsFilterByClass(t *testing.T) {
+	openTestDB(t)
+	e := newTrackedEcho()
+	for _, ua := range []string{chromeUA, chromeUA, "Googlebot/2.1"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("User-Agent", ua)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	writer.flush()
+
+	var crawled []Request
+	for _, b := range GetHourlyBuckets(ClassCrawler) {
+		crawled = append(crawled, b.Requests...)
+	}
+	require.Len(t, crawled, 1)
+	require.Equal(t, ClassCrawler, crawled[0].Class)
+	require.Equal(t, 2, getTotalRequestCount(ClassHuman))
+	require.Equal(t, 3, getTotalRequestCount(""))
+
+	counts := GetClassCounts(time.Now().Add(-time.Hour))
+	require.Len(t, counts, len(Classes))
+	require.Equal(t, ClassCount{Class: ClassHuman, Count: 2}, counts[0])
+	require.Equal(t, ClassCount{Class: ClassCrawler, Count: 1}, counts[1])
+	require.Equal(t, ClassCount{Class: ClassScanner, Count: 0}, counts[4])
+}
@@ -0,0 +1,495 @@
+package traffic
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// ExportFormat is how exported rows are encoded.
+type ExportFormat string
+
+const (
+	FormatCSV    ExportFormat = "csv"    // a header row, then one row per record
+	FormatNDJSON ExportFormat = "ndjson" // one JSON object per line
+)
+
+// ParseExportFormat reads a format name, accepting "jsonl" for NDJSON.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch strings.ToLower(s) {
+	case "csv":
+		return FormatCSV, nil
+	case "ndjson", "jsonl":
+		return FormatNDJSON, nil
+	}
+	return "", fmt.Errorf("unknown format %q (want csv or ndjson)", s)
+}
+
+// ContentType is the MIME type exports in f are served as.
+func (f ExportFormat) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// columnKind says how a column is written out and read back.
+type columnKind int
+
+const (
+	colText    columnKind = iota // empty string when missing
+	colOptText                   // NULL when empty, like the writer's NULLIF
+	colInt                       // NULL when empty
+	colTime                      // RFC 3339 timestamp, stored as UTC
+)
+
+type exportColumn struct {
+	name     string
+	kind     columnKind
+	required bool
+}
+
+// exportTable is a table that can be exported and imported. Its key columns
+// identify a row across databases, so importing the same export twice (or
+// merging an old database that overlaps this one) skips rows already here.
+type exportTable struct {
+	name    string
+	columns []exportColumn
+	key     []string
+}
+
+// ExportTables are the tables export and import handle, by name.
+var ExportTables = []string{"requests", "suspicious_requests", "failed_auths"}
+
+var exportTables = map[string]exportTable{
+	"requests": {
+		name: "requests",
+		columns: []exportColumn{
+			{"id", colInt, false},
+			{"timestamp", colTime, true},
+			{"method", colText, false},
+			{"path", colText, true},
+			{"route", colText, false},
+			{"status", colInt, false},
+			{"bytes", colInt, false},
+			{"latency_us", colInt, false},
+			{"ip", colText, true},
+			{"visitor_hash", colOptText, false},
+			{"user_agent", colText, false},
+			{"referrer", colText, false},
+			{"class", colOptText, false},
+			{"proto", colText, false},
+			{"tls_version", colText, false},
+		},
+		key: []string{"timestamp", "ip", "path"},
+	},
+	"suspicious_requests": {
+		name: "suspicious_requests",
+		columns: []exportColumn{
+			{"id", colInt, false},
+			{"timestamp", colTime, true},
+			{"ip", colText, true},
+			{"path", colText, true},
+			{"user_agent", colText, false},
+		},
+		key: []string{"timestamp", "ip", "path"},
+	},
+	"failed_auths": {
+		name: "failed_auths",
+		columns: []exportColumn{
+			{"id", colInt, false},
+			{"timestamp", colTime, true},
+			{"ip", colText, true},
+		},
+		key: []string{"timestamp", "ip"},
+	},
+}
+
+func lookupExportTable(name string) (exportTable, error) {
+	t, ok := exportTables[name]
+	if !ok {
+		return t, fmt.Errorf("unknown table %q (want one of %s)", name, strings.Join(ExportTables, ", "))
+	}
+	return t, nil
+}
+
+func (t exportTable) column(name string) (exportColumn, bool) {
+	for _, c := range t.columns {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return exportColumn{}, false
+}
+
+func (t exportTable) columnNames() []string {
+	names := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// Export writes the rows of table recorded in [from, to) to w, oldest
+// first; a zero from or to leaves that end open. It returns how many rows
+// it wrote. Rows are streamed, so a large table doesn't have to fit in
+// memory.
+func Export(w io.Writer, table string, format ExportFormat, from, to time.Time) (int64, error) {
+	t, err := lookupExportTable(table)
+	if err != nil {
+		return 0, err
+	}
+	if db == nil {
+		return 0, errors.New("traffic database is not open")
+	}
+	where, args := timeWindow(from, to)
+	rows, err := db.Query("SELECT "+strings.Join(t.columnNames(), ", ")+" FROM "+t.name+" WHERE "+where+" ORDER BY id", args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	var cw *csv.Writer
+	if format == FormatCSV {
+		cw = csv.NewWriter(bw)
+		if err := cw.Write(t.columnNames()); err != nil {
+			return 0, err
+		}
+	}
+	values := make([]sql.NullString, len(t.columns))
+	dest := make([]any, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	record := make([]string, len(values))
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		if format == FormatCSV {
+			for i, v := range values {
+				record[i] = exportValue(t.columns[i], v)
+			}
+			err = cw.Write(record)
+		} else {
+			err = writeJSONRow(bw, t, values)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// exportValue formats a column for CSV; NULL is written as empty.
+func exportValue(c exportColumn, v sql.NullString) string {
+	if !v.Valid {
+		return ""
+	}
+	if c.kind == colTime {
+		return parseTimestamp(v.String).UTC().Format(time.RFC3339Nano)
+	}
+	return v.String
+}
+
+// writeJSONRow writes one NDJSON line, keeping the table's column order and
+// writing NULLs as null.
+func writeJSONRow(w *bufio.Writer, t exportTable, values []sql.NullString) error {
+	w.WriteByte('{')
+	for i, v := range values {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		key, _ := json.Marshal(t.columns[i].name)
+		w.Write(key)
+		w.WriteByte(':')
+		var value any
+		switch {
+		case !v.Valid:
+		case t.columns[i].kind == colInt:
+			value = json.Number(v.String)
+		default:
+			value = exportValue(t.columns[i], v)
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		w.Write(b)
+	}
+	w.WriteByte('}')
+	return w.WriteByte('\n')
+}
+
+// TableImportResult is what ImportTable did.
+type TableImportResult struct {
+	Imported int64
+	Skipped  int64 // already in the database
+}
+
+// ImportTable loads rows written by Export into table, in one transaction,
+// so a bad row imports nothing. IDs aren't kept: imported rows get new
+// ones, which lets an old database be merged into a live one. Rows whose
+// key columns match a row already in the table are skipped, so an import
+// can safely be re-run.
+//
+// In privacy mode, imported requests are stored the way privacy mode records
+// them: the IP truncated and, for rows without one, a visitor hash, salted
+// per day as AnonymizeRequests does. The security tables keep their raw IPs, as they do when recording.
+func ImportTable(r io.Reader, table string, format ExportFormat) (TableImportResult, error) {
+	var res TableImportResult
+	t, err := lookupExportTable(table)
+	if err != nil {
+		return res, err
+	}
+	if db == nil {
+		return res, errors.New("traffic database is not open")
+	}
+	next, err := importReader(r, t, format)
+	if err != nil {
+		return res, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+	var cols []string
+	for _, c := range t.columns {
+		if c.name != "id" {
+			cols = append(cols, c.name)
+		}
+	}
+	var keyConds []string
+	for _, k := range t.key {
+		keyConds = append(keyConds, k+" = ?")
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s WHERE NOT EXISTS (SELECT 1 FROM %s WHERE %s)",
+		t.name, strings.Join(cols, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", "),
+		t.name, strings.Join(keyConds, " AND ")))
+	if err != nil {
+		return res, err
+	}
+	defer stmt.Close()
+
+	anonymize := t.name == "requests" && privacyMode()
+	salts := map[string][]byte{}
+	for line := 1; ; line++ {
+		row, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("record %d: %w", line, err)
+		}
+		if anonymize {
+			if err := anonymizeImportedRow(tx, row, salts); err != nil {
+				return res, fmt.Errorf("record %d: %w", line, err)
+			}
+		}
+		args := make([]any, 0, len(cols)+len(t.key))
+		for _, c := range cols {
+			args = append(args, row[c])
+		}
+		for _, k := range t.key {
+			args = append(args, row[k])
+		}
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			return res, fmt.Errorf("record %d: %w", line, err)
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			res.Imported++
+		} else {
+			res.Skipped++
+		}
+	}
+	return res, tx.Commit()
+}
+
+// anonymizeImportedRow converts a requests row to the privacy mode form,
+// remembering in salts the salt each day's rows are hashed with.
+func anonymizeImportedRow(tx *sql.Tx, row map[string]any, salts map[string][]byte) error {
+	ip := row["ip"].(string)
+	if row["visitor_hash"] == nil {
+		day := row["timestamp"].(string)[:len(time.DateOnly)]
+		salt, ok := salts[day]
+		if !ok {
+			var err error
+			if salt, err = anonymizeSalt(tx, day); err != nil {
+				return err
+			}
+			salts[day] = salt
+		}
+		row["visitor_hash"] = visitorHash(salt, ip, row["user_agent"].(string))
+	}
+	row["ip"] = truncateIP(ip)
+	return nil
+}
+
+// importReader returns a function yielding each record in r as column
+// values ready to insert, and io.EOF after the last.
+func importReader(r io.Reader, t exportTable, format ExportFormat) (func() (map[string]any, error), error) {
+	if format == FormatCSV {
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("reading CSV header: %w", err)
+		}
+		for _, name := range header {
+			if _, ok := t.column(name); !ok {
+				return nil, fmt.Errorf("%s has no column %q", t.name, name)
+			}
+		}
+		return func() (map[string]any, error) {
+			record, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			fields := make(map[string]*string, len(header))
+			for i, name := range header {
+				fields[name] = &record[i]
+			}
+			return importRow(t, fields)
+		}, nil
+	}
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return func() (map[string]any, error) {
+		var obj map[string]any
+		if err := dec.Decode(&obj); err != nil {
+			return nil, err
+		}
+		fields := make(map[string]*string, len(obj))
+		for name, v := range obj {
+			if _, ok := t.column(name); !ok {
+				return nil, fmt.Errorf("%s has no column %q", t.name, name)
+			}
+			var s string
+			switch v := v.(type) {
+			case nil:
+				continue
+			case string:
+				s = v
+			case json.Number:
+				s = v.String()
+			default:
+				return nil, fmt.Errorf("%s: want a string or number, got %v", name, v)
+			}
+			fields[name] = &s
+		}
+		return importRow(t, fields)
+	}, nil
+}
+
+// importRow converts a record's fields, nil where missing or null, to the
+// values stored for them.
+func importRow(t exportTable, fields map[string]*string) (map[string]any, error) {
+	row := make(map[string]any, len(t.columns))
+	for _, c := range t.columns {
+		f := fields[c.name]
+		if f == nil || *f == "" {
+			if c.required {
+				return nil, fmt.Errorf("missing %s", c.name)
+			}
+			if c.kind == colText {
+				row[c.name] = ""
+			} else {
+				row[c.name] = nil
+			}
+			continue
+		}
+		switch c.kind {
+		case colInt:
+			n, err := strconv.ParseInt(*f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not an integer", c.name, *f)
+			}
+			row[c.name] = n
+		case colTime:
+			ts, err := time.Parse(time.RFC3339Nano, *f)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %q is not an RFC 3339 time", c.name, *f)
+			}
+			// stored as UTC so it sorts and compares with recorded rows
+			row[c.name] = ts.UTC().Format(time.RFC3339Nano)
+		default:
+			row[c.name] = *f
+		}
+	}
+	if class, ok := row["class"].(string); ok {
+		if _, known := ParseClass(class); !known {
+			return nil, fmt.Errorf("class: unknown class %q", class)
+		}
+	}
+	return row, nil
+}
+
+// ExportHandler serves GET
+// /admin/traffic/export?table=&format=&from=&to=, downloading table as a
+// file. Without from or to it exports everything.
+func ExportHandler(c echo.Context) error {
+	table := c.QueryParam("table")
+	if table == "" {
+		table = "requests"
+	}
+	if _, err := lookupExportTable(table); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	format := FormatCSV
+	if s := c.QueryParam("format"); s != "" {
+		var err error
+		if format, err = ParseExportFormat(s); err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
+		}
+	}
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if s := c.QueryParam(p.name); s != "" {
+			t, err := parseAPITime(s)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, p.name+": "+err.Error())
+			}
+			*p.t = t
+		}
+	}
+
+	filename := fmt.Sprintf("%s-%s.%s", table, time.Now().UTC().Format("20060102"), format)
+	c.Response().Header().Set(echo.HeaderContentType, format.ContentType())
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().WriteHeader(http.StatusOK)
+	n, err := Export(c.Response(), table, format, from, to)
+	if err != nil {
+		// the status is already sent; a truncated download is all we can do
+		log.Error().Err(err).Msgf("traffic export of %s failed after %d rows", table, n)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package traffic
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []ExportFormat{FormatCSV, FormatNDJSON} {
+		t.Run(string(format), func(t *testing.T) {
+			openTestDB(t)
+			now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+			_, err := db.Exec(`INSERT INTO requests (path, ip, user_agent, referrer, timestamp, method, route, status, bytes, latency_us, proto, tls_version, class)
+				VALUES ('/blog/a,b', '192.0.2.1', 'Mozilla "quoted"', 'https://example.com/', ?, 'GET', '/blog/:blog', 200, 512, 1500, 'HTTP/2.0', 'TLS 1.3', 'human')`,
+				now.Format(time.RFC3339Nano))
+			require.NoError(t, err)
+			insertRequestAt(t, now.Add(time.Minute).Format(time.RFC3339Nano), "/", "192.0.2.2", "", nil)
+			insertRequestAt(t, now.AddDate(0, 0, -3).Format(time.RFC3339Nano), "/old", "192.0.2.3", "", 200)
+
+			var out bytes.Buffer
+			n, err := Export(&out, "requests", format, now.Add(-time.Hour), time.Time{})
+			require.NoError(t, err)
+			require.EqualValues(t, 2, n, "the old request is outside the window")
+			before, err := QueryRequests(RequestFilter{From: now.Add(-time.Hour)}, "", 10)
+			require.NoError(t, err)
+
+			res, err := ImportTable(bytes.NewReader(out.Bytes()), "requests", format)
+			require.NoError(t, err)
+			require.Equal(t, TableImportResult{Skipped: 2}, res, "re-importing skips rows already present")
+
+			_, err = db.Exec("DELETE FROM requests")
+			require.NoError(t, err)
+			res, err = ImportTable(bytes.NewReader(out.Bytes()), "requests", format)
+			require.NoError(t, err)
+			require.Equal(t, TableImportResult{Imported: 2}, res)
+
+			after, err := QueryRequests(RequestFilter{From: now.Add(-time.Hour)}, "", 10)
+			require.NoError(t, err)
+			require.Len(t, after.Items, 2)
+			for i := range after.Items {
+				require.NotEqual(t, before.Items[i].ID, after.Items[i].ID, "imported rows get new IDs")
+				after.Items[i].ID = before.Items[i].ID
+			}
+			require.Equal(t, before.Items, after.Items)
+		})
+	}
+}
+
+func TestExportNDJSONKeepsNulls(t *testing.T) {
+	openTestDB(t)
+	insertRequestAt(t, "2026-10-18T12:00:00Z", "/", "192.0.2.1", "", nil)
+	var out bytes.Buffer
+	_, err := Export(&out, "requests", FormatNDJSON, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, `{"id":1,"timestamp":"2026-10-18T12:00:00Z","method":null,"path":"/","route":null,"status":null,"bytes":null,`+
+		`"latency_us":null,"ip":"192.0.2.1","visitor_hash":null,"user_agent":"","referrer":"","class":null,"proto":null,"tls_version":null}`+"\n", out.String())
+}
+
+func TestImportTableRejectsBadRows(t *testing.T) {
+	openTestDB(t)
+	for name, tc := range map[string]struct {
+		format ExportFormat
+		input  string
+	}{
+		"unknown column":   {FormatCSV, "timestamp,ip,colour\n2026-10-18T12:00:00Z,192.0.2.1,red\n"},
+		"missing required": {FormatCSV, "timestamp,ip\n2026-10-18T12:00:00Z,\n"},
+		"bad time":         {FormatNDJSON, `{"timestamp":"yesterday","ip":"192.0.2.1"}`},
+		"bad integer":      {FormatNDJSON, `{"id":"one","timestamp":"2026-10-18T12:00:00Z","ip":"192.0.2.1"}`},
+	} {
+		// the good row first shows a bad one rolls the whole import back
+		input := tc.input
+		if tc.format == FormatNDJSON {
+			input = `{"timestamp":"2026-10-18T11:00:00Z","ip":"192.0.2.8"}` + "\n" + input
+		}
+		_, err := ImportTable(strings.NewReader(input), "failed_auths", tc.format)
+		require.Error(t, err, name)
+		require.Zero(t, countRows(t, "failed_auths"), name)
+	}
+
+	_, err := ImportTable(strings.NewReader(""), "bad_ips", FormatCSV)
+	require.ErrorContains(t, err, "unknown table")
+	_, err = ImportTable(strings.NewReader("timestamp,ip,path,class\n2026-10-18T12:00:00Z,192.0.2.1,/,robot\n"), "requests", FormatCSV)
+	require.ErrorContains(t, err, "unknown class")
+}
+
+func TestImportTableInPrivacyMode(t *testing.T) {
+	openTestDB(t)
+	setPrivacyMode(t, true)
+	input := "timestamp,ip,path,user_agent,visitor_hash\n" +
+		"2025-03-01T10:00:00Z,192.0.2.77,/,Mozilla,\n" +
+		"2025-03-01T11:00:00Z,192.0.2.77,/blog,Mozilla,\n" +
+		"2025-03-01T12:00:00Z,2001:db8:1:2::7,/,Mozilla,\n" +
+		"2025-03-01T13:00:00Z,198.51.100.0,/,Mozilla,abcdef\n"
+	res, err := ImportTable(strings.NewReader(input), "requests", FormatCSV)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, res.Imported)
+
+	stored := storedRequests(t)
+	require.Equal(t, "192.0.2.0", stored[0].ip)
+	require.Equal(t, "2001:db8:1::", stored[2].ip)
+	require.NotEmpty(t, stored[0].visitorHash)
+	require.Equal(t, stored[0].visitorHash, stored[1].visitorHash, "same visitor, same day")
+	require.NotEqual(t, stored[0].visitorHash, stored[2].visitorHash)
+	require.Equal(t, storedRequest{ip: "198.51.100.0", visitorHash: "abcdef"}, stored[3], "already anonymized")
+	require.Zero(t, countRows(t, "visitor_salts"), "the import's salts aren't kept")
+
+	res, err = ImportTable(strings.NewReader(input), "requests", FormatCSV)
+	require.NoError(t, err)
+	require.EqualValues(t, 4, res.Skipped, "re-importing still finds the rows")
+}
+
+func TestExportHandler(t *testing.T) {
+	openTestDB(t)
+	_, err := db.Exec("INSERT INTO failed_auths (ip, timestamp) VALUES ('192.0.2.1', '2026-10-17T12:00:00Z'), ('192.0.2.2', '2026-10-18T12:00:00Z')")
+	require.NoError(t, err)
+	e := echo.New()
+	e.GET("/export", ExportHandler)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export?table=failed_auths&from=2026-10-18", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/csv; charset=utf-8", rec.Header().Get(echo.HeaderContentType))
+	require.Contains(t, rec.Header().Get(echo.HeaderContentDisposition), `attachment; filename="failed_auths-`)
+	require.Equal(t, "id,timestamp,ip\n2,2026-10-18T12:00:00Z,192.0.2.2\n", rec.Body.String())
+
+	for _, target := range []string{"/export?table=bad_ips", "/export?format=parquet", "/export?to=tomorrow"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+}
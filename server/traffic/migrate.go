@@ -0,0 +1,241 @@
+package traffic
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// migrationFiles are the traffic database's schema changes, named
+// NNNN_description.sql and applied in version order. Once a migration has
+// shipped, never edit it; add a new one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus is a migration and when it was applied to the open
+// database; AppliedAt is zero if it's pending. On a database that predates
+// schema_migrations, LegacyUserVersion is the PRAGMA user_version that says
+// the migration was applied, and AppliedAt is unknown.
+type MigrationStatus struct {
+	Migration
+	AppliedAt         time.Time
+	LegacyUserVersion int
+}
+
+// Applied reports whether the migration has been applied.
+func (s MigrationStatus) Applied() bool {
+	return !s.AppliedAt.IsZero() || s.LegacyUserVersion > 0
+}
+
+// legacyUserVersionMigrations maps the PRAGMA user_version a database was
+// left at by the upgrades that came before versioned migrations to the last
+// migration it already has: user_version n had applied migrations 1 through
+// n+1.
+func legacyUserVersionMigrations(userVersion int) int {
+	if userVersion == 0 {
+		return 0
+	}
+	return userVersion + 1
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, e := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(e.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_description.sql", e.Name())
+		}
+		b, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(b)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %04d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// ensureMigrationsTable creates schema_migrations if needed. A database
+// that predates it is marked as having the migrations its PRAGMA
+// user_version says it already has, so they aren't run twice.
+func ensureMigrationsTable() error {
+	exists, err := migrationsTableExists()
+	if err != nil || exists {
+		return err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	userVersion, applied, err := legacyApplied(migrations)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`CREATE TABLE schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`); err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, m := range migrations[:applied] {
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.Version, m.Name, now); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if applied > 0 {
+		log.Info().Msgf("traffic: marked migrations 1-%d as applied from user_version %d", applied, userVersion)
+	}
+	return nil
+}
+
+func migrationsTableExists() (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&n)
+	return n > 0, err
+}
+
+// legacyApplied reads the database's PRAGMA user_version and how many
+// migrations it means were applied.
+func legacyApplied(migrations []Migration) (userVersion, applied int, err error) {
+	if err := db.QueryRow("PRAGMA user_version").Scan(&userVersion); err != nil {
+		return 0, 0, err
+	}
+	applied = legacyUserVersionMigrations(userVersion)
+	if applied > len(migrations) {
+		return 0, 0, fmt.Errorf("database user_version %d is newer than any known migration", userVersion)
+	}
+	return userVersion, applied, nil
+}
+
+// MigrationStatuses lists every known migration and whether the open
+// database has it. It only reads: on a database that predates
+// schema_migrations, the statuses come from its PRAGMA user_version.
+func MigrationStatuses() ([]MigrationStatus, error) {
+	if db == nil {
+		return nil, fmt.Errorf("traffic database is not open")
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, m := range migrations {
+		statuses[i] = MigrationStatus{Migration: m}
+	}
+	exists, err := migrationsTableExists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		userVersion, applied, err := legacyApplied(migrations)
+		if err != nil {
+			return nil, err
+		}
+		for i := range statuses[:applied] {
+			statuses[i].LegacyUserVersion = userVersion
+		}
+		return statuses, nil
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = parseTimestamp(appliedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range statuses {
+		statuses[i].AppliedAt = applied[statuses[i].Version]
+	}
+	return statuses, nil
+}
+
+// Migrate applies every pending migration in order, each in its own
+// transaction, and returns the ones it applied. It stops at the first that
+// fails, leaving the database at the last one that succeeded.
+func Migrate() ([]Migration, error) {
+	if db == nil {
+		return nil, fmt.Errorf("traffic database is not open")
+	}
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, s := range statuses {
+		if s.Applied() {
+			continue
+		}
+		if err := applyMigration(s.Migration); err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", s.Version, s.Name, err)
+		}
+		log.Info().Msgf("traffic: applied migration %04d_%s", s.Version, s.Name)
+		applied = append(applied, s.Migration)
+	}
+	return applied, nil
+}
+
+func applyMigration(m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		m.Version, m.Name, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
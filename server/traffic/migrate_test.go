@@ -0,0 +1,137 @@
+package traffic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func openUnmigratedTestDB(t *testing.T) {
+	t.Helper()
+	require.NoError(t, Open(filepath.Join(t.TempDir(), "traffic.db")))
+	t.Cleanup(func() {
+		Close()
+		db = nil
+	})
+}
+
+func requireAllMigrationsApplied(t *testing.T) {
+	t.Helper()
+	statuses, err := MigrationStatuses()
+	require.NoError(t, err)
+	require.NotEmpty(t, statuses)
+	for _, s := range statuses {
+		require.True(t, s.Applied(), "%04d_%s", s.Version, s.Name)
+	}
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	openUnmigratedTestDB(t)
+
+	statuses, err := MigrationStatuses()
+	require.NoError(t, err)
+	for _, s := range statuses {
+		require.False(t, s.Applied())
+	}
+
+	applied, err := Migrate()
+	require.NoError(t, err)
+	require.Len(t, applied, len(statuses))
+	requireAllMigrationsApplied(t)
+
+	applied, err = Migrate()
+	require.NoError(t, err)
+	require.Empty(t, applied, "nothing left to apply")
+}
+
+func TestMigrateBootstrapsFromUserVersion(t *testing.T) {
+	openUnmigratedTestDB(t)
+	// a database the old user_version upgrades had taken as far as the
+	// status column, with tables schema.sql used to create unconditionally
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	for _, m := range migrations[:3] {
+		_, err := db.Exec(m.SQL)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(migrations[9].SQL)
+	require.NoError(t, err)
+	// and the job_runs table the scheduler used to create itself
+	require.Equal(t, "job_runs", migrations[14].Name)
+	_, err = db.Exec(migrations[14].SQL)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO job_runs (job, trigger, started_at, outcome) VALUES ('expire-shows', 'schedule', '2026-01-01', 'ok')")
+	require.NoError(t, err)
+	_, err = db.Exec("PRAGMA user_version = 2")
+	require.NoError(t, err)
+
+	applied, err := Migrate()
+	require.NoError(t, err)
+	require.Len(t, applied, len(migrations)-3)
+	require.Equal(t, 4, applied[0].Version)
+	requireAllMigrationsApplied(t)
+
+	_, err = db.Exec("INSERT INTO requests (path, ip, timestamp, status, latency_us) VALUES ('/', '192.0.2.1', '2026-01-01', 200, 5)")
+	require.NoError(t, err)
+	require.Equal(t, 1, countRows(t, "job_runs"), "existing run history is kept")
+}
+
+func TestMigrationStatusesIsReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.db")
+	require.NoError(t, Open(path))
+	migrations, err := loadMigrations()
+	require.NoError(t, err)
+	for _, m := range migrations[:3] {
+		_, err := db.Exec(m.SQL)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec("PRAGMA user_version = 2")
+	require.NoError(t, err)
+	require.NoError(t, Close())
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	require.NoError(t, OpenReadOnly(path))
+	t.Cleanup(func() {
+		Close()
+		db = nil
+	})
+	statuses, err := MigrationStatuses()
+	require.NoError(t, err)
+	for _, s := range statuses {
+		if s.Version <= 3 {
+			require.Equal(t, 2, s.LegacyUserVersion, s.Name)
+			require.True(t, s.Applied())
+		} else {
+			require.False(t, s.Applied(), s.Name)
+		}
+	}
+	exists, err := migrationsTableExists()
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.NoError(t, Close())
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	openUnmigratedTestDB(t)
+	_, err := Migrate()
+	require.NoError(t, err)
+
+	err = applyMigration(Migration{
+		Version: 99,
+		Name:    "broken",
+		SQL:     "CREATE TABLE half_done (x INTEGER);\nINSERT INTO no_such_table VALUES (1);",
+	})
+	require.Error(t, err)
+
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'").Scan(&n))
+	require.Zero(t, n)
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = 99").Scan(&n))
+	require.Zero(t, n)
+}
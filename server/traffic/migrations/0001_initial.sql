@@ -1,4 +1,5 @@
--- Traffic monitoring schema
+-- Traffic monitoring schema as it stood before migrations were versioned;
+-- IF NOT EXISTS because databases from then already have it.
 
 CREATE TABLE IF NOT EXISTS requests (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -0,0 +1,2 @@
+-- NULL for permanent blocks
+ALTER TABLE bad_ips ADD COLUMN expires_at DATETIME;
@@ -0,0 +1 @@
+ALTER TABLE requests ADD COLUMN tls_version TEXT;
@@ -0,0 +1,13 @@
+-- one row per automatic ban; bad_ips holds the ban itself until it expires.
+-- IF NOT EXISTS because it predates versioned migrations.
+CREATE TABLE IF NOT EXISTS ban_decisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip TEXT NOT NULL,
+    rule TEXT NOT NULL,
+    hits INTEGER NOT NULL,
+    window_seconds INTEGER NOT NULL,
+    decided_at DATETIME NOT NULL,
+    banned_until DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_ban_decisions_decided_at ON ban_decisions(decided_at);
@@ -0,0 +1,18 @@
+-- requests older than the retention period, aggregated per day; status is 0
+-- for rows recorded before statuses were tracked. IF NOT EXISTS because these
+-- predate versioned migrations.
+CREATE TABLE IF NOT EXISTS daily_requests (
+    day TEXT NOT NULL,
+    path TEXT NOT NULL,
+    referrer_host TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    requests INTEGER NOT NULL,
+    unique_ips INTEGER NOT NULL,
+    PRIMARY KEY (day, path, referrer_host, status)
+);
+
+CREATE TABLE IF NOT EXISTS daily_totals (
+    day TEXT PRIMARY KEY,
+    requests INTEGER NOT NULL,
+    unique_ips INTEGER NOT NULL
+);
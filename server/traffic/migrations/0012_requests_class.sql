@@ -0,0 +1,5 @@
+-- human, crawler, feed_reader, monitor or scanner; NULL for requests recorded
+-- before classification
+ALTER TABLE requests ADD COLUMN class TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_requests_class ON requests(class);
@@ -0,0 +1,19 @@
+-- daily_requests gains class as part of its key, which SQLite can only do by
+-- rebuilding the table. Existing rollups predate classification and get ''.
+CREATE TABLE daily_requests_new (
+    day TEXT NOT NULL,
+    path TEXT NOT NULL,
+    referrer_host TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    class TEXT NOT NULL,
+    requests INTEGER NOT NULL,
+    unique_ips INTEGER NOT NULL,
+    PRIMARY KEY (day, path, referrer_host, status, class)
+);
+
+INSERT INTO daily_requests_new (day, path, referrer_host, status, class, requests, unique_ips)
+    SELECT day, path, referrer_host, status, '', requests, unique_ips FROM daily_requests;
+
+DROP TABLE daily_requests;
+
+ALTER TABLE daily_requests_new RENAME TO daily_requests;
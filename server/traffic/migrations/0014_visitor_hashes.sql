@@ -0,0 +1,10 @@
+-- privacy mode stores a salted hash of IP and user agent in place of the IP,
+-- for counting unique visitors; NULL for requests with a raw IP
+ALTER TABLE requests ADD COLUMN visitor_hash TEXT;
+
+-- one random salt per UTC day; older ones are deleted so hashes can't be
+-- traced back to an address
+CREATE TABLE visitor_salts (
+    day TEXT PRIMARY KEY,
+    salt BLOB NOT NULL
+);
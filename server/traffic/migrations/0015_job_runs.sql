@@ -0,0 +1,14 @@
+-- background job run history, written by the jobs package.
+-- IF NOT EXISTS because the scheduler created it itself before it moved here.
+CREATE TABLE IF NOT EXISTS job_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job TEXT NOT NULL,
+    trigger TEXT NOT NULL,
+    started_at DATETIME NOT NULL,
+    ended_at DATETIME,
+    outcome TEXT NOT NULL,
+    error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_runs_started_at ON job_runs(started_at);
+CREATE INDEX IF NOT EXISTS idx_job_runs_job ON job_runs(job, started_at);
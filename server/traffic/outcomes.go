@@ -0,0 +1,144 @@
+package traffic
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// outcomeWindow is how far back the admin page's error rate and slowest
+// route views look.
+const outcomeWindow = 24 * time.Hour
+
+// adminRoutesShown caps the slowest and erroring route tables on the admin
+// page.
+const adminRoutesShown = 15
+
+// StatusClassCount is how many requests in a window ended with a status in
+// one class, e.g. "4xx".
+type StatusClassCount struct {
+	Class   string
+	Count   int
+	Percent float64
+}
+
+// RouteStats summarizes the requests one route handled in a window. Route is
+// "" for requests no route matched.
+type RouteStats struct {
+	Method       string
+	Route        string
+	Requests     int
+	ClientErrors int
+	ServerErrors int
+	AvgLatency   time.Duration
+	MaxLatency   time.Duration
+	AvgBytes     int64
+}
+
+// ErrorRate is the percentage of the route's requests that ended in a 4xx
+// or 5xx.
+func (r RouteStats) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return 100 * float64(r.ClientErrors+r.ServerErrors) / float64(r.Requests)
+}
+
+// GetStatusClasses counts requests since the given time by status class,
+// limited to one traffic class unless class is "". Requests recorded before
+// statuses were tracked are left out.
+func GetStatusClasses(since time.Time, class Class) []StatusClassCount {
+	if db == nil {
+		return nil
+	}
+	filter, args := classFilter(class)
+	rows, err := db.Query(`
+		SELECT status / 100 AS status_class, COUNT(*)
+		FROM requests
+		WHERE timestamp >= ? AND status > 0`+filter+`
+		GROUP BY status_class
+		ORDER BY status_class
+	`, append([]any{since.UTC().Format(time.RFC3339Nano)}, args...)...)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query status classes")
+		return nil
+	}
+	defer rows.Close()
+
+	var results []StatusClassCount
+	total := 0
+	for rows.Next() {
+		var statusClass, count int
+		if err := rows.Scan(&statusClass, &count); err != nil {
+			log.Error().Err(err).Msg("failed to scan status class row")
+			continue
+		}
+		results = append(results, StatusClassCount{Class: fmt.Sprintf("%dxx", statusClass), Count: count})
+		total += count
+	}
+	for i := range results {
+		results[i].Percent = 100 * float64(results[i].Count) / float64(total)
+	}
+	return results
+}
+
+// GetSlowestRoutes lists the routes with the highest average latency since
+// the given time, slowest first.
+func GetSlowestRoutes(since time.Time, class Class, limit int) []RouteStats {
+	return getRouteStats(since, class, "", "avg_latency DESC", limit)
+}
+
+// GetErroringRoutes lists the matched routes that returned errors since the
+// given time, most server errors first. Unmatched requests are left out:
+// they're 404s for pages the site doesn't have.
+func GetErroringRoutes(since time.Time, class Class, limit int) []RouteStats {
+	return getRouteStats(since, class, "HAVING route != '' AND client_errors + server_errors > 0",
+		"server_errors DESC, client_errors DESC", limit)
+}
+
+func getRouteStats(since time.Time, class Class, having, orderBy string, limit int) []RouteStats {
+	if db == nil {
+		return nil
+	}
+	filter, args := classFilter(class)
+	args = append([]any{since.UTC().Format(time.RFC3339Nano)}, args...)
+	rows, err := db.Query(`
+		SELECT method, route, COUNT(*),
+			SUM(status >= 400 AND status < 500) AS client_errors,
+			SUM(status >= 500) AS server_errors,
+			AVG(latency_us) AS avg_latency, MAX(latency_us), AVG(bytes)
+		FROM requests
+		WHERE timestamp >= ? AND latency_us IS NOT NULL`+filter+`
+		GROUP BY method, route
+		`+having+`
+		ORDER BY `+orderBy+`
+		LIMIT ?
+	`, append(args, limit)...)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to query route stats")
+		return nil
+	}
+	defer rows.Close()
+
+	var results []RouteStats
+	for rows.Next() {
+		var s RouteStats
+		var method, route sql.NullString
+		var avgLatency, avgBytes float64
+		var maxLatency int64
+		if err := rows.Scan(&method, &route, &s.Requests, &s.ClientErrors, &s.ServerErrors,
+			&avgLatency, &maxLatency, &avgBytes); err != nil {
+			log.Error().Err(err).Msg("failed to scan route stats row")
+			continue
+		}
+		s.Method = method.String
+		s.Route = route.String
+		s.AvgLatency = time.Duration(avgLatency) * time.Microsecond
+		s.MaxLatency = time.Duration(maxLatency) * time.Microsecond
+		s.AvgBytes = int64(avgBytes)
+		results = append(results, s)
+	}
+	return results
+}
@@ -0,0 +1,96 @@
+package traffic
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackingMiddlewareRecordsOutcome(t *testing.T) {
+	openTestDB(t)
+	e := newTrackedEcho()
+	e.GET("/blog/:name", func(c echo.Context) error {
+		if c.Param("name") == "broken" {
+			return errors.New("template exploded")
+		}
+		time.Sleep(2 * time.Millisecond)
+		return c.String(http.StatusOK, "a post")
+	})
+
+	require.Equal(t, http.StatusOK, get(e, "192.0.2.1", "/blog/fiddle-tunes"))
+	require.Equal(t, http.StatusInternalServerError, get(e, "192.0.2.1", "/blog/broken"))
+	require.Equal(t, http.StatusNotFound, get(e, "192.0.2.1", "/nope"))
+	writer.flush()
+
+	byPath := map[string]Request{}
+	for _, b := range GetHourlyBuckets("") {
+		for _, r := range b.Requests {
+			byPath[r.Path] = r
+		}
+	}
+	require.Len(t, byPath, 3)
+
+	ok := byPath["/blog/fiddle-tunes"]
+	require.Equal(t, http.MethodGet, ok.Method)
+	require.Equal(t, "/blog/:name", ok.Route)
+	require.Equal(t, http.StatusOK, ok.Status)
+	require.Equal(t, int64(len("a post")), ok.Bytes)
+	require.GreaterOrEqual(t, ok.Latency, 2*time.Millisecond)
+
+	broken := byPath["/blog/broken"]
+	require.Equal(t, "/blog/:name", broken.Route)
+	require.Equal(t, http.StatusInternalServerError, broken.Status)
+	require.Positive(t, broken.Bytes, "the error page is counted")
+
+	require.Empty(t, byPath["/nope"].Route)
+	require.Equal(t, http.StatusNotFound, byPath["/nope"].Status)
+}
+
+func TestRouteStats(t *testing.T) {
+	openTestDB(t)
+	now := time.Now()
+	for _, r := range []Request{
+		{Path: "/", Method: "GET", Route: "/", Status: 200, Latency: 2 * time.Millisecond, Bytes: 100},
+		{Path: "/", Method: "GET", Route: "/", Status: 200, Latency: 4 * time.Millisecond, Bytes: 300},
+		{Path: "/sheet-music", Method: "GET", Route: "/sheet-music", Status: 200, Latency: 80 * time.Millisecond},
+		{Path: "/sheet-music", Method: "GET", Route: "/sheet-music", Status: 503, Latency: 20 * time.Millisecond},
+		{Path: "/blog/x", Method: "GET", Route: "/blog/:name", Status: 404, Latency: time.Millisecond},
+		{Path: "/wp-login.php", Method: "GET", Route: "", Status: 404, Latency: time.Millisecond},
+		// outside the window
+		{Path: "/", Method: "GET", Route: "/", Status: 500, Latency: time.Second, Timestamp: now.Add(-48 * time.Hour)},
+	} {
+		r.IP = "192.0.2.1"
+		RecordRequest(r)
+	}
+	writer.flush()
+	// recorded before outcomes were tracked
+	insertRequestAt(t, now.UTC().Format(time.RFC3339Nano), "/", "192.0.2.1", "", nil)
+
+	since := now.Add(-time.Hour)
+	require.Equal(t, []StatusClassCount{
+		{Class: "2xx", Count: 3, Percent: 50},
+		{Class: "4xx", Count: 2, Percent: 100.0 * 2 / 6},
+		{Class: "5xx", Count: 1, Percent: 100.0 / 6},
+	}, GetStatusClasses(since, ""))
+
+	slowest := GetSlowestRoutes(since, "", 2)
+	require.Len(t, slowest, 2)
+	require.Equal(t, "/sheet-music", slowest[0].Route)
+	require.Equal(t, 50*time.Millisecond, slowest[0].AvgLatency)
+	require.Equal(t, 80*time.Millisecond, slowest[0].MaxLatency)
+	require.Equal(t, 50.0, slowest[0].ErrorRate())
+	require.Equal(t, "/", slowest[1].Route)
+	require.Equal(t, 3*time.Millisecond, slowest[1].AvgLatency)
+	require.Equal(t, int64(200), slowest[1].AvgBytes)
+
+	erroring := GetErroringRoutes(since, "", 10)
+	require.Len(t, erroring, 2, "unmatched 404s aren't route errors")
+	require.Equal(t, "/sheet-music", erroring[0].Route)
+	require.Equal(t, 1, erroring[0].ServerErrors)
+	require.Equal(t, "/blog/:name", erroring[1].Route)
+	require.Equal(t, 1, erroring[1].ClientErrors)
+}
@@ -0,0 +1,219 @@
+package traffic
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Network prefixes that privacy mode keeps of a visitor's address: enough
+// to tell roughly where traffic comes from, not who sent it.
+const (
+	privacyIPv4Bits = 24
+	privacyIPv6Bits = 48
+)
+
+func privacyMode() bool {
+	return config.C.TrafficPrivacyMode
+}
+
+// truncateIP zeroes everything past the privacy prefix of ip, or returns ""
+// if ip isn't an address.
+func truncateIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := privacyIPv6Bits
+	if addr.Is4() {
+		bits = privacyIPv4Bits
+	}
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
+
+// visitorHash identifies one visitor (IP and user agent) within a day
+// without storing either: once the day's salt is deleted, the hash can't be
+// traced back to them.
+func visitorHash(salt []byte, ip, userAgent string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(ip))
+	h.Write([]byte{0})
+	h.Write([]byte(userAgent))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func newSalt() []byte {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return salt
+}
+
+// daySalt returns the salt for a UTC day ("2006-01-02"), creating it if it's
+// the first request that day. Creating one deletes those from before the
+// previous day, which is still kept for requests written just after
+// midnight.
+func daySalt(tx *sql.Tx, day string) ([]byte, error) {
+	var salt []byte
+	err := tx.QueryRow("SELECT salt FROM visitor_salts WHERE day = ?", day).Scan(&salt)
+	if err == nil {
+		return salt, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	salt = newSalt()
+	if _, err := tx.Exec("INSERT INTO visitor_salts (day, salt) VALUES (?, ?)", day, salt); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM visitor_salts WHERE day < date(?, '-1 day')", day); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// anonymizeSalt returns the salt to hash day's requests with when they're
+// converted after the fact. A day that has (or, being today or yesterday,
+// will have) a stored salt uses it, so a visitor recorded both ways is still
+// one visitor; older days get a fresh salt that's never stored.
+func anonymizeSalt(tx *sql.Tx, day string) ([]byte, error) {
+	var salt []byte
+	err := tx.QueryRow("SELECT salt FROM visitor_salts WHERE day = ?", day).Scan(&salt)
+	switch {
+	case err == nil:
+		return salt, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	case day >= time.Now().UTC().AddDate(0, 0, -1).Format(time.DateOnly):
+		return daySalt(tx, day)
+	}
+	return newSalt(), nil
+}
+
+// anonymizeBatch replaces each request's IP with its visitor hash and
+// truncated address, in the transaction that writes them.
+func anonymizeBatch(tx *sql.Tx, batch []Request) error {
+	salts := map[string][]byte{}
+	for i := range batch {
+		r := &batch[i]
+		day := r.Timestamp.UTC().Format("2006-01-02")
+		salt, ok := salts[day]
+		if !ok {
+			var err error
+			if salt, err = daySalt(tx, day); err != nil {
+				return err
+			}
+			salts[day] = salt
+		}
+		r.VisitorHash = visitorHash(salt, r.IP, r.UserAgent)
+		r.IP = truncateIP(r.IP)
+	}
+	return nil
+}
+
+// AnonymizeRequests converts requests recorded with raw IPs to the privacy
+// mode form, a day at a time. Days before yesterday are hashed with a fresh
+// salt that's never stored, so unique visitor counts survive but nothing can
+// be traced back; today and yesterday share the salt live requests use. The database is vacuumed afterwards so the raw addresses don't
+// linger in free pages.
+func AnonymizeRequests() (int64, error) {
+	if db == nil {
+		return 0, errors.New("traffic database is not open")
+	}
+	rows, err := db.Query("SELECT DISTINCT substr(timestamp, 1, 10) FROM requests WHERE visitor_hash IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, day := range days {
+		n, err := anonymizeDay(day)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	if total > 0 {
+		if _, err := db.Exec("VACUUM"); err != nil {
+			return total, err
+		}
+		if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			return total, err
+		}
+		log.Info().Msgf("traffic: anonymized %d requests over %d days", total, len(days))
+	}
+	return total, nil
+}
+
+func anonymizeDay(day string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		id            int64
+		ip, userAgent string
+	}
+	rows, err := tx.Query("SELECT id, ip, user_agent FROM requests WHERE substr(timestamp, 1, 10) = ? AND visitor_hash IS NULL", day)
+	if err != nil {
+		return 0, err
+	}
+	var pending []row
+	for rows.Next() {
+		var r row
+		var userAgent sql.NullString
+		if err := rows.Scan(&r.id, &r.ip, &userAgent); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		r.userAgent = userAgent.String
+		pending = append(pending, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("UPDATE requests SET ip = ?, visitor_hash = ? WHERE id = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	salt, err := anonymizeSalt(tx, day)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range pending {
+		if _, err := stmt.Exec(truncateIP(r.ip), visitorHash(salt, r.ip, r.userAgent), r.id); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(pending)), tx.Commit()
+}
@@ -0,0 +1,147 @@
+package traffic
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/stretchr/testify/require"
+)
+
+func setPrivacyMode(t *testing.T, on bool) {
+	t.Helper()
+	prev := config.C
+	config.C.TrafficPrivacyMode = on
+	t.Cleanup(func() { config.C = prev })
+}
+
+type storedRequest struct {
+	ip, visitorHash string
+}
+
+func storedRequests(t *testing.T) []storedRequest {
+	t.Helper()
+	rows, err := db.Query("SELECT ip, COALESCE(visitor_hash, '') FROM requests ORDER BY id")
+	require.NoError(t, err)
+	defer rows.Close()
+	var out []storedRequest
+	for rows.Next() {
+		var r storedRequest
+		require.NoError(t, rows.Scan(&r.ip, &r.visitorHash))
+		out = append(out, r)
+	}
+	return out
+}
+
+func TestTruncateIP(t *testing.T) {
+	for ip, want := range map[string]string{
+		"203.0.113.77":             "203.0.113.0",
+		"::ffff:203.0.113.77":      "203.0.113.0",
+		"2001:db8:abcd:12::1":      "2001:db8:abcd::",
+		"fe80::1%eth0":             "fe80::",
+		"not an ip":                "",
+		"2001:db8:abcd:ffff:1:2:3": "",
+	} {
+		require.Equal(t, want, truncateIP(ip), ip)
+	}
+}
+
+func TestPrivacyModeStoresVisitorHashes(t *testing.T) {
+	openTestDB(t)
+	setPrivacyMode(t, true)
+	today := time.Now()
+	yesterday := today.Add(-24 * time.Hour)
+	for _, r := range []Request{
+		{IP: "203.0.113.77", UserAgent: "firefox", Timestamp: today},
+		{IP: "203.0.113.77", UserAgent: "firefox", Timestamp: today},
+		{IP: "203.0.113.78", UserAgent: "firefox", Timestamp: today},
+		{IP: "203.0.113.77", UserAgent: "firefox", Timestamp: yesterday},
+	} {
+		r.Path = "/"
+		RecordRequest(r)
+	}
+	writer.flush()
+
+	stored := storedRequests(t)
+	require.Len(t, stored, 4)
+	for _, r := range stored {
+		require.Equal(t, "203.0.113.0", r.ip)
+		require.Len(t, r.visitorHash, 32)
+	}
+	require.Equal(t, stored[0].visitorHash, stored[1].visitorHash, "same visitor, same day")
+	require.NotEqual(t, stored[0].visitorHash, stored[2].visitorHash, "same network, different visitor")
+	require.NotEqual(t, stored[0].visitorHash, stored[3].visitorHash, "salts rotate daily")
+}
+
+func TestDaySaltPrunesOldSalts(t *testing.T) {
+	openTestDB(t)
+	for _, day := range []string{"2026-03-01", "2026-03-02", "2026-03-03", "2026-03-03"} {
+		tx, err := db.Begin()
+		require.NoError(t, err)
+		_, err = daySalt(tx, day)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+	}
+	rows, err := db.Query("SELECT day FROM visitor_salts ORDER BY day")
+	require.NoError(t, err)
+	defer rows.Close()
+	var days []string
+	for rows.Next() {
+		var day string
+		require.NoError(t, rows.Scan(&day))
+		days = append(days, day)
+	}
+	require.Equal(t, []string{"2026-03-02", "2026-03-03"}, days)
+}
+
+func TestAnonymizeRequests(t *testing.T) {
+	openTestDB(t)
+	ts := time.Now().UTC().Format(time.RFC3339Nano)
+	insertRequestAt(t, ts, "/", "198.51.100.7", "", 200)
+	insertRequestAt(t, ts, "/", "198.51.100.7", "", 200)
+	insertRequestAt(t, ts, "/", "198.51.100.8", "", 200)
+	insertRequestAt(t, ts, "/", "2001:db8:1:2::9", "", 200)
+	RecordSuspiciousRequest("/.env", "198.51.100.7", "")
+
+	n, err := AnonymizeRequests()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), n)
+
+	stored := storedRequests(t)
+	require.Equal(t, "198.51.100.0", stored[0].ip)
+	require.Equal(t, "2001:db8:1::", stored[3].ip)
+	require.Equal(t, stored[0].visitorHash, stored[1].visitorHash)
+	require.NotEqual(t, stored[0].visitorHash, stored[2].visitorHash)
+
+	var ip string
+	require.NoError(t, db.QueryRow("SELECT ip FROM suspicious_requests").Scan(&ip))
+	require.Equal(t, "198.51.100.7", ip, "security tables keep raw IPs")
+
+	n, err = AnonymizeRequests()
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestAnonymizingTodayMatchesLiveHashes(t *testing.T) {
+	openTestDB(t)
+	setPrivacyMode(t, true)
+	now := time.Now().UTC()
+	RecordRequest(Request{IP: "203.0.113.77", Path: "/", Timestamp: now})
+	writer.flush()
+	// recorded before privacy mode was turned on
+	insertRequestAt(t, now.Format(time.RFC3339Nano), "/blog", "203.0.113.77", "", 200)
+	n, err := AnonymizeRequests()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+	// and one merged in from an old database's export
+	res, err := ImportTable(strings.NewReader("timestamp,ip,path\n"+now.Format(time.RFC3339Nano)+",203.0.113.77,/music\n"), "requests", FormatCSV)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, res.Imported)
+
+	stored := storedRequests(t)
+	require.Len(t, stored, 3)
+	require.Equal(t, stored[0].visitorHash, stored[1].visitorHash, "one visitor, however the request was stored")
+	require.Equal(t, stored[0].visitorHash, stored[2].visitorHash)
+	require.Equal(t, 1, countRows(t, "visitor_salts"))
+}
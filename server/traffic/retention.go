@@ -0,0 +1,251 @@
+package traffic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Default retention, in days, for RETENTION_* settings left unset (0). A
+// negative setting keeps that table's rows forever.
+const (
+	defaultRequestsRetentionDays   = 30
+	defaultSuspiciousRetentionDays = 90
+	defaultFailedAuthRetentionDays = 90
+	defaultBanRetentionDays        = 365
+	defaultRollupRetentionDays     = -1
+)
+
+// RetentionResult is what one retention run did.
+type RetentionResult struct {
+	DaysRolledUp      int
+	RequestsRolledUp  int64
+	SuspiciousDeleted int64
+	FailedAuthDeleted int64
+	BansDeleted       int64
+	RollupsDeleted    int64
+	Vacuumed          bool
+}
+
+func retentionDays(setting, def int) int {
+	if setting == 0 {
+		return def
+	}
+	return setting
+}
+
+// cutoffDay is the first UTC day (YYYY-MM-DD) still inside a retention period
+// of days, or "" if rows are kept forever.
+func cutoffDay(now time.Time, days int) string {
+	if days < 0 {
+		return ""
+	}
+	return now.UTC().AddDate(0, 0, -days).Format(time.DateOnly)
+}
+
+// RunRetention rolls raw requests older than the requests retention period
+// into the daily rollup tables and deletes them, prunes the other tables to
+// their own retention periods, then compacts the database.
+func RunRetention(ctx context.Context) (RetentionResult, error) {
+	var res RetentionResult
+	if db == nil {
+		return res, fmt.Errorf("traffic database not initialized")
+	}
+	now := time.Now()
+
+	if cutoff := cutoffDay(now, retentionDays(config.C.RetentionRequestsDays, defaultRequestsRetentionDays)); cutoff != "" {
+		days, err := daysBefore("requests", cutoff)
+		if err != nil {
+			return res, err
+		}
+		for _, day := range days {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+			n, err := rollUpDay(day)
+			if err != nil {
+				return res, fmt.Errorf("rolling up %s: %w", day, err)
+			}
+			res.DaysRolledUp++
+			res.RequestsRolledUp += n
+		}
+	}
+
+	prunes := []struct {
+		table   string
+		column  string
+		days    int
+		deleted *int64
+	}{
+		{"suspicious_requests", "timestamp", retentionDays(config.C.RetentionSuspiciousDays, defaultSuspiciousRetentionDays), &res.SuspiciousDeleted},
+		{"failed_auths", "timestamp", retentionDays(config.C.RetentionFailedAuthDays, defaultFailedAuthRetentionDays), &res.FailedAuthDeleted},
+		{"ban_decisions", "decided_at", retentionDays(config.C.RetentionBanDays, defaultBanRetentionDays), &res.BansDeleted},
+		{"daily_requests", "day", retentionDays(config.C.RetentionRollupDays, defaultRollupRetentionDays), &res.RollupsDeleted},
+		{"daily_totals", "day", retentionDays(config.C.RetentionRollupDays, defaultRollupRetentionDays), &res.RollupsDeleted},
+	}
+	for _, p := range prunes {
+		cutoff := cutoffDay(now, p.days)
+		if cutoff == "" {
+			continue
+		}
+		r, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE substr(%s, 1, 10) < ?", p.table, p.column), cutoff)
+		if err != nil {
+			return res, fmt.Errorf("pruning %s: %w", p.table, err)
+		}
+		n, _ := r.RowsAffected()
+		*p.deleted += n
+	}
+
+	if res.RequestsRolledUp+res.SuspiciousDeleted+res.FailedAuthDeleted+res.BansDeleted+res.RollupsDeleted > 0 {
+		if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+			return res, fmt.Errorf("vacuum: %w", err)
+		}
+		res.Vacuumed = true
+	}
+	if _, err := db.ExecContext(ctx, "PRAGMA optimize"); err != nil {
+		return res, fmt.Errorf("optimize: %w", err)
+	}
+
+	log.Info().
+		Int("days_rolled_up", res.DaysRolledUp).
+		Int64("requests_rolled_up", res.RequestsRolledUp).
+		Int64("suspicious_deleted", res.SuspiciousDeleted).
+		Int64("failed_auths_deleted", res.FailedAuthDeleted).
+		Int64("ban_decisions_deleted", res.BansDeleted).
+		Int64("rollups_deleted", res.RollupsDeleted).
+		Bool("vacuumed", res.Vacuumed).
+		Msg("traffic: retention run finished")
+	return res, nil
+}
+
+// daysBefore lists the distinct days with rows in table older than cutoff,
+// oldest first. Timestamps in every format the table has used start with
+// the date, so the first ten characters are the day.
+func daysBefore(table, cutoff string) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT DISTINCT substr(timestamp, 1, 10) AS day FROM %s WHERE substr(timestamp, 1, 10) < ? ORDER BY day", table,
+	), cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var days []string
+	for rows.Next() {
+		var day string
+		if err := rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	return days, rows.Err()
+}
+
+type rollupKey struct {
+	path         string
+	referrerHost string
+	status       int
+	class        string
+}
+
+type rollupCounts struct {
+	requests int
+	ips      map[string]struct{}
+}
+
+// rollUpDay aggregates one day of raw requests into daily_requests and
+// daily_totals and deletes them, in a single transaction so a day is never
+// half rolled up. It returns how many raw rows it rolled up.
+func rollUpDay(day string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// unique_ips counts visitors: the visitor hash where privacy mode has
+	// replaced the IP, which on its own is only a network prefix
+	rows, err := tx.Query(`
+		SELECT path, COALESCE(visitor_hash, ip), referrer, status, class
+		FROM requests WHERE substr(timestamp, 1, 10) = ?`, day)
+	if err != nil {
+		return 0, err
+	}
+	groups := map[rollupKey]*rollupCounts{}
+	dayIPs := map[string]struct{}{}
+	var total int64
+	for rows.Next() {
+		var path, visitor string
+		var referrer, class sql.NullString
+		var status sql.NullInt64
+		if err := rows.Scan(&path, &visitor, &referrer, &status, &class); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		k := rollupKey{path: path, referrerHost: referrerHost(referrer.String), status: int(status.Int64), class: class.String}
+		g := groups[k]
+		if g == nil {
+			g = &rollupCounts{ips: map[string]struct{}{}}
+			groups[k] = g
+		}
+		g.requests++
+		g.ips[visitor] = struct{}{}
+		dayIPs[visitor] = struct{}{}
+		total++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// a day is normally rolled up once, but rows restored or backdated into
+	// an already rolled-up day are merged in: request counts add up, while
+	// unique IPs can't be merged exactly so the larger count is kept
+	stmt, err := tx.Prepare(`
+		INSERT INTO daily_requests (day, path, referrer_host, status, class, requests, unique_ips) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(day, path, referrer_host, status, class) DO UPDATE SET
+			requests = requests + excluded.requests,
+			unique_ips = MAX(unique_ips, excluded.unique_ips)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for k, g := range groups {
+		if _, err := stmt.Exec(day, k.path, k.referrerHost, k.status, k.class, g.requests, len(g.ips)); err != nil {
+			return 0, err
+		}
+	}
+	_, err = tx.Exec(`
+		INSERT INTO daily_totals (day, requests, unique_ips) VALUES (?, ?, ?)
+		ON CONFLICT(day) DO UPDATE SET
+			requests = requests + excluded.requests,
+			unique_ips = MAX(unique_ips, excluded.unique_ips)`,
+		day, total, len(dayIPs))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM requests WHERE substr(timestamp, 1, 10) = ?", day); err != nil {
+		return 0, err
+	}
+	return total, tx.Commit()
+}
+
+// referrerHost reduces a referrer to its host, so rollups group
+// "https://news.ycombinator.com/item?id=1" and "...?id=2" together. Direct
+// visits (no referrer) are "".
+func referrerHost(referrer string) string {
+	referrer = strings.TrimSpace(referrer)
+	if referrer == "" {
+		return ""
+	}
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return referrer
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
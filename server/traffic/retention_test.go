@@ -0,0 +1,104 @@
+package traffic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/stretchr/testify/require"
+)
+
+func insertRequestAt(t *testing.T, ts, path, ip, referrer string, status any) {
+	t.Helper()
+	_, err := db.Exec(
+		"INSERT INTO requests (path, ip, user_agent, referrer, timestamp, status) VALUES (?, ?, '', ?, ?, ?)",
+		path, ip, referrer, ts, status,
+	)
+	require.NoError(t, err)
+}
+
+func countRows(t *testing.T, table string) int {
+	t.Helper()
+	var n int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+	return n
+}
+
+func TestRunRetentionRollsUpOldRequests(t *testing.T) {
+	openTestDB(t)
+	prev := config.C
+	config.C.RetentionRequestsDays = 7
+	config.C.RetentionSuspiciousDays = 30
+	config.C.RetentionFailedAuthDays = -1
+	t.Cleanup(func() { config.C = prev })
+
+	old := time.Now().UTC().AddDate(0, 0, -10)
+	oldDay := old.Format(time.DateOnly)
+	oldTS := old.Format(time.RFC3339Nano)
+	insertRequestAt(t, oldTS, "/", "1.1.1.1", "https://www.google.com/search?q=fiddle", 200)
+	insertRequestAt(t, oldTS, "/", "2.2.2.2", "https://google.com/", 200)
+	insertRequestAt(t, oldTS, "/", "1.1.1.1", "https://www.google.com/search?q=tunes", 200)
+	insertRequestAt(t, oldTS, "/sheet-music", "1.1.1.1", "", 200)
+	// recorded before statuses were tracked, in an older timestamp format
+	insertRequestAt(t, old.Format("2006-01-02 15:04:05.999999999 -0700 MST"), "/", "3.3.3.3", "", nil)
+	recent := time.Now().UTC().Format(time.RFC3339Nano)
+	insertRequestAt(t, recent, "/", "4.4.4.4", "", 200)
+
+	_, err := db.Exec("INSERT INTO suspicious_requests (path, ip, user_agent, timestamp) VALUES ('/.env', '5.5.5.5', '', ?), ('/.env', '5.5.5.5', '', ?)",
+		time.Now().UTC().AddDate(0, 0, -40).Format(time.RFC3339Nano), recent)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO failed_auths (ip, timestamp) VALUES ('6.6.6.6', ?)", time.Now().UTC().AddDate(-2, 0, 0).Format(time.RFC3339Nano))
+	require.NoError(t, err)
+
+	res, err := RunRetention(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 1, res.DaysRolledUp)
+	require.Equal(t, int64(5), res.RequestsRolledUp)
+	require.Equal(t, int64(1), res.SuspiciousDeleted)
+	require.Zero(t, res.FailedAuthDeleted, "negative retention keeps rows forever")
+	require.True(t, res.Vacuumed)
+
+	require.Equal(t, 1, countRows(t, "requests"), "only the recent request is left raw")
+	require.Equal(t, 1, countRows(t, "suspicious_requests"))
+	require.Equal(t, 1, countRows(t, "failed_auths"))
+
+	type rollup struct {
+		path, host       string
+		status, requests int
+		uniqueIPs        int
+	}
+	rows, err := db.Query("SELECT path, referrer_host, status, requests, unique_ips FROM daily_requests WHERE day = ? ORDER BY path, referrer_host, status", oldDay)
+	require.NoError(t, err)
+	var got []rollup
+	for rows.Next() {
+		var r rollup
+		require.NoError(t, rows.Scan(&r.path, &r.host, &r.status, &r.requests, &r.uniqueIPs))
+		got = append(got, r)
+	}
+	require.NoError(t, rows.Close())
+	require.Equal(t, []rollup{
+		{"/", "", 0, 1, 1},
+		{"/", "google.com", 200, 3, 2},
+		{"/sheet-music", "", 200, 1, 1},
+	}, got)
+
+	var total, unique int
+	require.NoError(t, db.QueryRow("SELECT requests, unique_ips FROM daily_totals WHERE day = ?", oldDay).Scan(&total, &unique))
+	require.Equal(t, 5, total)
+	require.Equal(t, 3, unique)
+
+	// nothing left to do on a second run
+	res, err = RunRetention(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, res.DaysRolledUp)
+	require.False(t, res.Vacuumed)
+}
+
+func TestReferrerHost(t *testing.T) {
+	require.Equal(t, "", referrerHost(""))
+	require.Equal(t, "news.ycombinator.com", referrerHost("https://news.ycombinator.com/item?id=1"))
+	require.Equal(t, "google.com", referrerHost("https://WWW.Google.com/"))
+	require.Equal(t, "com.slack", referrerHost("android-app://com.slack"))
+	require.Equal(t, "not a url", referrerHost("not a url"))
+}
@@ -1,48 +1,101 @@
 package traffic
 
 import (
+	"crypto/tls"
 	"database/sql"
-	_ "embed"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/andrewwillette/andrewwillettedotcom/jobs"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
 	_ "modernc.org/sqlite"
 )
 
-//go:embed schema.sql
-var schema string
-
 var db *sql.DB
 
-func InitDB(dbPath string) error {
+// Open opens the traffic database without migrating it or starting the
+// request writer, for tools that manage the schema themselves.
+func Open(dbPath string) error {
 	var err error
-	db, err = sql.Open("sqlite", dbPath)
-	if err != nil {
+	db, err = sql.Open("sqlite", sqliteDSN(dbPath))
+	return err
+}
+
+// OpenReadOnly opens an existing traffic database for reading only, for
+// tools that must not change it (migrate status). Unlike Open it doesn't
+// switch the file to WAL or create it if it's missing.
+func OpenReadOnly(dbPath string) error {
+	var err error
+	db, err = sql.Open("sqlite", "file:"+dbPath+"?mode=ro&_pragma=busy_timeout(5000)")
+	return err
+}
+
+// InitDB opens the traffic database, applies any pending migrations and
+// starts writing tracked requests to it.
+func InitDB(dbPath string) error {
+	if err := Open(dbPath); err != nil {
 		return err
 	}
-
-	_, err = db.Exec(schema)
+	if _, err := Migrate(); err != nil {
+		return fmt.Errorf("migrating traffic database: %w", err)
+	}
+	c, err := newClassifier()
 	if err != nil {
-		return err
+		return fmt.Errorf("loading traffic classifier: %w", err)
 	}
+	reqClassifier = c
 
+	writer = newRequestWriter()
 	log.Info().Msgf("traffic: database initialized at %s", dbPath)
 	return nil
 }
 
+// DB returns the traffic database, or nil if InitDB hasn't succeeded. Other
+// packages that keep operational history (e.g. job runs) share it.
+func DB() *sql.DB {
+	return db
+}
+
+// Close writes any requests still queued and closes the traffic database,
+// if it was opened.
+func Close() error {
+	if writer != nil {
+		writer.close()
+		writer = nil
+	}
+	if db == nil {
+		return nil
+	}
+	return db.Close()
+}
+
+// Request is one tracked request. The outcome fields (Method onwards) are
+// zero for requests recorded before they were tracked.
 type Request struct {
-	Path      string
-	IP        string
-	UserAgent string
-	Referrer  string
-	Timestamp time.Time
+	Path       string
+	IP         string
+	UserAgent  string
+	Referrer   string
+	Timestamp  time.Time
+	Method     string
+	Route      string // matched route pattern, e.g. "/blog/:name"; "" when nothing matched
+	Status     int
+	Bytes      int64
+	Latency    time.Duration
+	Proto      string // e.g. "HTTP/2.0"
+	TLSVersion string // e.g. "TLS 1.3"; "" for plain HTTP, including behind a TLS-terminating proxy
+	Class      Class  // "" for requests recorded before classification
+
+	// VisitorHash identifies the visitor within a day when IP has been
+	// truncated by privacy mode; "" otherwise.
+	VisitorHash string
 }
 
 type HourlyBucket struct {
@@ -84,18 +137,18 @@ func isSuspiciousPath(path string) bool {
 	return false
 }
 
-func RecordRequest(path, ip, userAgent, referrer string) {
-	if db == nil {
+// RecordRequest queues a request to be written by the background writer; it
+// never blocks on the database. A zero Timestamp means now. In privacy mode
+// the writer replaces the IP with a visitor hash and truncated address
+// before it's stored.
+func RecordRequest(req Request) {
+	if writer == nil {
 		return
 	}
-	timestamp := time.Now().UTC().Format(time.RFC3339Nano)
-	_, err := db.Exec(
-		"INSERT INTO requests (path, ip, user_agent, referrer, timestamp) VALUES (?, ?, ?, ?, ?)",
-		path, ip, userAgent, referrer, timestamp,
-	)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to record request")
+	if req.Timestamp.IsZero() {
+		req.Timestamp = time.Now()
 	}
+	writer.enqueue(req)
 }
 
 func RecordSuspiciousRequest(path, ip, userAgent string) {
@@ -214,17 +267,22 @@ func GetSuspiciousSummary() []SuspiciousSummary {
 	return results
 }
 
-func GetHourlyBuckets() []HourlyBucket {
+// GetHourlyBuckets groups the most recent requests by hour, limited to one
+// class unless class is "".
+func GetHourlyBuckets(class Class) []HourlyBucket {
 	if db == nil {
 		return nil
 	}
 
+	filter, args := classFilter(class)
 	rows, err := db.Query(`
-		SELECT path, ip, user_agent, referrer, timestamp
+		SELECT path, ip, user_agent, referrer, timestamp,
+			method, route, status, bytes, latency_us, class
 		FROM requests
+		WHERE 1 = 1`+filter+`
 		ORDER BY timestamp DESC
 		LIMIT 1000
-	`)
+	`, args...)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to query requests")
 		return nil
@@ -234,14 +292,22 @@ func GetHourlyBuckets() []HourlyBucket {
 	bucketMap := make(map[string][]Request)
 	for rows.Next() {
 		var req Request
-		var userAgent, referrer sql.NullString
+		var userAgent, referrer, method, route, reqClass sql.NullString
+		var status, bytes, latencyUS sql.NullInt64
 		var timestampStr string
-		if err := rows.Scan(&req.Path, &req.IP, &userAgent, &referrer, &timestampStr); err != nil {
+		if err := rows.Scan(&req.Path, &req.IP, &userAgent, &referrer, &timestampStr,
+			&method, &route, &status, &bytes, &latencyUS, &reqClass); err != nil {
 			log.Error().Err(err).Msg("failed to scan request row")
 			continue
 		}
 		req.UserAgent = userAgent.String
 		req.Referrer = referrer.String
+		req.Method = method.String
+		req.Route = route.String
+		req.Status = int(status.Int64)
+		req.Bytes = bytes.Int64
+		req.Latency = time.Duration(latencyUS.Int64) * time.Microsecond
+		req.Class = Class(reqClass.String)
 		req.Timestamp = parseTimestamp(timestampStr)
 
 		hourKey := req.Timestamp.Format("2006-01-02 15:00")
@@ -257,24 +323,19 @@ func GetHourlyBuckets() []HourlyBucket {
 	}
 
 	// Sort buckets by hour descending (most recent first)
-	for i := 0; i < len(buckets)-1; i++ {
-		for j := i + 1; j < len(buckets); j++ {
-			if buckets[i].Hour < buckets[j].Hour {
-				buckets[i], buckets[j] = buckets[j], buckets[i]
-			}
-		}
-	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Hour > buckets[j].Hour })
 
 	return buckets
 }
 
-func getTotalRequestCount() int {
+func getTotalRequestCount(class Class) int {
 	if db == nil {
 		return 0
 	}
 
+	filter, args := classFilter(class)
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM requests").Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM requests WHERE 1 = 1"+filter, args...).Scan(&count)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to count requests")
 		return 0
@@ -311,20 +372,70 @@ func humanBytes(b int64) string {
 	)
 }
 
+// TrackingMiddleware records every request along with how it turned out.
+// Errors are handed to the HTTP error handler here rather than further out,
+// so the recorded status and size are those of the error page actually sent.
 func TrackingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		path := c.Request().URL.Path
-		ip := c.RealIP()
-		userAgent := c.Request().UserAgent()
-
-		RecordRequest(path, ip, userAgent, c.Request().Referer())
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
 
-		if isSuspiciousPath(path) {
-			RecordSuspiciousRequest(path, ip, userAgent)
+		r := c.Request()
+		req := Request{
+			Path:      r.URL.Path,
+			IP:        c.RealIP(),
+			UserAgent: r.UserAgent(),
+			Referrer:  r.Referer(),
+			Timestamp: start,
+			Method:    r.Method,
+			Route:     matchedRoute(c, err),
+			Status:    c.Response().Status,
+			Bytes:     c.Response().Size,
+			Latency:   time.Since(start),
+			Proto:     r.Proto,
+		}
+		if r.TLS != nil {
+			req.TLSVersion = tls.VersionName(r.TLS.Version)
+		}
+		if reqClassifier != nil {
+			req.Class = reqClassifier.classify(req)
+		}
+		RecordRequest(req)
+
+		// only probes for pages the site doesn't have count, so visiting the
+		// real admin page never looks like an attack
+		if isSuspiciousPath(req.Path) && isUnroutedStatus(req.Status) {
+			RecordSuspiciousRequest(req.Path, req.IP, req.UserAgent)
+			// a miss under the site's own admin pages is most likely the owner
+			// mistyping; those pages are behind basic auth and rate limited
+			if !isAdminPath(req.Path) {
+				checkAutoban(req.IP, RuleSuspiciousPaths)
+			}
 		}
+		return nil
+	}
+}
 
-		return next(c)
+// matchedRoute is the route pattern that handled the request, or "" when the
+// router found none. Echo leaves the closest node's path in c.Path() on a
+// miss, so the router's own not-found errors are what tell the cases apart.
+func matchedRoute(c echo.Context, err error) string {
+	if err == echo.ErrNotFound || err == echo.ErrMethodNotAllowed {
+		return ""
 	}
+	return c.Path()
+}
+
+// isAdminPath reports whether path is under the site's /admin prefix.
+func isAdminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+func isUnroutedStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusMethodNotAllowed
 }
 
 type AdminPageData struct {
@@ -334,22 +445,60 @@ type AdminPageData struct {
 	DBSize             string
 	SuspiciousRequests []SuspiciousSummary
 	FailedAuths        []FailedAuthSummary
+	Jobs               []jobs.Status
+	JobRuns            []jobs.Run
+	BanDecisions       []BanDecision
+	DroppedRequests    uint64
+	StatusClasses      []StatusClassCount
+	SlowestRoutes      []RouteStats
+	ErroringRoutes     []RouteStats
+	Class              Class // filter applied to the traffic views; "" for all
+	ClassCounts        []ClassCount
+	CSRFToken          string // for the forms that POST back to /admin
 }
 
-func HandleAdminPage(c echo.Context) error {
-	log.Info().Msg("HandleAdminPage")
-	buckets := GetHourlyBuckets()
+// adminJobRunsShown caps the job history table on the admin page.
+const adminJobRunsShown = 25
+
+// adminBanDecisionsShown caps the automatic bans table on the admin page.
+const adminBanDecisionsShown = 50
 
-	data := AdminPageData{
-		CurrentYear:        time.Now().Year(),
-		Buckets:            buckets,
-		TotalCount:         getTotalRequestCount(),
-		DBSize:             humanBytes(getDBSize()),
-		SuspiciousRequests: GetSuspiciousSummary(),
-		FailedAuths:        GetFailedAuthSummary(),
+// AdminPageHandler renders the admin page, including the background jobs
+// registered with sched and their recent runs.
+func AdminPageHandler(sched *jobs.Scheduler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		log.Info().Msg("HandleAdminPage")
+		// an unknown ?class= shows everything rather than nothing
+		class, _ := ParseClass(c.QueryParam("class"))
+		buckets := GetHourlyBuckets(class)
+		outcomesSince := time.Now().Add(-outcomeWindow)
+
+		runs, err := sched.RecentRuns(adminJobRunsShown)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to load job runs")
+		}
+		csrfToken, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+		data := AdminPageData{
+			CurrentYear:        time.Now().Year(),
+			Buckets:            buckets,
+			TotalCount:         getTotalRequestCount(class),
+			DBSize:             humanBytes(getDBSize()),
+			SuspiciousRequests: GetSuspiciousSummary(),
+			FailedAuths:        GetFailedAuthSummary(),
+			Jobs:               sched.Statuses(),
+			JobRuns:            runs,
+			BanDecisions:       GetBanDecisions(adminBanDecisionsShown),
+			DroppedRequests:    DroppedRequests(),
+			StatusClasses:      GetStatusClasses(outcomesSince, class),
+			SlowestRoutes:      GetSlowestRoutes(outcomesSince, class, adminRoutesShown),
+			ErroringRoutes:     GetErroringRoutes(outcomesSince, class, adminRoutesShown),
+			Class:              class,
+			ClassCounts:        GetClassCounts(outcomesSince),
+			CSRFToken:          csrfToken,
+		}
+		log.Info().Msg("Rendering admin page")
+		return c.Render(http.StatusOK, "adminpage", data)
 	}
-	log.Info().Msg("Rendering admin page")
-	return c.Render(http.StatusOK, "adminpage", data)
 }
 
 func BasicAuthMiddleware() echo.MiddlewareFunc {
@@ -359,6 +508,7 @@ func BasicAuthMiddleware() echo.MiddlewareFunc {
 		}
 		RecordFailedAuth(c.RealIP())
 		log.Info().Msgf("failed auth attempt from IP: %s", c.RealIP())
+		checkAutoban(c.RealIP(), RuleFailedAuths)
 		return false, nil
 	})
 }
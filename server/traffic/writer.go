@@ -0,0 +1,246 @@
+package traffic
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/rs/zerolog/log"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Defaults for the TRAFFIC_* write settings left unset (0).
+const (
+	defaultWriteBuffer   = 4096
+	defaultBatchSize     = 200
+	defaultFlushInterval = 500 * time.Millisecond
+)
+
+// requestWriter moves request inserts off the request path: handlers queue
+// rows on a buffered channel and a single goroutine writes them in
+// transactions of up to batchSize rows, or whatever has arrived every
+// interval. When the buffer is full, rows are dropped and counted rather than
+// making a handler wait on the database. A batch that can't be written
+// because something else holds the database lock (the nightly VACUUM, an
+// anonymize run) is kept and retried every interval, up to a buffer's worth
+// of rows; any other failed write is counted as dropped too.
+type requestWriter struct {
+	rows      chan Request
+	flushReq  chan chan struct{}
+	done      chan struct{}
+	batchSize int
+	interval  time.Duration
+
+	dropped       atomic.Uint64
+	droppedLogged uint64 // only touched by run
+	mu            sync.RWMutex
+	closed        bool
+}
+
+var writer *requestWriter
+
+func newRequestWriter() *requestWriter {
+	buffer := config.C.TrafficWriteBuffer
+	if buffer <= 0 {
+		buffer = defaultWriteBuffer
+	}
+	batchSize := config.C.TrafficBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	interval := defaultFlushInterval
+	if config.C.TrafficFlushMillis > 0 {
+		interval = time.Duration(config.C.TrafficFlushMillis) * time.Millisecond
+	}
+	w := &requestWriter{
+		rows:      make(chan Request, buffer),
+		flushReq:  make(chan chan struct{}),
+		done:      make(chan struct{}),
+		batchSize: batchSize,
+		interval:  interval,
+	}
+	go w.run()
+	return w
+}
+
+// enqueue queues a row without ever blocking.
+func (w *requestWriter) enqueue(r Request) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+	select {
+	case w.rows <- r:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// flush writes everything queued so far and returns once it's in the
+// database.
+func (w *requestWriter) flush() {
+	ack := make(chan struct{})
+	select {
+	case w.flushReq <- ack:
+		<-ack
+	case <-w.done:
+	}
+}
+
+// close stops accepting rows, writes whatever is still queued and waits for
+// the writer to exit.
+func (w *requestWriter) close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.rows)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *requestWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]Request, 0, w.batchSize)
+	var retryAt time.Time // while the database is locked, only the ticker retries
+	write := func() {
+		if len(batch) > 0 {
+			err := w.write(batch)
+			switch {
+			case err == nil:
+				batch = batch[:0]
+				retryAt = time.Time{}
+			case isBusy(err) && len(batch) < cap(w.rows):
+				log.Warn().Err(err).Msgf("traffic: database busy, will retry %d requests", len(batch))
+				retryAt = time.Now().Add(w.interval)
+			default:
+				log.Error().Err(err).Msgf("failed to record %d requests", len(batch))
+				w.dropped.Add(uint64(len(batch)))
+				batch = batch[:0]
+				retryAt = time.Time{}
+			}
+		}
+		w.logDropped()
+	}
+	// dropPending counts rows still waiting on a locked database when the
+	// writer stops.
+	dropPending := func() {
+		if len(batch) > 0 {
+			w.dropped.Add(uint64(len(batch)))
+			batch = batch[:0]
+			w.logDropped()
+		}
+	}
+	for {
+		select {
+		case r, ok := <-w.rows:
+			if !ok {
+				write()
+				dropPending()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= w.batchSize && time.Now().After(retryAt) {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case ack := <-w.flushReq:
+		drain:
+			for {
+				select {
+				case r, ok := <-w.rows:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, r)
+					if len(batch) >= w.batchSize && time.Now().After(retryAt) {
+						write()
+					}
+				default:
+					break drain
+				}
+			}
+			write()
+			close(ack)
+		}
+	}
+}
+
+func (w *requestWriter) write(batch []Request) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if privacyMode() {
+		if err := anonymizeBatch(tx, batch); err != nil {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare(`INSERT INTO requests
+		(path, ip, user_agent, referrer, timestamp, method, route, status, bytes, latency_us, proto, tls_version, class, visitor_hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		if _, err := stmt.Exec(r.Path, r.IP, r.UserAgent, r.Referrer, r.Timestamp.UTC().Format(time.RFC3339Nano),
+			r.Method, r.Route, r.Status, r.Bytes, r.Latency.Microseconds(), r.Proto, r.TLSVersion, r.Class, r.VisitorHash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// isBusy reports whether err is SQLite giving up on a lock another
+// connection held past the busy timeout.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff // primary code, without the extended bits
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// logDropped warns when more rows have been dropped since it last looked.
+func (w *requestWriter) logDropped() {
+	total := w.dropped.Load()
+	if total == w.droppedLogged {
+		return
+	}
+	log.Warn().Msgf("traffic: dropped %d requests (%d since start)", total-w.droppedLogged, total)
+	w.droppedLogged = total
+}
+
+// DroppedRequests is how many requests weren't recorded, because the write
+// buffer was full or writing them failed, since the database was opened.
+func DroppedRequests() uint64 {
+	if writer == nil {
+		return 0
+	}
+	return writer.dropped.Load()
+}
+
+// sqliteDSN adds the connection settings the traffic database needs to a
+// file path: WAL so the admin page and retention job can read while requests
+// are written, and a busy timeout so the writers (request batches, job runs,
+// autoban) wait on each other instead of failing with SQLITE_BUSY.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+}
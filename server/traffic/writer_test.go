@@ -0,0 +1,109 @@
+package traffic
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/andrewwillette/andrewwillettedotcom/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordRequestBatchesWrites(t *testing.T) {
+	openTestDB(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Go(func() {
+			for j := 0; j < 50; j++ {
+				RecordRequest(Request{Path: "/", IP: "192.0.2.1", Status: 200})
+			}
+		})
+	}
+	wg.Wait()
+	writer.flush()
+	require.Equal(t, 400, countRows(t, "requests"))
+	require.Zero(t, DroppedRequests())
+
+	var mode string
+	require.NoError(t, db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	require.Equal(t, "wal", mode)
+}
+
+func TestRecordRequestDropsWhenBufferFull(t *testing.T) {
+	openTestDB(t)
+	// swap in a writer that isn't draining its one-row buffer
+	writer.close()
+	writer = &requestWriter{rows: make(chan Request, 1), batchSize: 10}
+	t.Cleanup(func() { writer = nil })
+
+	RecordRequest(Request{Path: "/a", IP: "192.0.2.1", Status: 200})
+	RecordRequest(Request{Path: "/b", IP: "192.0.2.1", Status: 200})
+	RecordRequest(Request{Path: "/c", IP: "192.0.2.1", Status: 200})
+	require.Equal(t, uint64(2), DroppedRequests())
+}
+
+func TestCloseFlushesQueuedRequests(t *testing.T) {
+	prev := config.C
+	config.C.TrafficFlushMillis = 60 * 60 * 1000 // only a full batch or Close writes
+	t.Cleanup(func() { config.C = prev })
+	path := filepath.Join(t.TempDir(), "traffic.db")
+
+	require.NoError(t, InitDB(path))
+	for i := 0; i < 3; i++ {
+		RecordRequest(Request{Path: "/", IP: "192.0.2.1", Status: 200})
+	}
+	require.NoError(t, Close())
+	RecordRequest(Request{Path: "/after-close", IP: "192.0.2.1", Status: 200}) // ignored, not a panic
+
+	require.NoError(t, InitDB(path))
+	t.Cleanup(func() {
+		Close()
+		db = nil
+	})
+	require.Equal(t, 3, countRows(t, "requests"))
+}
+
+func TestWriterRetriesWhileDatabaseLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.db")
+	require.NoError(t, InitDB(path))
+	t.Cleanup(func() {
+		Close()
+		db = nil
+	})
+	// one connection with a short busy timeout, so the writer gives up fast
+	db.SetMaxOpenConns(1)
+	_, err := db.Exec("PRAGMA busy_timeout = 20")
+	require.NoError(t, err)
+
+	other, err := sql.Open("sqlite", sqliteDSN(path))
+	require.NoError(t, err)
+	t.Cleanup(func() { other.Close() })
+	lock, err := other.Conn(context.Background())
+	require.NoError(t, err)
+	defer lock.Close()
+	_, err = lock.ExecContext(context.Background(), "BEGIN IMMEDIATE")
+	require.NoError(t, err)
+
+	RecordRequest(Request{Path: "/", IP: "192.0.2.1", Status: 200})
+	writer.flush()
+	require.Zero(t, countRows(t, "requests"))
+	require.Zero(t, DroppedRequests(), "kept for a retry, not dropped")
+
+	_, err = lock.ExecContext(context.Background(), "COMMIT")
+	require.NoError(t, err)
+	writer.flush()
+	require.Equal(t, 1, countRows(t, "requests"))
+	require.Zero(t, DroppedRequests())
+}
+
+func TestWriterCountsFailedWritesAsDropped(t *testing.T) {
+	openTestDB(t)
+	_, err := db.Exec("DROP TABLE requests")
+	require.NoError(t, err)
+	RecordRequest(Request{Path: "/", IP: "192.0.2.1", Status: 200})
+	RecordRequest(Request{Path: "/", IP: "192.0.2.2", Status: 200})
+	writer.flush()
+	require.Equal(t, uint64(2), DroppedRequests())
+}